@@ -0,0 +1,73 @@
+package main
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jddwoody/album/pkg/album"
+)
+
+// album dupes [-json] [-distance bits] [-quarantine dir] <albumKey>
+func dupes(args []string) int {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Report the clusters as JSON")
+	distance := flags.Int("distance", album.DEFAULT_DUPE_DISTANCE, "How many bits of their hashes copies can differ in")
+	quarantine := flags.String("quarantine", "", "Move all but the biggest copy of each photo into this directory, outside albumDir")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s dupes [options] <albumKey>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	app, err := album.LoadAppConfigFile()
+	if err != nil {
+		log.Printf("Error loading config file %s, err:%v", album.APP_CONFIG_FILENAME, err)
+		return 1
+	}
+	a := album.New(album.WithAppConfig(app), album.WithLogger(log.New(os.Stderr, "", log.LstdFlags)))
+	clusters, err := a.FindDuplicates(flags.Arg(0), *distance)
+	if err != nil {
+		log.Printf("Error finding duplicates in %s: %v", flags.Arg(0), err)
+		return 1
+	}
+
+	if *asJson {
+		contents, err := json.MarshalIndent(clusters, "", "  ")
+		if err != nil {
+			log.Printf("Error writing JSON: %v", err)
+			return 1
+		}
+		fmt.Println(string(contents))
+	} else {
+		for _, cluster := range clusters {
+			fmt.Println(cluster.Keep)
+			for _, dupe := range cluster.Copies {
+				fmt.Printf("  %v\n", dupe)
+			}
+			fmt.Println()
+		}
+	}
+
+	if *quarantine != "" {
+		if err := a.QuarantineDuplicates(flags.Arg(0), clusters, *quarantine); err != nil {
+			log.Printf("Error quarantining duplicates: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
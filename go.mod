@@ -1,7 +1,14 @@
 module github.com/jddwoody/album
 
 require github.com/disintegration/imaging v1.6.2
+
 require github.com/alitto/pond v1.8.3
-require gopkg.in/yaml.v2 v2.4.0
 
-go 1.15
+require (
+	github.com/andybalholm/brotli v1.1.1
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+go 1.16
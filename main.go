@@ -12,11 +12,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
-	"github.com/jddwoody/album/internal/album"
+	"github.com/jddwoody/album/pkg/album"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dupes" {
+		os.Exit(dupes(os.Args[2:]))
+	}
+
 	if !album.IsFfmpegAvailable() {
 		fmt.Println("ffmpeg is not available, no video support")
 	}
@@ -25,5 +30,5 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error loading config file %s, err:%v", album.APP_CONFIG_FILENAME, err)
 	}
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", app.Port), album.Album{}))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", app.Port), album.New(album.WithAppConfig(app))))
 }
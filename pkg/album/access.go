@@ -0,0 +1,160 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ACCESS_PUBLIC  = "public"
+	ACCESS_PRIVATE = "private"
+)
+
+// Access rule from the access: section of a config.yaml, it covers the directory and
+// every sub directory that doesn't have a rule of its own.  It can be written as just
+// the mode, ie access: private
+type Access struct {
+	Mode   string   `yaml:"mode"`
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+}
+
+func (a *Access) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mode string
+	if err := unmarshal(&mode); err == nil {
+		*a = Access{Mode: mode}
+		return a.validate()
+	}
+
+	type plain Access
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+func (a Access) validate() error {
+	switch a.Mode {
+	case "", ACCESS_PUBLIC, ACCESS_PRIVATE:
+		return nil
+	}
+	return fmt.Errorf("unknown access mode %s, expecting %s or %s", a.Mode, ACCESS_PUBLIC, ACCESS_PRIVATE)
+}
+
+// Public lets in anyone allowed to see the album.  Private needs a logged in user, and
+// if users or groups are listed the user has to be one of them.
+func (a Access) IsAllowed(user *User) bool {
+	if a.Mode != ACCESS_PRIVATE {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	if len(a.Users) == 0 && len(a.Groups) == 0 {
+		return true
+	}
+
+	for _, name := range a.Users {
+		if name == "*" || name == user.Name {
+			return true
+		}
+	}
+	for _, group := range a.Groups {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Access) String() string {
+	return fmt.Sprintf("Access:{Mode:%s,Users:%v,Groups:%v}", a.Mode, a.Users, a.Groups)
+}
+
+func LoadConfigFile(filename string) (*Config, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.Close()
+	decoder := yaml.NewDecoder(in)
+	var config Config
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Walks from the top of the album at baseDir down to relDir, the closest config.yaml with
+// an access rule wins.  access is the rule for the album as a whole.  A config.yaml that
+// can't be read denies access rather than silently dropping its rule.
+func DirectoryAccess(baseDir, relDir string, access Access) Access {
+	dir := baseDir
+	elems := []string{""}
+	if relDir != "" && relDir != "." {
+		elems = append(elems, strings.Split(relDir, "/")...)
+	}
+
+	for _, elem := range elems {
+		dir = filepath.Join(dir, elem)
+		config, err := LoadConfigFile(filepath.Join(dir, CONFIG_FILENAME))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Access{Mode: ACCESS_PRIVATE, Users: []string{}, Groups: []string{}}
+		}
+		if config.Access.Mode != "" {
+			access = config.Access
+		}
+	}
+	return access
+}
+
+// Whether the current user may see relDir, a directory relative to the top of the album.
+// A share link only reaches its own subtree but needs no login.
+func (t TemplateSource) CanAccess(relDir string) bool {
+	if t.Share != nil {
+		return t.Share.Contains(relDir)
+	}
+	if !t.AlbumConfig.IsAllowed(t.User) {
+		return false
+	}
+
+	albumDefault := t.AlbumsConfig.Default
+	Merge(&albumDefault, &t.AlbumConfig.Config)
+	return DirectoryAccess(t.baseDir(), relDir, albumDefault.Access).IsAllowed(t.User)
+}
+
+// The directory whose rules cover pathInfo, which is pathInfo itself when it's a directory
+// in the album.  Thumbnails are always files.
+func accessDir(baseDir, pathInfo string, isThumb bool) string {
+	pathInfo = strings.Trim(pathInfo, "/")
+	if !isThumb {
+		if stat, err := os.Stat(filepath.Join(baseDir, pathInfo)); err == nil && stat.IsDir() {
+			return pathInfo
+		}
+	}
+
+	dir := path.Dir(pathInfo)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,113 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestAccessYaml(t *testing.T) {
+	var tests = []struct {
+		input   string
+		want    Access
+		wantErr bool
+	}{
+		{"access: private", Access{Mode: ACCESS_PRIVATE}, false},
+		{"access:\n  mode: private\n  groups: [family]", Access{Mode: ACCESS_PRIVATE, Groups: []string{"family"}}, false},
+		{"access: public", Access{Mode: ACCESS_PUBLIC}, false},
+		{"thumbnailWidth: 10", Access{}, false},
+		{"access: secret", Access{}, true},
+	}
+	for _, test := range tests {
+		var config Config
+		err := yaml.Unmarshal([]byte(test.input), &config)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.input, err)
+			continue
+		}
+		if !test.wantErr && config.Access.String() != test.want.String() {
+			t.Errorf("%s: expecting %v, got %v", test.input, test.want, config.Access)
+		}
+	}
+}
+
+func setupAccessAlbum(t *testing.T) *Album {
+	a := setupAuthAlbum(t, true)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	for _, dir := range []string{"2021/private", "2021/public"} {
+		if err := os.MkdirAll(filepath.Join(source, dir), 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"2020/config.yaml":         "access:\n  mode: private\n  groups: [family]\n",
+		"2021/private/config.yaml": "access: private\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestDirectoryAccess(t *testing.T) {
+	a := setupAccessAlbum(t)
+
+	var tests = []struct {
+		url        string
+		user       string
+		wantStatus int
+	}{
+		{"/test/albums/2020/(01)January/", "", http.StatusSeeOther},
+		{"/test/albums/2020/(01)January/party.jpg", "", http.StatusSeeOther},
+		{"/test/albums/2020/(01)January/party.jpg?slide_show=sm", "", http.StatusSeeOther},
+		{"/test/thumbs/2020/(01)January/tn__party.jpg", "", http.StatusUnauthorized},
+		{"/test/thumbs/2020/(01)January/640x480_party.jpg", "bob", http.StatusForbidden},
+		{"/test/thumbs/2020/(01)January/tn__party.jpg", "jenny", http.StatusOK},
+		{"/test/albums/2020/(01)January/party.jpg", "jenny", http.StatusOK},
+		{"/api/v1/test/tree/2020/(01)January", "", http.StatusUnauthorized},
+		{"/api/v1/test/media/2020/(01)January/party.jpg", "bob", http.StatusForbidden},
+		{"/api/v1/test/media/2020/(01)January/party.jpg", "jenny", http.StatusOK},
+		{"/test/albums/2021/private/", "", http.StatusSeeOther},
+		{"/test/albums/2021/private/", "bob", http.StatusOK},
+		{"/test/albums/2021/public/", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "secret")
+		}
+		if rec := serve(a, req); rec.Code != test.wantStatus {
+			t.Errorf("GET %s as %s: expecting %d, got %d", test.url, test.user, test.wantStatus, rec.Code)
+		}
+	}
+}
+
+func TestDirectoryAccessListings(t *testing.T) {
+	a := setupAccessAlbum(t)
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/albums/2021/", nil))
+	if !strings.Contains(rec.Body.String(), "2021/public/") || strings.Contains(rec.Body.String(), "2021/private/") {
+		t.Errorf("Expecting only the public directory to be listed: %s", rec.Body.String())
+	}
+
+	var tree ApiTree
+	getJson(t, a, "/api/v1/test/tree/", http.StatusOK, &tree)
+	for _, dir := range tree.Dirs {
+		if dir.Name == "2020" {
+			t.Errorf("Expecting 2020 to be hidden from anonymous users: %v", tree.Dirs)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/test/albums/2021/", nil)
+	req.SetBasicAuth("jenny", "secret")
+	if rec = serve(a, req); !strings.Contains(rec.Body.String(), "2021/private/") {
+		t.Errorf("Expecting jenny to see the private directory: %s", rec.Body.String())
+	}
+}
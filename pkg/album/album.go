@@ -0,0 +1,1113 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+func (a *Album) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "POST":
+		a.handleGet(w, req)
+	}
+}
+
+func (a *Album) handleGet(w http.ResponseWriter, req *http.Request) {
+	url := req.URL
+	path := url.Path
+	a.logger.Printf("url.Path:%s\n", path)
+	var page string
+	if hasEncodedSeparator(url) {
+		http.Error(w, ErrBadPath.Error(), http.StatusBadRequest)
+		return
+	}
+	appConfig, albumsConfig, err := a.loadConfig()
+	if err != nil {
+		a.logger.Printf("Error loading config: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// mountPrefix is part of the request path, the forwarded prefix was already stripped by a proxy
+	mountPrefix := a.prefix
+	if mountPrefix == "" {
+		mountPrefix = cleanPrefix(appConfig.BasePath)
+	}
+	linkPrefix := forwardedPrefix(req) + mountPrefix
+	if mountPrefix != "" {
+		if path == mountPrefix {
+			http.Redirect(w, req, linkPrefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(path, mountPrefix+"/") {
+			http.NotFound(w, req)
+			return
+		}
+		path = strings.TrimPrefix(path, mountPrefix)
+	}
+
+	albumsConfig, hostConfig := albumsConfig.ForHost(req.Host)
+	tmplSource := TemplateSource{AppConfig: appConfig, AlbumsConfig: albumsConfig, HostConfig: hostConfig, Prefix: linkPrefix}
+	tmplSource.Root = tmplSource.Prefix + path
+	tmplSource.User = a.currentUser(req, appConfig, albumsConfig.Auth)
+
+	switch path {
+	case "/login":
+		a.handleLogin(w, req, tmplSource)
+		return
+	case "/logout":
+		a.handleLogout(w, req, tmplSource)
+		return
+	case "/shares":
+		a.handleShares(w, req, tmplSource)
+		return
+	}
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasPrefix(path, API_PREFIX) {
+		a.handleApi(w, req, tmplSource, strings.TrimPrefix(path, API_PREFIX))
+		return
+	}
+
+	if hostConfig != nil && hostConfig.Album != "" {
+		// Host serves a single album at /, with its thumbnails under /thumbs/
+		if strings.HasPrefix(path, "/thumbs/") || strings.HasPrefix(path, "/share/") {
+			path = "/" + hostConfig.Album + path
+		} else {
+			path = "/" + hostConfig.Album + "/albums" + path
+		}
+	}
+
+	paths := strings.SplitN(path[1:], "/", 3)
+	if len(paths) < 3 {
+		// It should always be at least 2, so show page with available albums
+		tmplSource.Current = albumsConfig.Default
+		a.render(w, req, tmplSource, "index.html")
+		return
+	}
+
+	if paths[1] == "share" {
+		// /<album>/share/<token>/<path> browses the album, /<album>/share/<token>/thumbs/<path> its thumbnails
+		shareInfo := strings.SplitN(paths[2], "/", 2)
+		share, err := a.parseShare(appConfig, albumsConfig, shareInfo[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if share.Album != paths[0] {
+			http.NotFound(w, req)
+			return
+		}
+		if len(shareInfo) < 2 {
+			http.Redirect(w, req, tmplSource.Root+"/", http.StatusFound)
+			return
+		}
+		tmplSource.Share = share
+		paths[1], paths[2] = "albums", shareInfo[1]
+		if strings.HasPrefix(paths[2], "thumbs/") {
+			paths[1], paths[2] = "thumbs", strings.TrimPrefix(paths[2], "thumbs/")
+		}
+	}
+
+	var resolved string
+	public := false
+	if albumConfig, ok := albumsConfig.Albums[paths[0]]; ok {
+		root := albumConfig.AlbumDir
+		if paths[1] == "thumbs" {
+			root = albumConfig.ThumbDir
+		}
+		if resolved, err = ResolvePath(filepath.Join(appConfig.AlbumsDir, root), paths[2], albumConfig.FollowSymlinks); err != nil {
+			a.pathError(w, paths[2], err)
+			return
+		}
+
+		// Thumbnails are checked against the album directory they were made from
+		tmplSource.AlbumConfig = albumConfig
+		relDir := accessDir(tmplSource.baseDir(), paths[2], paths[1] == "thumbs")
+		if tmplSource.Share != nil && paths[1] == "albums" && strings.Trim(paths[2], "/") == "" && tmplSource.Share.Path != "" {
+			// The top of a share is the shared directory
+			http.Redirect(w, req, tmplSource.shareRoot(paths[0], tmplSource.Share.Token)+"/"+tmplSource.Share.Path+"/", http.StatusFound)
+			return
+		}
+		if !tmplSource.CanAccess(relDir) && tmplSource.Share != nil {
+			http.Error(w, "Not part of this share", http.StatusForbidden)
+			return
+		}
+		if !tmplSource.CanAccess(relDir) {
+			a.denyAccess(w, req, tmplSource, paths[1] == "albums")
+			return
+		}
+
+		// Shared caches may only keep what anyone could see
+		anonymous := tmplSource
+		anonymous.User = nil
+		public = tmplSource.Share == nil && anonymous.CanAccess(relDir)
+	}
+
+	if paths[1] == "thumbs" {
+		if req.URL.Query().Get(FINAL_WIDTH_PARAM) != "" && !tmplSource.CanDownload() {
+			// Resizing to the screen is as good as the original
+			http.Error(w, "Downloads are not allowed", http.StatusForbidden)
+			return
+		}
+		// must be a thumbnail, files only
+		a.handleThumbnail(w, req, appConfig, albumsConfig, paths[0], paths[2], public)
+		return
+	}
+
+	if paths[1] != "albums" {
+		// Invalid path
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	defer func() {
+		if page != "" {
+			a.render(w, req, tmplSource, page)
+		}
+	}()
+
+	// Paths[0] should match an album id, Paths[1] should be either albums or thumbs
+	tmplSource.BasePath = paths[0]
+	tmplSource.AlbumsRoot = tmplSource.AlbumsRootFor(paths[0])
+	tmplSource.ThumbsRoot = tmplSource.ThumbsRootFor(paths[0])
+	tmplSource.PathInfo = paths[2]
+	tmplSource.PathInfo = strings.TrimSuffix(tmplSource.PathInfo, "/")
+	var ok bool
+	albumConfig, ok := albumsConfig.Albums[paths[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tmplSource.AlbumConfig = albumConfig
+	tmplSource.Current = albumsConfig.Default
+	Merge(&tmplSource.Current, &albumConfig.Config)
+	if tmplSource.Current.IsViewableFile(tmplSource.PathInfo) {
+		tmplSource.DirInfo = filepath.Dir(tmplSource.Root)
+	} else {
+		tmplSource.DirInfo = tmplSource.Root
+	}
+	if tmplSource.Current.AllowFinalResize {
+		w.Header().Set("Accept-CH", ACCEPT_CH)
+	}
+	baseDir := filepath.Join(appConfig.AlbumsDir, tmplSource.AlbumConfig.AlbumDir)
+	albumPathInfo := resolved
+
+	stat, err := os.Stat(albumPathInfo)
+	if err != nil {
+		filename := filepath.Base("/" + tmplSource.PathInfo)
+		// if the filename starts with 640x480_, 800x600_ or 1024x768_, set imgLink to
+		// thumbs and let the normal handler take care of it
+		if strings.HasPrefix(filename, "640x480_") || strings.HasPrefix(filename, "800x600_") || strings.HasPrefix(filename, "1024x768_") {
+			tmplSource.ActualPath = fmt.Sprintf("%s/%s", tmplSource.ThumbsRoot, tmplSource.PathInfo)
+			tmplSource.BaseFilename = filepath.Base(cleanTn(tmplSource.ActualPath))
+		} else {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	playVideo := req.URL.Query().Get("playvideo")
+	slideShow := req.URL.Query().Get("slide_show")
+	if err != nil && (playVideo != "" || slideShow != "") {
+		// Only the page of a sized photo is shown without the original
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if playVideo != "" && stat.Mode().IsRegular() {
+		tmplSource.BaseFilename = filepath.Base(tmplSource.PathInfo)
+		videoDir := fmt.Sprintf("%s/%s", baseDir, filepath.Dir(tmplSource.PathInfo))
+		dirEntries, err := os.ReadDir(videoDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, dirEntry := range dirEntries {
+			if tmplSource.Current.IsVideoFile(dirEntry.Name()) {
+				tmplSource.Files = append(tmplSource.Files, dirEntry)
+			}
+		}
+
+		for idx, dirEntry := range tmplSource.Files {
+			if dirEntry.Name() == tmplSource.BaseFilename {
+				tmplSource.FileIndex = idx
+			}
+		}
+		lastIndex := len(tmplSource.Files) - 1
+
+		if lastIndex > 7 {
+			if tmplSource.FileIndex > 3 {
+				less := tmplSource.FileIndex - 3
+				if less > 7 {
+					less = 7
+				}
+				move := 0
+				if tmplSource.FileIndex > lastIndex-3 {
+					move = lastIndex - tmplSource.FileIndex
+				}
+				prevName := tmplSource.Files[tmplSource.FileIndex-less-move].Name()
+				tmplSource.PrevSeven = SevenLink{Url: fmt.Sprintf("%s/%s?playvideo=1", filepath.Dir(tmplSource.Root), prevName), Count: less}
+			}
+
+			if tmplSource.FileIndex < lastIndex-3 {
+				more := lastIndex - 3 - tmplSource.FileIndex
+				if more > 7 {
+					more = 7
+				}
+				move := 0
+				if tmplSource.FileIndex < 3 {
+					move = 3
+				}
+				nextName := tmplSource.Files[tmplSource.FileIndex+more+move].Name()
+				currentBase := filepath.Base(tmplSource.Root)
+				tmplSource.NextSeven = SevenLink{Url: fmt.Sprintf("%s/%s?playvideo=1", filepath.Dir(tmplSource.Root), fixNextName(currentBase, nextName)), Count: more}
+			}
+		}
+
+		lowerIndex := 0
+		extra := 0
+		upperIndex := lastIndex
+		if len(tmplSource.Files) > 7 {
+			if tmplSource.FileIndex > 3 {
+				lowerIndex = tmplSource.FileIndex - 3
+			} else {
+				extra = 3 - tmplSource.FileIndex
+			}
+			if lastIndex-tmplSource.FileIndex > 3 {
+				upperIndex = tmplSource.FileIndex + 3 + extra
+			} else {
+				lowerIndex -= 3 - (lastIndex - tmplSource.FileIndex)
+			}
+		}
+		currentBase := filepath.Base(tmplSource.Root)
+		for i := lowerIndex; i <= upperIndex; i++ {
+			filename := tmplSource.Files[i].Name()
+			tmplSource.Strip = append(tmplSource.Strip, StripLink{
+				Url:     fixNextName(currentBase, filename) + "?playvideo=1",
+				Src:     tmplSource.ThumbnailUrl(filename),
+				Current: i == tmplSource.FileIndex,
+				Video:   true,
+			})
+		}
+
+		if tmplSource.Current.CanHtmlPlay(tmplSource.BaseFilename) {
+			tmplSource.ActualPath = tmplSource.Root
+		} else {
+			tmplSource.ActualPath = fmt.Sprintf("%s/%s", tmplSource.ThumbsRoot, ChangeExtension(tmplSource.PathInfo, "webm"))
+			tmplSource.Mp4Path = fmt.Sprintf("%s/%s", tmplSource.ThumbsRoot, ChangeExtension(tmplSource.PathInfo, "mp4"))
+			mp4RelativeFile := filepath.Join(tmplSource.AlbumConfig.ThumbDir, ChangeExtension(tmplSource.PathInfo, "mp4"))
+			mp4ActualFile := filepath.Join(appConfig.AlbumsDir, mp4RelativeFile)
+			a.logger.Printf("mp4ActualFile:%s\n", mp4ActualFile)
+			if _, err := os.Stat(mp4ActualFile); errors.Is(err, os.ErrNotExist) {
+				source := filepath.Join(baseDir, tmplSource.PathInfo)
+				a.logger.Printf("Need to generate mp4:%s from %s\n", mp4ActualFile, source)
+				ConvertVideoFile(source, mp4ActualFile)
+			}
+		}
+		tmplSource.PlayVideo = true
+		page = "video.html"
+		if mediaType := tmplSource.Current.MediaType(tmplSource.BaseFilename); mediaType != nil {
+			page = mediaType.Viewer()
+		}
+		return
+	}
+
+	tmplSource.SlideShow = slideShow
+	if slideShow != "" && stat.Mode().IsRegular() {
+		if tmplSource.Current.IsImageFile(tmplSource.PathInfo) {
+			tmplSource.ActualPath = fmt.Sprintf("%s/%s/%s", tmplSource.ThumbsRoot, filepath.Dir(tmplSource.PathInfo), changeSize(slideShow, filepath.Base(tmplSource.PathInfo)))
+			tmplSource.BaseFilename = filepath.Base("/" + tmplSource.PathInfo)
+			if slideShow == "full" && tmplSource.Current.AllowFinalResize {
+				// Rather than the whole original, send one that fits the screen
+				w.Header().Set("Vary", ACCEPT_CH)
+				tmplSource.FinalWidth = DEFAULT_FINAL_WIDTH
+				if width := hintedWidth(req); width > 0 {
+					tmplSource.FinalWidth = SnapWidth(width)
+				}
+				tmplSource.ActualPath = tmplSource.FinalUrl(tmplSource.BaseFilename)
+			}
+		} else {
+			// Can't do a slide show of videos
+			http.Error(w, "Can't do slide show of videos", http.StatusNotFound)
+			return
+		}
+	}
+	if tmplSource.ActualPath == "" && stat.Mode().IsRegular() {
+		if tmplSource.Current.IsImageFile(tmplSource.PathInfo) && !tmplSource.CanDownload() {
+			http.Error(w, "Downloads are not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl(public, false))
+		w.Header().Set("ETag", originalEtag(stat))
+		http.ServeFile(w, req, albumPathInfo)
+		return
+	}
+
+	albumDir := albumPathInfo
+	if tmplSource.ActualPath != "" {
+		albumDir = filepath.Dir(albumPathInfo)
+	}
+	dirEntries, err := os.ReadDir(albumDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if a.pageNotModified(w, req, tmplSource, albumDir, dirEntries) {
+		return
+	}
+	a.readDir(&tmplSource, albumDir, dirEntries)
+
+	tmplSource.sortDirs()
+
+	if len(tmplSource.Files) == 0 {
+		// No images, just show directories
+		paths := strings.Split(tmplSource.PathInfo, "/")
+		for idx, ele := range paths {
+			paths[idx] = beautify(ele)
+		}
+		tmplSource.FullTitle = strings.Join(paths, " - ")
+		page = "dirs.html"
+		return
+	}
+
+	allFullImages := req.URL.Query().Get("all_full_images")
+	if allFullImages != "" {
+		if allFullImages == "full" && !tmplSource.CanDownload() {
+			allFullImages = "lg"
+		}
+		tmplSource.AllImages = allFullImages
+		tmplSource.PageTitle = strings.ReplaceAll(beautify(tmplSource.PathInfo), "/", " - ")
+		tmplSource.FullTitle = tmplSource.PageTitle
+		page = "allimages.html"
+		return
+	}
+
+	tmplSource.PageTitle = beautify(filepath.Base(tmplSource.PathInfo))
+	dir := filepath.Dir(tmplSource.PathInfo)
+	if dir != "" && dir != "." {
+		paths := strings.Split(dir, "/")
+		for idx, ele := range paths {
+			paths[idx] = beautify(ele)
+		}
+		if tmplSource.ActualPath == "" {
+			// Must be dir
+			tmplSource.FullTitle = strings.Join(paths, " - ") + " - " + tmplSource.PageTitle
+		} else {
+			tmplSource.FullTitle = strings.Join(paths, " - ")
+		}
+	} else {
+		tmplSource.FullTitle = tmplSource.PageTitle
+	}
+
+	imageFiles := tmplSource.GetImageFiles()
+	if tmplSource.ActualPath == "" {
+		if slideShow != "" && len(imageFiles) > 0 {
+			// If there isn't a filename and slideShow is enabled, just call the first picture
+			http.Redirect(w, req, fmt.Sprintf("%s/%s?slide_show=%s", tmplSource.Root, tmplSource.Files[0].Name(), slideShow), http.StatusTemporaryRedirect)
+			return
+		}
+		if tmplSource.Current.NumberOfColumns > 0 {
+			tmplSource.NumberOfColumns = tmplSource.Current.NumberOfColumns
+		} else {
+			tmplSource.NumberOfColumns = tmplSource.Current.GetDefaultBrowserWidth() / tmplSource.Current.GetThumbnailWidth()
+		}
+		if tmplSource.Current.StackBursts {
+			a.stackFiles(&tmplSource, req.URL.Query().Get(STACK_PARAM))
+		}
+		if tmplSource.Current.SimilarPhotos {
+			a.submitSimilarIndex(tmplSource)
+		}
+		if tmplSource.Current.Placeholders {
+			a.placeholderFiles(&tmplSource)
+		}
+		page = "grid.html"
+	} else {
+		for idx, dirEntry := range imageFiles {
+			if dirEntry.Name() == tmplSource.BaseFilename {
+				tmplSource.FileIndex = idx
+			}
+		}
+		lastIndex := len(imageFiles) - 1
+		if lastIndex > 7 {
+			if tmplSource.FileIndex > 3 {
+				less := tmplSource.FileIndex - 3
+				if less > 7 {
+					less = 7
+				}
+				move := 0
+				if tmplSource.FileIndex > lastIndex-3 {
+					move = lastIndex - tmplSource.FileIndex
+				}
+				prevName := imageFiles[tmplSource.FileIndex-less-move].Name()
+				currentBase := filepath.Base(tmplSource.Root)
+				if strings.HasPrefix(currentBase, "640x480_") {
+					prevName = "640x480_" + prevName
+				} else if strings.HasPrefix(currentBase, "800x600_") {
+					prevName = "800x600_" + prevName
+				} else if strings.HasPrefix(currentBase, "1024x768_") {
+					prevName = "1024x768_" + prevName
+				}
+
+				tmplSource.PrevSeven = SevenLink{Url: fmt.Sprintf("%s/%s", filepath.Dir(tmplSource.Root), prevName), Count: less}
+			}
+
+			if tmplSource.FileIndex < lastIndex-3 {
+				more := lastIndex - 3 - tmplSource.FileIndex
+				if more > 7 {
+					more = 7
+				}
+				move := 0
+				if tmplSource.FileIndex < 3 {
+					move = 3
+				}
+				nextName := imageFiles[tmplSource.FileIndex+more+move].Name()
+				currentBase := filepath.Base(tmplSource.Root)
+				tmplSource.NextSeven = SevenLink{Url: fmt.Sprintf("%s/%s", filepath.Dir(tmplSource.Root), fixNextName(currentBase, nextName)), Count: more}
+			}
+		}
+
+		lowerIndex := 0
+		extra := 0
+		upperIndex := lastIndex
+		if len(imageFiles) > 7 {
+			if tmplSource.FileIndex > 3 {
+				lowerIndex = tmplSource.FileIndex - 3
+			} else {
+				extra = 3 - tmplSource.FileIndex
+			}
+			if lastIndex-tmplSource.FileIndex > 3 {
+				upperIndex = tmplSource.FileIndex + 3 + extra
+			} else {
+				lowerIndex -= 3 - (lastIndex - tmplSource.FileIndex)
+			}
+		}
+		currentBase := filepath.Base(tmplSource.Root)
+		for i := lowerIndex; i <= upperIndex; i++ {
+			filename := imageFiles[i].Name()
+			tmplSource.Strip = append(tmplSource.Strip, StripLink{
+				Url:     fixNextName(currentBase, filename),
+				Src:     tmplSource.ThumbnailUrl(filename),
+				Current: i == tmplSource.FileIndex,
+			})
+		}
+		if tmplSource.Current.SimilarPhotos && slideShow == "" {
+			a.submitSimilarIndex(tmplSource)
+			a.findSimilar(&tmplSource)
+		}
+		page = "single.html"
+		if mediaType := tmplSource.Current.MediaType(tmplSource.BaseFilename); mediaType != nil {
+			page = mediaType.Viewer()
+		}
+
+		// If it's a slideshow show, set up a refresh
+		if slideShow != "" && tmplSource.FileIndex < lastIndex {
+			w.Header().Set("Refresh", fmt.Sprintf("%d; URL=%s?slide_show=%s", tmplSource.Current.SlideShowDelay, imageFiles[tmplSource.FileIndex+1].Name(), slideShow))
+		}
+
+	}
+}
+
+// Sorts the entries of albumDir into Dirs and Files, merges any config.yaml into Current
+// and reads caption.txt.  Files listed in order.txt come first in its order.  Videos that
+// can't be played by a browser are queued for conversion.
+func (a *Album) readDir(t *TemplateSource, albumDir string, dirEntries []os.DirEntry) {
+	var captionFile *CaptionFile
+	var order map[string]int
+	var others []os.DirEntry
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			if !strings.HasPrefix(dirEntry.Name(), ".") && t.CanAccess(path.Join(t.PathInfo, dirEntry.Name())) {
+				t.Dirs = append(t.Dirs, dirEntry)
+			}
+		} else {
+			if dirEntry.Name() == "caption.txt" {
+				in, err := os.Open(fmt.Sprintf("%s/%s", albumDir, dirEntry.Name()))
+				if err == nil {
+					captionFile = NewCaptionFile(in)
+					in.Close()
+				}
+			} else if dirEntry.Name() == ORDER_FILENAME {
+				in, err := os.Open(filepath.Join(albumDir, dirEntry.Name()))
+				if err == nil {
+					order = readOrder(in)
+					in.Close()
+				}
+			} else if dirEntry.Name() == CONFIG_FILENAME {
+				a.logger.Println("Found config.yaml")
+				dirConfig, err := LoadConfigFile(fmt.Sprintf("%s/%s", albumDir, dirEntry.Name()))
+				if err == nil {
+					a.logger.Printf("new dirconfig: %v\n", *dirConfig)
+					Merge(&t.Current, dirConfig)
+				} else {
+					a.logger.Printf("Error loading config file: %v\n", err)
+				}
+			} else if !strings.HasPrefix(dirEntry.Name(), ".") {
+				others = append(others, dirEntry)
+			}
+		}
+	}
+
+	// Only once config.yaml is merged are all the extraTypes known
+	for _, dirEntry := range others {
+		if !t.Current.IsViewableFile(dirEntry.Name()) {
+			continue
+		}
+		t.Files = append(t.Files, dirEntry)
+		if t.Current.IsImageFile(dirEntry.Name()) {
+			t.ImageCount += 1
+		}
+
+		// A video file that isn't html viewable needs to be converted
+		if t.Current.VideoNeedsConversion(dirEntry.Name()) {
+			originalFilename := fmt.Sprintf("%s/%s", albumDir, dirEntry.Name())
+			convertedFilename := t.convertedFilename(dirEntry.Name())
+			if _, err := os.Stat(convertedFilename); errors.Is(err, os.ErrNotExist) {
+				a.SubmitConversion(originalFilename, convertedFilename)
+			}
+		}
+	}
+
+	if order != nil {
+		t.sortFiles(order)
+	}
+	t.pairRaws()
+	a.pairLives(t)
+
+	if captionFile != nil {
+		t.CaptionHtml = t.trustedHtml(captionFile.Html)
+		t.CaptionMap = captionFile.CaptionMap
+	}
+}
+
+// The place of each file named in an order.txt, one name to a line
+func readOrder(in io.Reader) map[string]int {
+	order := make(map[string]int)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if _, ok := order[name]; name != "" && !ok {
+			order[name] = len(order)
+		}
+	}
+	return order
+}
+
+// Puts the Files named in order first, in its order, and the rest after them by name
+func (t *TemplateSource) sortFiles(order map[string]int) {
+	sort.SliceStable(t.Files, func(i, j int) bool {
+		iPlace, iOk := order[t.Files[i].Name()]
+		jPlace, jOk := order[t.Files[j].Name()]
+		if iOk && jOk {
+			return iPlace < jPlace
+		}
+		return iOk && !jOk
+	})
+}
+
+func (t *TemplateSource) sortDirs() {
+	if t.Current.ReverseDirs {
+		sort.Slice(t.Dirs, func(i, j int) bool {
+			return t.Dirs[i].Name() > t.Dirs[j].Name()
+		})
+	} else {
+		sort.Slice(t.Dirs, func(i, j int) bool {
+			return t.Dirs[i].Name() < t.Dirs[j].Name()
+		})
+	}
+}
+
+func (t TemplateSource) baseDir() string {
+	return filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.AlbumDir)
+}
+
+// Link to the top of an album without the trailing slash, "" when a host serves
+// just that album at /
+func (t TemplateSource) AlbumsRootFor(key string) string {
+	if t.Share != nil && t.Share.Album == key {
+		return t.shareRoot(key, t.Share.Token)
+	}
+	if t.HostConfig != nil && t.HostConfig.Album == key {
+		return t.Prefix
+	}
+	return t.Prefix + "/" + key + "/albums"
+}
+
+func (t TemplateSource) ThumbsRootFor(key string) string {
+	if t.Share != nil && t.Share.Album == key {
+		return t.shareRoot(key, t.Share.Token) + "/thumbs"
+	}
+	if t.HostConfig != nil && t.HostConfig.Album == key {
+		return t.Prefix + "/thumbs"
+	}
+	return t.Prefix + "/" + key + "/thumbs"
+}
+
+// Link to a file or directory under the current directory of the album
+func (t TemplateSource) albumUrl(elem ...string) string {
+	return t.AlbumsRootFor(t.BasePath) + "/" + path.Join(append([]string{t.PathInfo}, elem...)...)
+}
+
+// Link to a cached thumbnail, size variant or conversion under the current directory
+func (t TemplateSource) thumbUrl(elem ...string) string {
+	return t.ThumbsRootFor(t.BasePath) + "/" + path.Join(append([]string{t.PathInfo}, elem...)...)
+}
+
+// The directory being shown, PathInfo less the file name on a single image or video page
+func (t TemplateSource) currentDir() string {
+	if t.Current.IsViewableFile(t.PathInfo) {
+		return path.Dir(t.PathInfo)
+	}
+	return t.PathInfo
+}
+
+// Link to name in the current directory at size, sm, med or lg, or to the original for full
+func (t TemplateSource) SizedUrl(name, size string) string {
+	if size == "full" {
+		return t.AlbumsRootFor(t.BasePath) + "/" + path.Join(t.currentDir(), name)
+	}
+	return t.versioned(t.ThumbsRootFor(t.BasePath)+"/"+path.Join(t.currentDir(), prefixMap[size]+name), name)
+}
+
+// Link to the thumbnail of an image or video in the current directory
+func (t TemplateSource) ThumbnailUrl(name string) string {
+	thumbnail := name
+	if !t.Current.IsImageFile(name) {
+		thumbnail = ChangeExtension(name, "png")
+	}
+	return t.versioned(t.ThumbsRootFor(t.BasePath)+"/"+path.Join(t.currentDir(), "tn__"+thumbnail), name)
+}
+
+// The thumbnail and size variants of an image as a srcset, so the browser can pick one
+// for the screen it's on.  A cropped thumbnail isn't the same picture, so it's left out.
+func (t TemplateSource) Srcset(name string) string {
+	var srcset []string
+	if !t.CropsThumbnails() {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", srcsetUrl(t.ThumbnailUrl(name)), t.Current.GetThumbnailWidth()))
+	}
+	for _, size := range []string{"sm", "med", "lg"} {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", srcsetUrl(t.SizedUrl(name, size)), sizeWidths[size]))
+	}
+	if t.Current.AllowFinalResize && t.CanDownload() {
+		srcset = append(srcset, t.finalSrcset(name, sizeWidths["lg"]))
+	}
+	return strings.Join(srcset, ", ")
+}
+
+// Spaces and commas separate the entries of a srcset, so they can't be left in a url
+func srcsetUrl(link string) string {
+	query := ""
+	if i := strings.Index(link, "?"); i >= 0 {
+		link, query = link[:i], link[i:]
+	}
+	return strings.ReplaceAll((&url.URL{Path: link}).EscapedPath(), ",", "%2C") + query
+}
+
+// Where the browser playable version of a video in the current directory is cached
+func (t TemplateSource) convertedFilename(name string) string {
+	thumbActualDir := fmt.Sprintf("%s/%s", filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir), t.PathInfo)
+	return fmt.Sprintf("%s/%s", thumbActualDir, ChangeExtension(name, "webm"))
+}
+
+func (a *Album) handleThumbnail(w http.ResponseWriter, req *http.Request, appConfig *AppConfig, albumsConfig *AlbumsConfig, albumName, pathInfo string, public bool) {
+	config := albumsConfig.Default
+	albumConfig, ok := albumsConfig.Albums[albumName]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	Merge(&config, &albumConfig.Config)
+	if req.URL.Query().Get(FINAL_WIDTH_PARAM) != "" {
+		a.handleFinalResize(w, req, appConfig, albumConfig, config, pathInfo, public)
+		return
+	}
+	if strings.HasPrefix(path.Base(pathInfo), ".") {
+		// Hidden files aren't shown, and thumbDir keeps its caches in them
+		http.NotFound(w, req)
+		return
+	}
+	thumbDir := filepath.Join(appConfig.AlbumsDir, albumConfig.ThumbDir)
+	fullFilename, err := ResolvePath(thumbDir, pathInfo, albumConfig.FollowSymlinks)
+	if err != nil {
+		a.pathError(w, pathInfo, err)
+		return
+	}
+	fullAlbumDir := filepath.Join(appConfig.AlbumsDir, albumConfig.AlbumDir)
+	if motion := motionSource(config, pathInfo); motion != "" {
+		a.serveMotionClip(w, req, config, fullAlbumDir, motion, fullFilename, albumConfig.FollowSymlinks, public)
+		return
+	}
+	source, sourceErr := thumbnailSource(config, fullAlbumDir, pathInfo, albumConfig.FollowSymlinks)
+	var sourceStat os.FileInfo
+	if sourceErr == nil {
+		sourceStat, sourceErr = os.Stat(source)
+	}
+	if sourceErr == nil && config.MediaType(source) == nil {
+		config = withDirTypes(config, fullAlbumDir, path.Dir(cleanTn(pathInfo)))
+	}
+
+	// With thumbnailUse square or fill the tn__ of an image is cropped, and kept apart from
+	// the one that's only resized.  Animated GIFs keep moving rather than being cropped.
+	cropWidth, cropHeight, crop := config.thumbnailCrop()
+	crop = crop && sourceErr == nil && strings.HasPrefix(path.Base(pathInfo), "tn__") && config.IsImageFile(source) &&
+		(config.GetGifThumbnails() == GIF_STATIC || !isAnimatedGif(source))
+	var focus string
+	var focusStat os.FileInfo
+	if crop {
+		clean := cleanTn(pathInfo)
+		focus, focusStat = focusPoint(fullAlbumDir, clean)
+		if fullFilename, err = ResolvePath(thumbDir, cropFilename(clean, cropWidth, cropHeight), albumConfig.FollowSymlinks); err != nil {
+			a.pathError(w, pathInfo, err)
+			return
+		}
+	}
+	version := ""
+	if sourceErr == nil {
+		version = thumbnailVersion(config, sourceStat)
+		if crop {
+			version = thumbnailVersion(config, sourceStat, focus)
+		}
+	}
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(path.Dir(cleanTn(pathInfo))), INFO_FILENAME)
+	thumbStat, err := os.Stat(fullFilename)
+
+	// err just means we need to create it, as does an original, or focal point, that changed
+	// since, or settings it wasn't made with.  Converted videos are made in the background,
+	// not here.
+	stale := err == nil && sourceErr == nil && (config.IsImageFile(pathInfo) || strings.HasPrefix(path.Base(pathInfo), "tn__")) &&
+		(thumbStat.ModTime().Before(sourceStat.ModTime()) || focusStat != nil && thumbStat.ModTime().Before(focusStat.ModTime()) ||
+			!a.thumbnailMadeWith(infoFilename, fullFilename, version))
+	if err != nil || stale {
+		if sourceErr != nil {
+			a.pathError(w, pathInfo, sourceErr)
+			return
+		}
+		// First make sure the directories are all there
+		if err := os.MkdirAll(filepath.Dir(fullFilename), 0775); err != nil {
+			a.logger.Printf("Error creating directory %s:%v\n", filepath.Dir(fullFilename), err)
+		}
+
+		mediaType := config.DetectMediaType(source)
+		if mediaType == nil {
+			http.NotFound(w, req)
+			return
+		}
+		rendition, err := ResolvePath(thumbDir, heifRendition(cleanTn(pathInfo)), albumConfig.FollowSymlinks)
+		if err != nil {
+			a.pathError(w, pathInfo, err)
+			return
+		}
+		filename := path.Base(pathInfo)
+		width := int(config.GetThumbnailWidth())
+		if strings.HasPrefix(filename, "640") {
+			width = 640
+		} else if strings.HasPrefix(filename, "800") {
+			width = 800
+		} else if strings.HasPrefix(filename, "1024") {
+			width = 1024
+		}
+		opts := ThumbnailOptions{
+			Width:     width,
+			Quality:   config.GetThumbnailQuality(),
+			VideoSize: config.GetVideoThumbnailSize(),
+			Rendition: rendition,
+			Static:    strings.HasPrefix(filename, "tn__") && config.GetGifThumbnails() == GIF_STATIC,
+		}
+		if crop {
+			err = cropThumbnail(mediaType, source, fullFilename, opts, cropWidth, cropHeight, focus)
+		} else {
+			err = mediaType.Thumbnail(source, fullFilename, opts)
+		}
+		if err != nil {
+			a.logger.Printf("Error making %s from %s: %v\n", fullFilename, source, err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		a.saveThumbnailVersion(thumbDir, cleanTn(pathInfo), source, fullFilename, version)
+		if config.Placeholders && strings.HasPrefix(filename, "tn__") && config.IsImageFile(source) {
+			a.savePlaceholder(thumbDir, cleanTn(pathInfo), source, fullFilename)
+		}
+	}
+
+	if sourceErr == nil {
+		w.Header().Set("Cache-Control", cacheControl(public, req.URL.Query().Get(VERSION_PARAM) == version))
+	}
+	a.serveThumbnail(w, req, config, fullFilename, version)
+}
+
+// The original a thumbnail in pathInfo was made from.  A video's thumbnail is a png, so
+// unless there's a png of that name the original is found by the name without its extension.
+func thumbnailSource(config Config, fullAlbumDir, pathInfo string, followSymlinks bool) (string, error) {
+	clean := cleanTn(pathInfo)
+	if config.IsImageFile(pathInfo) {
+		source, err := ResolvePath(fullAlbumDir, clean, followSymlinks)
+		if err != nil || !strings.EqualFold(path.Ext(clean), ".png") {
+			return source, err
+		}
+		if _, err := os.Stat(source); err == nil {
+			return source, nil
+		}
+	}
+
+	prefix := strings.TrimSuffix(clean, filepath.Ext(clean))
+	sourcePrefix, err := ResolvePath(fullAlbumDir, prefix, followSymlinks)
+	if err != nil {
+		return "", err
+	}
+	glob, err := filepath.Glob(sourcePrefix + "*")
+	if err != nil {
+		return "", err
+	}
+	if len(glob) == 0 {
+		return "", fmt.Errorf("no match for %s: %w", prefix, os.ErrNotExist)
+	}
+	return ResolvePath(fullAlbumDir, path.Join(path.Dir(clean), filepath.Base(glob[0])), followSymlinks)
+}
+
+func (a *Album) Footer() string {
+	a.logger.Printf("  *****     Normal footer     ***********")
+	return `
+	<center>
+		Slide Show: <a href="?slide_show=sm">small</a> | <a href="?slide_show=med">medium</a> | <a href="?slide_show=lg">large</a> | <a href="?slide_show=full">full sized</a>
+	</center>
+	<br>
+	<center>
+		All Images: <a href="?all_full_images=sm">small</a> | '<a href="?all_full_images=med">medium</a> | <a href="?all_full_images=lg">large</a> | <a href="?all_full_images=full">full sized</a>
+	</center>
+`
+}
+
+func (a AlbumsConfig) SortedAlbumTitles() []AlbumTitle {
+	titles := make([]AlbumTitle, 0)
+	for key, value := range a.Albums {
+		titles = append(titles, AlbumTitle{
+			Key:   key,
+			Title: value.AlbumTitle,
+		})
+	}
+
+	sort.Slice(titles, func(i, j int) bool { return titles[i].Title < titles[j].Title })
+	return titles
+}
+
+// The albums the current user is allowed to see, sorted by title
+func (t TemplateSource) SortedAlbumTitles() []AlbumTitle {
+	titles := make([]AlbumTitle, 0)
+	for _, title := range t.AlbumsConfig.SortedAlbumTitles() {
+		if t.AlbumsConfig.Albums[title.Key].IsAllowed(t.User) {
+			titles = append(titles, title)
+		}
+	}
+	return titles
+}
+
+func (t TemplateSource) NeedNewRow(index int) bool {
+	return index > 0 && index%t.NumberOfColumns == 0
+}
+
+func (t TemplateSource) IsImageFile(filename string) bool {
+	return t.Current.IsImageFile(filename)
+}
+
+func (t TemplateSource) GetImageFiles() []os.DirEntry {
+	return t.Current.GetImageFiles(t.Files)
+}
+
+func (t TemplateSource) AsPngFilename(filename string) string {
+	return ChangeExtension(filename, "png")
+}
+
+func (t TemplateSource) HandleDirs(f os.DirEntry, subdir string, depth int) template.HTML {
+	// Check directory to see if there are sub-directories
+	newSubDir := f.Name()
+	if subdir != "" {
+		newSubDir = subdir + "/" + f.Name()
+	}
+	if !t.CanAccess(path.Join(t.PathInfo, newSubDir)) {
+		return ""
+	}
+	dir := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.AlbumDir)
+	if t.PathInfo == "" {
+		dir += "/" + newSubDir
+	} else {
+		dir += "/" + t.PathInfo + "/" + newSubDir
+	}
+
+	children := ""
+	dirEntries, err := os.ReadDir(dir)
+	if err == nil {
+		if t.Current.ReverseDirs {
+			sort.Slice(dirEntries, func(i, j int) bool {
+				return dirEntries[i].Name() > dirEntries[j].Name()
+			})
+		} else {
+			sort.Slice(dirEntries, func(i, j int) bool {
+				return dirEntries[i].Name() < dirEntries[j].Name()
+			})
+		}
+
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() {
+				children += string(t.HandleDirs(dirEntry, newSubDir, depth+1))
+			}
+		}
+		if children != "" {
+			children = "\n                <dd><dl>" + children + "</dl></dd>\n"
+		}
+
+	}
+
+	link := (&url.URL{Path: t.Root + newSubDir + "/"}).EscapedPath()
+	return template.HTML(fmt.Sprintf(`<dt><a href="%s">%s</a></dt>`,
+		template.HTMLEscapeString(link), template.HTMLEscapeString(beautify(f.Name()))) + children)
+}
+
+func (t TemplateSource) MakePicTitle(s string) string {
+	caption, ok := t.CaptionMap[s]
+	if ok {
+		return caption
+	}
+	s = strings.Split(s, ".")[0]
+	return strings.ReplaceAll(strings.ReplaceAll(s, "_", " "), "-", " ")
+}
+
+// The caption for a file as html, or its escaped name when there isn't one
+func (t TemplateSource) PicTitle(s string) template.HTML {
+	if caption, ok := t.CaptionMap[s]; ok {
+		return t.trustedHtml(caption)
+	}
+	return template.HTML(template.HTMLEscapeString(t.MakePicTitle(s)))
+}
+
+func beautify(s string) string {
+	re := regexp.MustCompile(`\d+\((.*)\)`)
+	matches := re.FindSubmatch([]byte(s))
+	if matches != nil {
+		s = string(matches[1])
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "_", " "), "-", " ")
+}
+
+func cleanTn(filename string) string {
+	// The thumbnail will be named something like /a/b/c/tn__filename.jpg or /a/b/c/800x600filename.jpg
+	// need to get rid of the tn__ or 800x600 to get to the actual filename
+	file := path.Base(filename)
+	if strings.HasPrefix(file, "tn__") {
+		return fmt.Sprintf("%s/%s", path.Dir(filename), file[4:])
+	}
+
+	if strings.HasPrefix(file, "800x600_") || strings.HasPrefix(file, "640x480_") {
+		return fmt.Sprintf("%s/%s", path.Dir(filename), file[8:])
+	}
+
+	if strings.HasPrefix(file, "1024x768_") {
+		return fmt.Sprintf("%s/%s", path.Dir(filename), file[9:])
+	}
+	return filename
+}
+
+var safePrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)*$`)
+
+// The X-Forwarded-Prefix header set by a reverse proxy that strips a path before
+// passing the request on.  Anything that isn't a plain path is ignored since it ends up in links.
+func forwardedPrefix(req *http.Request) string {
+	prefix := cleanPrefix(req.Header.Get("X-Forwarded-Prefix"))
+	if !safePrefix.MatchString(prefix) {
+		return ""
+	}
+	return prefix
+}
+
+// Normalizes a path prefix to either "" or a leading slash without a trailing one
+func cleanPrefix(prefix string) string {
+	prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+func fixNextName(currentBase, nextName string) string {
+	if strings.HasPrefix(currentBase, "640x480_") {
+		return "640x480_" + nextName
+	}
+	if strings.HasPrefix(currentBase, "800x600_") {
+		return "800x600_" + nextName
+	}
+	if strings.HasPrefix(currentBase, "1024x768_") {
+		return "1024x768_" + nextName
+	}
+	return nextName
+}
+
+func changeSize(name, filename string) string {
+	switch name {
+	case "sm":
+		return "640x480_" + filename
+	case "med":
+		return "800x600_" + filename
+	case "lg":
+		return "1024x768_" + filename
+	}
+
+	return filename
+}
+
+func LoadAppConfigFile() (*AppConfig, error) {
+	in, err := os.Open(APP_CONFIG_FILENAME)
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.Close()
+	decoder := yaml.NewDecoder(in)
+	var app AppConfig
+	err = decoder.Decode(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+func LoadAlbumsConfigFile(appConfig *AppConfig) (*AlbumsConfig, error) {
+	in, err := os.Open(filepath.Join(appConfig.AlbumsDir, ALBUMS_CONFIG_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+
+	defer in.Close()
+	decoder := yaml.NewDecoder(in)
+	var albumsConfig AlbumsConfig
+	err = decoder.Decode(&albumsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &albumsConfig, nil
+}
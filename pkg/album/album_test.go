@@ -0,0 +1,181 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefix(t *testing.T) {
+	a := setupTestAlbum(t, WithPrefix("photos/"))
+	mux := http.NewServeMux()
+	mux.Handle("/photos/", a)
+
+	var tests = []struct {
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/photos/", http.StatusOK, `<a href="/photos/test/albums/">Test Album</a>`},
+		{"/photos/test/albums/2020/", http.StatusOK, `<a href="/photos/test/albums/2020/%2801%29January/">`},
+		{"/photos/test/albums/", http.StatusOK, `src="/photos/test/thumbs/tn__Bob_and_Jenny.jpg?v=`},
+		{"/photos/test/albums/Bob_and_Jenny.jpg?slide_show=sm", http.StatusOK, `<a href="/photos/test/albums/">Back to Test Album</a>`},
+		{"/photos/api/v1/albums", http.StatusOK, `"treeUrl":"/photos/api/v1/test/tree/"`},
+		{"/test/albums/", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s: expecting body to contain %s, was %s", test.url, test.wantBody, rec.Body.String())
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	a := setupTestAlbum(t)
+	a.appConfig.BasePath = "photos"
+
+	var tests = []struct {
+		url        string
+		forwarded  string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/photos/", "", http.StatusOK, `<a href="/photos/test/albums/">Test Album</a>`},
+		{"/photos/", "/home/", http.StatusOK, `<a href="/home/photos/test/albums/">Test Album</a>`},
+		{"/photos/", `"><script>`, http.StatusOK, `<a href="/photos/test/albums/">Test Album</a>`},
+		{"/photos/test/albums/2020/", "/home", http.StatusOK, `<a href="/home/photos/test/albums/2020/%2801%29January/">`},
+		{"/photos/api/v1/test/tree/", "/home", http.StatusOK, `"url":"/home/photos/test/albums/"`},
+		{"/photos", "/home", http.StatusMovedPermanently, `/home/photos/`},
+		{"/test/albums/", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-Prefix", test.forwarded)
+		}
+		a.ServeHTTP(rec, req)
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s: expecting body to contain %s, was %s", test.url, test.wantBody, rec.Body.String())
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["other"] = AlbumConfig{AlbumTitle: "Other Album", AlbumDir: "source/2020", ThumbDir: "thumbs/other"}
+	albumsConfig.Albums["private"] = AlbumConfig{AlbumTitle: "Private Album", AlbumDir: "source", ThumbDir: "thumbs"}
+	albumsConfig.Hosts = map[string]HostConfig{
+		"photos.smith.example": {Album: "test", Config: Config{BodyArgs: `bgcolor="white"`}},
+		"family.example":       {Albums: []string{"test", "other"}, BodyArgs: `bgcolor="black"`},
+	}
+	a.albumsConfig = albumsConfig
+
+	var tests = []struct {
+		host       string
+		url        string
+		wantStatus int
+		wantBody   string
+		notBody    string
+	}{
+		{"localhost:8000", "/", http.StatusOK, `<a href="/private/albums/">Private Album</a>`, ""},
+		{"photos.smith.example", "/", http.StatusOK, `src="/thumbs/tn__Bob_and_Jenny.jpg?v=`, "Available Albums"},
+		{"photos.smith.example:8000", "/", http.StatusOK, `<body bgcolor="white">`, ""},
+		{"photos.smith.example", "/2020/", http.StatusOK, `<a href="/2020/%2801%29January/">`, ""},
+		{"photos.smith.example", "/thumbs/tn__Bob_and_Jenny.jpg", http.StatusOK, "", ""},
+		{"photos.smith.example", "/other/albums/", http.StatusNotFound, "", ""},
+		{"photos.smith.example", "/api/v1/albums", http.StatusOK, `"url":"/"`, "other"},
+		{"family.example", "/", http.StatusOK, `<body bgcolor="black">`, "Private Album"},
+		{"family.example", "/other/albums/", http.StatusOK, `<a href="/other/albums/%2801%29January/">`, ""},
+		{"family.example", "/private/albums/", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Host = test.host
+		a.ServeHTTP(rec, req)
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s%s: expecting status %d, was %d", test.host, test.url, test.wantStatus, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s%s: expecting body to contain %s, was %s", test.host, test.url, test.wantBody, rec.Body.String())
+		}
+		if test.notBody != "" && strings.Contains(rec.Body.String(), test.notBody) {
+			t.Errorf("GET %s%s: expecting body not to contain %s", test.host, test.url, test.notBody)
+		}
+	}
+}
+
+func TestMissingSized(t *testing.T) {
+	a := setupTestAlbum(t)
+	for _, url := range []string{"/test/albums/640x480_missing.jpg?playvideo=1", "/test/albums/800x600_missing.jpg?slide_show=sm"} {
+		if rec := serve(a, httptest.NewRequest("GET", url, nil)); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expecting status 404, was %d", url, rec.Code)
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	a := setupTestAlbum(t)
+	for _, name := range []string{`"><script>.jpg`, "x<b>.jpg"} {
+		if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source", name), nil, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caption := "<H1>Header</H1>\n__END__\nBob_and_Jenny.jpg: Me and <i>my</i> sister<script>x()</script>\n"
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source", "caption.txt"), []byte(caption), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		url      string
+		policy   string
+		wantBody []string
+	}{
+		{"/test/albums/", "", []string{"<H1>Header</H1>", "Me and <i>my</i> sister<script>x()</script>", `%22%3e%3cscript%3e.jpg"`, "x&lt;b&gt;"}},
+		{"/test/albums/%22%3E%3Cscript%3E.jpg?slide_show=sm", "", []string{`="&#34;&gt;&lt;script&gt;.jpg"`, `&#34;&gt;&lt;script&gt;`}},
+		{"/test/albums/", CAPTION_BASIC, []string{"<H1>Header</H1>", "Me and <i>my</i> sister&lt;script&gt;x()&lt;/script&gt;"}},
+		{"/test/albums/", CAPTION_TEXT, []string{"&lt;H1&gt;Header&lt;/H1&gt;", "Me and &lt;i&gt;my&lt;/i&gt;"}},
+	}
+	for _, theme := range []string{THEME_MODERN, THEME_LEGACY} {
+		for _, test := range tests {
+			albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			albumConfig := albumsConfig.Albums["test"]
+			albumConfig.CaptionPolicy = test.policy
+			albumConfig.Config.Theme = theme
+			albumsConfig.Albums["test"] = albumConfig
+			a.albumsConfig = albumsConfig
+
+			rec := serve(a, httptest.NewRequest("GET", test.url, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET %s: expecting status 200, was %d", test.url, rec.Code)
+			}
+			if strings.Contains(rec.Body.String(), `"><script>`) {
+				t.Errorf("GET %s: filename wasn't escaped: %s", test.url, rec.Body.String())
+			}
+			for _, want := range test.wantBody {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("GET %s with %s %q: expecting body to contain %s, was %s", test.url, theme, test.policy, want, rec.Body.String())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	API_PREFIX = "/api/v1/"
+)
+
+//go:embed openapi.json
+var openApiDoc []byte
+
+type ApiAlbum struct {
+	Key     string `json:"key"`
+	Title   string `json:"title"`
+	Url     string `json:"url"`
+	TreeUrl string `json:"treeUrl"`
+}
+
+type ApiAlbums struct {
+	Albums []ApiAlbum `json:"albums"`
+}
+
+type ApiDir struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Path    string `json:"path"`
+	Url     string `json:"url"`
+	TreeUrl string `json:"treeUrl"`
+}
+
+type ApiConversion struct {
+	State   string `json:"state"`
+	WebmUrl string `json:"webmUrl,omitempty"`
+}
+
+type ApiMedia struct {
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Type         string            `json:"type"`
+	Title        string            `json:"title"`
+	Caption      string            `json:"caption,omitempty"`
+	Url          string            `json:"url"`
+	ThumbnailUrl string            `json:"thumbnailUrl"`
+	Variants     map[string]string `json:"variants,omitempty"`
+	RawUrl       string            `json:"rawUrl,omitempty"`
+	LiveUrl      string            `json:"liveUrl,omitempty"`
+	Conversion   *ApiConversion    `json:"conversion,omitempty"`
+}
+
+type ApiTree struct {
+	Album       string     `json:"album"`
+	AlbumTitle  string     `json:"albumTitle"`
+	Path        string     `json:"path"`
+	Title       string     `json:"title"`
+	Url         string     `json:"url"`
+	Config      Config     `json:"config"`
+	CaptionHtml string     `json:"captionHtml"`
+	Dirs        []ApiDir   `json:"dirs"`
+	Files       []ApiMedia `json:"files"`
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+// Serves the read-only JSON api, apiPath is everything after API_PREFIX
+func (a *Album) handleApi(w http.ResponseWriter, req *http.Request, tmplSource TemplateSource, apiPath string) {
+	if apiPath == "albums" || apiPath == "albums/" {
+		titles := tmplSource.SortedAlbumTitles()
+		albums := ApiAlbums{Albums: make([]ApiAlbum, 0, len(titles))}
+		for _, title := range titles {
+			albums.Albums = append(albums.Albums, ApiAlbum{
+				Key:     title.Key,
+				Title:   title.Title,
+				Url:     tmplSource.AlbumsRootFor(title.Key) + "/",
+				TreeUrl: fmt.Sprintf("%s%s%s/tree/", tmplSource.Prefix, API_PREFIX, title.Key),
+			})
+		}
+		writeJson(w, http.StatusOK, albums)
+		return
+	}
+
+	if apiPath == "openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(openApiDoc)
+		return
+	}
+
+	// Everything else is <album>/tree/<path> or <album>/media/<path>
+	paths := strings.SplitN(apiPath, "/", 3)
+	if len(paths) < 2 {
+		writeJsonError(w, http.StatusNotFound, "unknown api path")
+		return
+	}
+	pathInfo := ""
+	if len(paths) == 3 {
+		pathInfo = strings.TrimPrefix(path.Clean("/"+paths[2]), "/")
+	}
+
+	if err := tmplSource.setApiAlbum(paths[0]); err != nil {
+		writeJsonError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !tmplSource.AlbumConfig.IsAllowed(tmplSource.User) {
+		apiDenyAccess(w, tmplSource)
+		return
+	}
+
+	switch paths[1] {
+	case "tree":
+		a.apiTree(w, tmplSource, pathInfo)
+	case "media":
+		a.apiMedia(w, tmplSource, pathInfo)
+	default:
+		writeJsonError(w, http.StatusNotFound, "unknown api path")
+	}
+}
+
+func (a *Album) apiTree(w http.ResponseWriter, tmplSource TemplateSource, pathInfo string) {
+	if !tmplSource.CanAccess(pathInfo) {
+		apiDenyAccess(w, tmplSource)
+		return
+	}
+	tmplSource.PathInfo = pathInfo
+	albumDir, err := ResolvePath(tmplSource.baseDir(), pathInfo, tmplSource.AlbumConfig.FollowSymlinks)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("no such directory: %s", pathInfo))
+		return
+	}
+	dirEntries, err := os.ReadDir(albumDir)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("no such directory: %s", pathInfo))
+		return
+	}
+	a.readDir(&tmplSource, albumDir, dirEntries)
+	tmplSource.sortDirs()
+
+	tree := ApiTree{
+		Album:       tmplSource.BasePath,
+		AlbumTitle:  tmplSource.AlbumConfig.AlbumTitle,
+		Path:        pathInfo,
+		Title:       beautify(filepath.Base("/" + pathInfo)),
+		Url:         strings.TrimSuffix(tmplSource.albumUrl(), "/") + "/",
+		Config:      tmplSource.Current,
+		CaptionHtml: string(tmplSource.CaptionHtml),
+		Dirs:        make([]ApiDir, 0, len(tmplSource.Dirs)),
+		Files:       make([]ApiMedia, 0, len(tmplSource.Files)),
+	}
+	for _, dir := range tmplSource.Dirs {
+		tree.Dirs = append(tree.Dirs, ApiDir{
+			Name:    dir.Name(),
+			Title:   beautify(dir.Name()),
+			Path:    path.Join(pathInfo, dir.Name()),
+			Url:     tmplSource.albumUrl(dir.Name()) + "/",
+			TreeUrl: tmplSource.Prefix + API_PREFIX + path.Join(tmplSource.BasePath, "tree", pathInfo, dir.Name()) + "/",
+		})
+	}
+	for _, file := range tmplSource.Files {
+		tree.Files = append(tree.Files, a.newApiMedia(tmplSource, file.Name()))
+	}
+	writeJson(w, http.StatusOK, tree)
+}
+
+func (a *Album) apiMedia(w http.ResponseWriter, tmplSource TemplateSource, pathInfo string) {
+	name := path.Base(pathInfo)
+	if pathInfo == "" || !tmplSource.Current.IsViewableFile(name) {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("not a media file: %s", pathInfo))
+		return
+	}
+
+	tmplSource.PathInfo = path.Dir(pathInfo)
+	if tmplSource.PathInfo == "." {
+		tmplSource.PathInfo = ""
+	}
+	if !tmplSource.CanAccess(tmplSource.PathInfo) {
+		apiDenyAccess(w, tmplSource)
+		return
+	}
+	filename, err := ResolvePath(tmplSource.baseDir(), pathInfo, tmplSource.AlbumConfig.FollowSymlinks)
+	if err != nil {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("no such file: %s", pathInfo))
+		return
+	}
+	albumDir := filepath.Dir(filename)
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() {
+		writeJsonError(w, http.StatusNotFound, fmt.Sprintf("no such file: %s", pathInfo))
+		return
+	}
+
+	// Read the directory for the caption.txt and config.yaml
+	dirEntries, err := os.ReadDir(albumDir)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.readDir(&tmplSource, albumDir, dirEntries)
+	writeJson(w, http.StatusOK, a.newApiMedia(tmplSource, name))
+}
+
+func (t *TemplateSource) setApiAlbum(key string) error {
+	albumConfig, ok := t.AlbumsConfig.Albums[key]
+	if !ok {
+		return fmt.Errorf("no such album: %s", key)
+	}
+	t.BasePath = key
+	t.AlbumConfig = albumConfig
+	t.Current = t.AlbumsConfig.Default
+	Merge(&t.Current, &albumConfig.Config)
+	return nil
+}
+
+// Describes a single file in the current directory
+func (a *Album) newApiMedia(t TemplateSource, name string) ApiMedia {
+	media := ApiMedia{
+		Name:    name,
+		Path:    path.Join(t.PathInfo, name),
+		Title:   t.MakePicTitle(name),
+		Caption: strings.TrimSpace(t.CaptionMap[name]),
+		Url:     t.albumUrl(name),
+	}
+
+	if t.Current.IsImageFile(name) {
+		media.Type = MEDIA_IMAGE
+		media.ThumbnailUrl = t.thumbUrl("tn__" + name)
+		media.Variants = make(map[string]string)
+		for size, prefix := range prefixMap {
+			media.Variants[size] = t.thumbUrl(prefix + name)
+		}
+		if t.CanDownload() {
+			media.RawUrl = t.RawUrl(name)
+		}
+		media.LiveUrl = t.LiveUrl(name)
+		return media
+	}
+
+	media.Type = MEDIA_VIDEO
+	media.ThumbnailUrl = t.thumbUrl("tn__" + ChangeExtension(name, "png"))
+	state := CONVERSION_NONE
+	if t.Current.VideoNeedsConversion(name) {
+		state = a.ConversionState(filepath.Join(t.baseDir(), t.PathInfo, name), t.convertedFilename(name))
+	}
+	media.Conversion = &ApiConversion{State: state}
+	if state != CONVERSION_NONE {
+		media.Conversion.WebmUrl = t.thumbUrl(ChangeExtension(name, "webm"))
+	}
+	return media
+}
+
+func apiDenyAccess(w http.ResponseWriter, tmplSource TemplateSource) {
+	if tmplSource.User != nil {
+		writeJsonError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if tmplSource.AlbumsConfig.Auth.BasicAuth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="album", charset="UTF-8"`)
+	}
+	writeJsonError(w, http.StatusUnauthorized, "unauthorized")
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, ApiError{Error: msg})
+}
@@ -0,0 +1,140 @@
+package album
+
+import (
+	"encoding/json"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// Builds an albums directory with a single "test" album
+func setupTestAlbum(t testing.TB, opts ...Option) *Album {
+	albumsDir := t.TempDir()
+	for _, dir := range []string{"source/2020/(01)January", "thumbs"} {
+		if err := os.MkdirAll(filepath.Join(albumsDir, dir), 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for _, name := range []string{"source/Bob_and_Jenny.jpg", "source/2020/(01)January/party.jpg"} {
+		if err := imaging.Save(img, filepath.Join(albumsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"albumsconfig.yaml":   "default:\n    thumbnailWidth: 50\nalbums:\n  test:\n    albumTitle: Test Album\n    albumDir: source\n    thumbDir: thumbs\n",
+		"source/caption.txt":  "<H1>Header</H1>\n__END__\nBob_and_Jenny.jpg: Me and my sister\n",
+		"source/movie.avi":    "not really a movie",
+		"source/.hidden.jpg":  "",
+		"source/notes.txt":    "not media",
+		"source/.hiddenDir/x": "",
+	}
+	for name, contents := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(albumsDir, name)), 0775)
+		if err := os.WriteFile(filepath.Join(albumsDir, name), []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts = append([]Option{WithAppConfig(&AppConfig{AlbumsDir: albumsDir}), WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	return New(opts...)
+}
+
+func getJson(t *testing.T, a *Album, url string, wantStatus int, v interface{}) {
+	req := httptest.NewRequest("GET", url, nil)
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	if rec.Code != wantStatus {
+		t.Fatalf("GET %s: expecting status %d, was %d: %s", url, wantStatus, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: expecting application/json, was %s", url, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestApiAlbums(t *testing.T) {
+	a := setupTestAlbum(t)
+	var albums ApiAlbums
+	getJson(t, a, "/api/v1/albums", http.StatusOK, &albums)
+	if len(albums.Albums) != 1 || albums.Albums[0].Key != "test" || albums.Albums[0].Title != "Test Album" {
+		t.Errorf("Unexpected albums: %v", albums)
+	}
+	if albums.Albums[0].TreeUrl != "/api/v1/test/tree/" {
+		t.Errorf("Unexpected tree url: %s", albums.Albums[0].TreeUrl)
+	}
+}
+
+func TestApiTree(t *testing.T) {
+	a := setupTestAlbum(t)
+	var tree ApiTree
+	getJson(t, a, "/api/v1/test/tree/", http.StatusOK, &tree)
+	if tree.CaptionHtml != "<H1>Header</H1>\n" {
+		t.Errorf("Unexpected caption html: %q", tree.CaptionHtml)
+	}
+	if tree.Config.ThumbnailWidth != 50 {
+		t.Errorf("Expecting effective thumbnailWidth 50, was %d", tree.Config.ThumbnailWidth)
+	}
+	if len(tree.Dirs) != 1 || tree.Dirs[0].Name != "2020" || tree.Dirs[0].TreeUrl != "/api/v1/test/tree/2020/" {
+		t.Errorf("Unexpected dirs: %v", tree.Dirs)
+	}
+	if len(tree.Files) != 2 {
+		t.Fatalf("Expecting 2 files, got %v", tree.Files)
+	}
+
+	image := tree.Files[0]
+	if image.Name != "Bob_and_Jenny.jpg" || image.Type != "image" || image.Caption != "Me and my sister" {
+		t.Errorf("Unexpected image: %v", image)
+	}
+	if image.ThumbnailUrl != "/test/thumbs/tn__Bob_and_Jenny.jpg" || image.Variants["med"] != "/test/thumbs/800x600_Bob_and_Jenny.jpg" {
+		t.Errorf("Unexpected image urls: %v", image)
+	}
+
+	video := tree.Files[1]
+	if video.Type != "video" || video.Conversion == nil || video.Conversion.State == CONVERSION_NONE {
+		t.Errorf("Unexpected video: %v", video)
+	}
+
+	var subTree ApiTree
+	getJson(t, a, "/api/v1/test/tree/2020/(01)January", http.StatusOK, &subTree)
+	if subTree.Path != "2020/(01)January" || len(subTree.Files) != 1 || subTree.Files[0].Url != "/test/albums/2020/(01)January/party.jpg" {
+		t.Errorf("Unexpected sub directory: %v", subTree)
+	}
+}
+
+func TestApiMedia(t *testing.T) {
+	a := setupTestAlbum(t)
+	var media ApiMedia
+	getJson(t, a, "/api/v1/test/media/2020/(01)January/party.jpg", http.StatusOK, &media)
+	if media.Path != "2020/(01)January/party.jpg" || media.Title != "party" || media.Conversion != nil {
+		t.Errorf("Unexpected media: %v", media)
+	}
+
+	var apiError ApiError
+	getJson(t, a, "/api/v1/test/media/missing.jpg", http.StatusNotFound, &apiError)
+	getJson(t, a, "/api/v1/test/media/notes.txt", http.StatusNotFound, &apiError)
+	getJson(t, a, "/api/v1/nosuchalbum/tree/", http.StatusNotFound, &apiError)
+	if apiError.Error == "" {
+		t.Error("Expecting an error message")
+	}
+}
+
+func TestApiOpenApi(t *testing.T) {
+	a := setupTestAlbum(t)
+	var doc map[string]interface{}
+	getJson(t, a, "/api/v1/openapi.json", http.StatusOK, &doc)
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("Unexpected openapi document: %v", doc["openapi"])
+	}
+}
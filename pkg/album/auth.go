@@ -0,0 +1,369 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SESSION_COOKIE          = "album_session"
+	DEFAULT_SESSION_TIMEOUT = 24 * 30
+)
+
+type AuthConfig struct {
+	UsersFile      string   `yaml:"usersFile"`
+	SessionKey     string   `yaml:"sessionKey"`
+	SessionTimeout int      `yaml:"sessionTimeout"`
+	BasicAuth      bool     `yaml:"basicAuth"`
+	Admins         []string `yaml:"admins"`
+	AdminGroups    []string `yaml:"adminGroups"`
+}
+
+type User struct {
+	Name   string
+	Groups []string
+	hash   []byte
+}
+
+// Reads an htpasswd style file of bcrypt hashes, one user per line as name:hash or
+// name:hash:group1,group2.  Blank lines and lines starting with # are ignored.
+func NewUsersFile(f io.Reader) (map[string]*User, error) {
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expecting name:hash[:groups]", lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %s is not a bcrypt hash: %v", lineNumber, fields[0], err)
+		}
+
+		user := &User{Name: fields[0], hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			for _, group := range strings.Split(fields[2], ",") {
+				if group = strings.TrimSpace(group); group != "" {
+					user.Groups = append(user.Groups, group)
+				}
+			}
+		}
+		users[user.Name] = user
+	}
+	return users, scanner.Err()
+}
+
+func (a AuthConfig) Enabled() bool {
+	return a.UsersFile != ""
+}
+
+func (a AuthConfig) GetSessionTimeout() time.Duration {
+	if a.SessionTimeout <= 0 {
+		return DEFAULT_SESSION_TIMEOUT * time.Hour
+	}
+	return time.Duration(a.SessionTimeout) * time.Hour
+}
+
+func (a AuthConfig) IsAdmin(user *User) bool {
+	if user == nil {
+		return false
+	}
+	for _, name := range a.Admins {
+		if name == user.Name {
+			return true
+		}
+	}
+	for _, group := range a.AdminGroups {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a AuthConfig) String() string {
+	return fmt.Sprintf("AuthConfig:{UsersFile:%s,SessionTimeout:%d,BasicAuth:%v,Admins:%v,AdminGroups:%v}", a.UsersFile, a.SessionTimeout, a.BasicAuth, a.Admins, a.AdminGroups)
+}
+
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) String() string {
+	return fmt.Sprintf("User:{Name:%s,Groups:%v}", u.Name, u.Groups)
+}
+
+// An album without allowedUsers or allowedGroups is public.  An allowedUsers entry of
+// "*" lets in anyone who is logged in.
+func (a AlbumConfig) IsAllowed(user *User) bool {
+	if len(a.AllowedUsers) == 0 && len(a.AllowedGroups) == 0 {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+
+	for _, name := range a.AllowedUsers {
+		if name == "*" || name == user.Name {
+			return true
+		}
+	}
+	for _, group := range a.AllowedGroups {
+		if user.InGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// The users file as it was when its size and time were last seen, it's needed on every
+// request once auth is on
+type loadedUsers struct {
+	size    int64
+	modTime time.Time
+	users   map[string]*User
+}
+
+// The users in the users file, only parsed again once it's changed
+func (a *Album) loadUsers(appConfig *AppConfig, authConfig AuthConfig) (map[string]*User, error) {
+	filename := authConfig.UsersFile
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(appConfig.AlbumsDir, filename)
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a.authLock.Lock()
+	loaded, ok := a.loadedUsers[filename]
+	a.authLock.Unlock()
+	if ok && loaded.size == stat.Size() && loaded.modTime.Equal(stat.ModTime()) {
+		return loaded.users, nil
+	}
+
+	users, err := NewUsersFile(in)
+	if err != nil {
+		return nil, err
+	}
+	a.authLock.Lock()
+	a.loadedUsers[filename] = loadedUsers{size: stat.Size(), modTime: stat.ModTime(), users: users}
+	a.authLock.Unlock()
+	return users, nil
+}
+
+// Returns the logged in user from the session cookie, or from an Authorization
+// header when basicAuth is on.  nil means anonymous.
+func (a *Album) currentUser(req *http.Request, appConfig *AppConfig, authConfig AuthConfig) *User {
+	if !authConfig.Enabled() {
+		return nil
+	}
+
+	users, err := a.loadUsers(appConfig, authConfig)
+	if err != nil {
+		a.logger.Printf("Error loading users file %s: %v\n", authConfig.UsersFile, err)
+		return nil
+	}
+
+	if cookie, err := req.Cookie(SESSION_COOKIE); err == nil {
+		if name, ok := a.verifySession(authConfig, cookie.Value); ok {
+			if user, ok := users[name]; ok {
+				return user
+			}
+		}
+	}
+
+	if authConfig.BasicAuth {
+		if name, password, ok := req.BasicAuth(); ok {
+			return a.checkPassword(users, name, password)
+		}
+	}
+	return nil
+}
+
+func (a *Album) checkPassword(users map[string]*User, name, password string) *User {
+	user, ok := users[name]
+	if !ok {
+		// Spend the same time as a real comparison so names can't be guessed
+		bcrypt.CompareHashAndPassword([]byte("$2a$10$lIqS/QV8AC7FSZWnFwcHPOE1k1YMxcowLA4gv/351qEr7m/ym2.V2"), []byte(password))
+		return nil
+	}
+
+	// bcrypt is slow on purpose, remember good logins so basic auth isn't paid on every thumbnail
+	sum := sha256.Sum256([]byte(name + "\x00" + password + "\x00" + string(user.hash)))
+	key := hex.EncodeToString(sum[:])
+	a.authLock.Lock()
+	verified := a.verifiedLogins[key]
+	a.authLock.Unlock()
+	if verified {
+		return user
+	}
+
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(password)) != nil {
+		return nil
+	}
+	a.authLock.Lock()
+	a.verifiedLogins[key] = true
+	a.authLock.Unlock()
+	return user
+}
+
+// Session cookies are name|expiry signed with the session key, nothing is kept on the server
+func (a *Album) signSession(authConfig AuthConfig, name string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + a.sign(authConfig, payload)
+}
+
+func (a *Album) verifySession(authConfig AuthConfig, value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(a.sign(authConfig, value[:i]))) {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return "", false
+	}
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return fields[0], true
+}
+
+func (a *Album) sign(authConfig AuthConfig, payload string) string {
+	key := a.sessionKey
+	if authConfig.SessionKey != "" {
+		key = []byte(authConfig.SessionKey)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Anonymous users are sent to the login page, or asked for basic auth credentials by
+// anything that isn't a page.  Logged in users just aren't allowed.
+func (a *Album) denyAccess(w http.ResponseWriter, req *http.Request, tmplSource TemplateSource, isPage bool) {
+	if tmplSource.User != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if isPage {
+		next := tmplSource.Root
+		if req.URL.RawQuery != "" {
+			next += "?" + req.URL.RawQuery
+		}
+		http.Redirect(w, req, tmplSource.Prefix+"/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	if tmplSource.AlbumsConfig.Auth.BasicAuth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="album", charset="UTF-8"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (a *Album) handleLogin(w http.ResponseWriter, req *http.Request, tmplSource TemplateSource) {
+	authConfig := tmplSource.AlbumsConfig.Auth
+	if !authConfig.Enabled() {
+		http.NotFound(w, req)
+		return
+	}
+
+	next := req.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = tmplSource.Prefix + "/"
+	}
+
+	tmplSource.Current = tmplSource.AlbumsConfig.Default
+	tmplSource.PageTitle = "Log In"
+	tmplSource.Login.Next = next
+	status := http.StatusOK
+	if req.Method == "POST" {
+		users, err := a.loadUsers(tmplSource.AppConfig, authConfig)
+		if err != nil {
+			a.logger.Printf("Error loading users file %s: %v\n", authConfig.UsersFile, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		name := req.PostFormValue("username")
+		if user := a.checkPassword(users, name, req.PostFormValue("password")); user != nil {
+			a.logger.Printf("Login %s\n", name)
+			expires := time.Now().Add(authConfig.GetSessionTimeout())
+			http.SetCookie(w, &http.Cookie{
+				Name:     SESSION_COOKIE,
+				Value:    a.signSession(authConfig, user.Name, expires),
+				Path:     tmplSource.Prefix + "/",
+				Expires:  expires,
+				HttpOnly: true,
+				Secure:   isSecure(req),
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, req, next, http.StatusSeeOther)
+			return
+		}
+		a.logger.Printf("Failed login %s\n", name)
+		tmplSource.Login.Error = "Unknown username or password"
+		status = http.StatusUnauthorized
+	}
+	a.renderStatus(w, req, tmplSource, "login.html", status)
+}
+
+func (a *Album) handleLogout(w http.ResponseWriter, req *http.Request, tmplSource TemplateSource) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     tmplSource.Prefix + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, tmplSource.Prefix+"/", http.StatusSeeOther)
+}
+
+func isSecure(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
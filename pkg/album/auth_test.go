@@ -0,0 +1,212 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bcrypt of "secret"
+const testHash = "$2a$04$7DLZpEpx3PDYCPnUgWX3v.zFmLspAFEROBY34XpWEjD9viy5SfaZS"
+
+func TestNewUsersFile(t *testing.T) {
+	users, err := NewUsersFile(strings.NewReader("# comment\n\nbob:" + testHash + "\njenny:" + testHash + ":family, friends\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["bob"].Name != "bob" || len(users["bob"].Groups) != 0 {
+		t.Errorf("Unexpected users: %v", users)
+	}
+	if !users["jenny"].InGroup("friends") || users["jenny"].InGroup("work") {
+		t.Errorf("Unexpected groups: %v", users["jenny"])
+	}
+
+	for _, input := range []string{"bob", "bob:plaintext", ":" + testHash} {
+		if _, err := NewUsersFile(strings.NewReader(input)); err == nil {
+			t.Errorf("Expecting an error for %s", input)
+		}
+	}
+}
+
+func setupAuthAlbum(t *testing.T, basicAuth bool) *Album {
+	a := setupTestAlbum(t)
+	users := "bob:" + testHash + "\njenny:" + testHash + ":family\n"
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "users"), []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Auth = AuthConfig{UsersFile: "users", BasicAuth: basicAuth}
+	albumsConfig.Shares = ShareConfig{Key: "share secret"}
+	albumsConfig.Albums["family"] = AlbumConfig{AlbumTitle: "Family Album", AlbumDir: "source", ThumbDir: "thumbs", AllowedGroups: []string{"family"}}
+	albumsConfig.Albums["bobs"] = AlbumConfig{AlbumTitle: "Bobs Album", AlbumDir: "source", ThumbDir: "thumbs", AllowedUsers: []string{"bob"}}
+	a.albumsConfig = albumsConfig
+	return a
+}
+
+func TestLoadUsers(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+	authConfig := a.albumsConfig.Auth
+	users, err := a.loadUsers(a.appConfig, authConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := a.loadUsers(a.appConfig, authConfig); err != nil || again["bob"] != users["bob"] {
+		t.Errorf("Expecting the users file to be parsed once, was %v %v", again, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "users"), []byte("bob:"+testHash+":family\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := a.loadUsers(a.appConfig, authConfig); err != nil || len(changed) != 1 || !changed["bob"].InGroup("family") {
+		t.Errorf("Expecting the changed users file, was %v %v", changed, err)
+	}
+}
+
+func serve(a *Album, req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func login(t *testing.T, a *Album, name, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {name}, "password": {password}, "next": {"/family/albums/"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(a, req)
+}
+
+func TestAuthAnonymous(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+
+	rec := serve(a, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "Test Album") || strings.Contains(rec.Body.String(), "Family Album") {
+		t.Errorf("Anonymous index should only show public albums: %s", rec.Body.String())
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", "/family/albums/2020/?slide_show=sm", nil))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?next=%2Ffamily%2Falbums%2F2020%2F%3Fslide_show%3Dsm" {
+		t.Errorf("Expecting a redirect to login, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	for _, path := range []string{"/family/thumbs/tn__Bob_and_Jenny.jpg", "/api/v1/family/tree/"} {
+		rec = serve(a, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "" {
+			t.Errorf("GET %s: expecting 401 without basic auth, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+
+	if rec := login(t, a, "jenny", "wrong"); rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expecting a failed login, got %d", rec.Code)
+	}
+
+	rec := login(t, a, "jenny", "secret")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/family/albums/" {
+		t.Fatalf("Expecting a redirect after login, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SESSION_COOKIE || !cookies[0].HttpOnly {
+		t.Fatalf("Unexpected cookies: %v", cookies)
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", "/", nil), cookies...)
+	if !strings.Contains(rec.Body.String(), "Family Album") || strings.Contains(rec.Body.String(), "Bobs Album") || !strings.Contains(rec.Body.String(), "Logged in as jenny") {
+		t.Errorf("Unexpected index for jenny: %s", rec.Body.String())
+	}
+	if rec = serve(a, httptest.NewRequest("GET", "/family/albums/2020/", nil), cookies...); rec.Code != http.StatusOK {
+		t.Errorf("Expecting jenny to see the family album, got %d", rec.Code)
+	}
+	if rec = serve(a, httptest.NewRequest("GET", "/bobs/albums/", nil), cookies...); rec.Code != http.StatusForbidden {
+		t.Errorf("Expecting jenny to be forbidden from bobs album, got %d", rec.Code)
+	}
+
+	tampered := *cookies[0]
+	tampered.Value = strings.Replace(tampered.Value, ".", "x.", 1)
+	if rec = serve(a, httptest.NewRequest("GET", "/family/albums/", nil), &tampered); rec.Code != http.StatusSeeOther {
+		t.Errorf("Expecting a tampered session to be ignored, got %d", rec.Code)
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", "/logout", nil), cookies...)
+	if logout := rec.Result().Cookies(); len(logout) != 1 || logout[0].MaxAge >= 0 {
+		t.Errorf("Expecting logout to clear the cookie: %v", logout)
+	}
+}
+
+func TestLoginPages(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+	a.albumsConfig.Auth.Admins = []string{"bob"}
+	bob := login(t, a, "bob", "secret").Result().Cookies()
+
+	var tests = []struct {
+		theme       string
+		templateDir string
+		url         string
+		wantBody    string
+	}{
+		{THEME_MODERN, "", "/login?next=/family/albums/", `<input type="hidden" name="next" value="/family/albums/">`},
+		{THEME_MODERN, "", "/shares", `<form class="form" method="post" action="/shares">`},
+		{THEME_LEGACY, "", "/login", `<INPUT TYPE="password" NAME="password">`},
+		{THEME_LEGACY, "", "/shares", `<SELECT NAME="album"><OPTION>bobs</OPTION>`},
+		{THEME_MODERN, "site", "/login", `<form class="site">/</form>`},
+		{THEME_MODERN, "site", "/shares", `<p class="site">bobs family test</p>`},
+	}
+	site := filepath.Join(a.appConfig.AlbumsDir, "site")
+	os.MkdirAll(site, 0775)
+	os.WriteFile(filepath.Join(site, "login.html"), []byte(`<form class="site">{{ .Login.Next }}</form>`), 0664)
+	os.WriteFile(filepath.Join(site, "shares.html"), []byte(`<p class="site">{{ range $i, $album := .Shares.Albums }}{{ if $i }} {{ end }}{{ $album }}{{ end }}</p>`), 0664)
+	for _, test := range tests {
+		a.albumsConfig.Default.Theme = test.theme
+		a.appConfig.TemplateDir = test.templateDir
+		rec := serve(a, httptest.NewRequest("GET", test.url, nil), bob...)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s with %s %q: expecting %s, was %d %s", test.url, test.theme, test.templateDir, test.wantBody, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAuthLoginRedirect(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+	for _, next := range []string{"//evil.example/", "https://evil.example/", "/\\evil.example"} {
+		form := url.Values{"username": {"bob"}, "password": {"secret"}, "next": {next}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if rec := serve(a, req); rec.Header().Get("Location") != "/" {
+			t.Errorf("Expecting login to ignore next=%s, redirected to %s", next, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAuthBasic(t *testing.T) {
+	a := setupAuthAlbum(t, true)
+
+	rec := serve(a, httptest.NewRequest("GET", "/bobs/thumbs/tn__Bob_and_Jenny.jpg", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("Expecting a basic auth challenge, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/bobs/thumbs/tn__Bob_and_Jenny.jpg", nil)
+	req.SetBasicAuth("bob", "secret")
+	if rec = serve(a, req); rec.Code != http.StatusOK {
+		t.Errorf("Expecting basic auth to let bob in, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/bobs/tree/", nil)
+	req.SetBasicAuth("bob", "wrong")
+	if rec = serve(a, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expecting a bad password to be refused, got %d", rec.Code)
+	}
+}
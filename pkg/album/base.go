@@ -0,0 +1,629 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alitto/pond"
+)
+
+const (
+	DEFAULT_ASPECT         = 0.2
+	APP_CONFIG_FILENAME    = "appconfig.yaml"
+	ALBUMS_CONFIG_FILENAME = "albumsconfig.yaml"
+	CONFIG_FILENAME        = "config.yaml"
+	ORDER_FILENAME         = "order.txt"
+
+	CONVERSION_NONE    = "none"
+	CONVERSION_MISSING = "missing"
+	CONVERSION_PENDING = "pending"
+	CONVERSION_DONE    = "done"
+	CONVERSION_FAILED  = "failed"
+)
+
+type AppConfig struct {
+	Port        int    `yaml:"port"`
+	AlbumsDir   string `yaml:"albumsDir"`
+	BasePath    string `yaml:"basePath"`
+	TemplateDir string `yaml:"templateDir"`
+}
+
+type AlbumsConfig struct {
+	BodyArgs string                 `yaml:"bodyArgs"`
+	Default  Config                 `yaml:"default"`
+	Albums   map[string]AlbumConfig `yaml:"albums"`
+	Hosts    map[string]HostConfig  `yaml:"hosts"`
+	Auth     AuthConfig             `yaml:"auth"`
+	Shares   ShareConfig            `yaml:"shares"`
+}
+
+// Binds a Host header to a single album served at / or to a subset of the albums
+type HostConfig struct {
+	Album    string   `yaml:"album"`
+	Albums   []string `yaml:"albums"`
+	BodyArgs string   `yaml:"bodyArgs"`
+	Config   Config   `yaml:"config"`
+}
+
+type AlbumConfig struct {
+	AlbumTitle     string   `yaml:"albumTitle"`
+	AlbumDir       string   `yaml:"albumDir"`
+	ThumbDir       string   `yaml:"thumbDir"`
+	AllowedUsers   []string `yaml:"allowedUsers"`
+	AllowedGroups  []string `yaml:"allowedGroups"`
+	FollowSymlinks bool     `yaml:"followSymlinks"`
+	CaptionPolicy  string   `yaml:"captionPolicy"`
+	TemplateDir    string   `yaml:"templateDir"`
+	Config         Config   `yaml:"config"`
+}
+
+type Config struct {
+	BodyArgs            string      `yaml:"bodyArgs" json:"bodyArgs"`
+	VideoThumbnailSize  string      `yaml:"videoThumbnailSize" json:"videoThumbnailSize"`
+	ThumbnailUse        string      `yaml:"thumbnailUse" json:"thumbnailUse"`
+	ThumbnailWidth      int         `yaml:"thumbnailWidth" json:"thumbnailWidth"`
+	ThumbnailAspect     string      `yaml:"thumbnailAspect" json:"thumbnailAspect"`
+	DefaultBrowserWidth int         `yaml:"defaultBrowserWidth" json:"defaultBrowserWidth"`
+	SlideShowDelay      int         `yaml:"slideShowDelay" json:"slideShowDelay"`
+	NumberOfColumns     int         `yaml:"numberOfColumns" json:"numberOfColumns"`
+	OutsideTableBorder  int         `yaml:"outsideTableBorder" json:"outsideTableBorder"`
+	InsideTableBorder   int         `yaml:"insideTableBorder" json:"insideTableBorder"`
+	EditMode            bool        `yaml:"editMode" json:"editMode"`
+	AllowFinalResize    bool        `yaml:"allowFinalResize" json:"allowFinalResize"`
+	ReverseDirs         bool        `yaml:"reverseDirs" json:"reverseDirs"`
+	ReversePics         bool        `yaml:"reversePics" json:"reversePics"`
+	ThumbnailFormats    []string    `yaml:"thumbnailFormats" json:"thumbnailFormats"`
+	ThumbnailQuality    int         `yaml:"thumbnailQuality" json:"thumbnailQuality"`
+	Theme               string      `yaml:"theme" json:"theme"`
+	ColorScheme         string      `yaml:"colorScheme" json:"colorScheme"`
+	ExtraTypes          []ExtraType `yaml:"extraTypes" json:"extraTypes"`
+	GifThumbnails       string      `yaml:"gifThumbnails" json:"gifThumbnails"`
+	AnimationFormat     string      `yaml:"animationFormat" json:"animationFormat"`
+	StackBursts         bool        `yaml:"stackBursts" json:"stackBursts"`
+	StackSeconds        int         `yaml:"stackSeconds" json:"stackSeconds"`
+	StackDistance       int         `yaml:"stackDistance" json:"stackDistance"`
+	SimilarPhotos       bool        `yaml:"similarPhotos" json:"similarPhotos"`
+	Placeholders        bool        `yaml:"placeholders" json:"placeholders"`
+	Access              Access      `yaml:"access" json:"-"`
+	// The types it knows, built when it's merged rather than for every file
+	mediaTypes *mediaTypeCache
+}
+
+// The data every page template is executed with, see TEMPLATES in the README
+type TemplateSource struct {
+	AppConfig       *AppConfig
+	AlbumsConfig    *AlbumsConfig
+	AlbumConfig     AlbumConfig
+	HostConfig      *HostConfig
+	User            *User
+	Share           *Share
+	Current         Config
+	Prefix          string
+	AlbumsRoot      string
+	ThumbsRoot      string
+	Root            string
+	BasePath        string
+	PathInfo        string
+	DirInfo         string
+	NumberOfColumns int
+	Files           []os.DirEntry
+	Dirs            []os.DirEntry
+	ImageCount      int
+	FullTitle       string
+	PageTitle       string
+	ActualPath      string
+	Mp4Path         string
+	BaseFilename    string
+	FileIndex       int
+	PlayVideo       bool
+	SlideShow       string
+	FinalWidth      int
+	AllImages       string
+	PrevSeven       SevenLink
+	NextSeven       SevenLink
+	Strip           []StripLink
+	CaptionHtml     template.HTML
+	CaptionMap      map[string]string
+	Raws            map[string]string
+	Lives           map[string]string
+	Stacks          map[string][]string
+	Expanded        string
+	Similar         []StripLink
+	Placeholders    map[string]Placeholder
+	Login           LoginForm
+	Shares          SharesForm
+}
+
+// What login.html shows, where to go after logging in and why the last try failed
+type LoginForm struct {
+	Next  string
+	Error string
+}
+
+// What shares.html shows, the albums a link can be made for, the link just made, what
+// the last post did, and the token its forms are posted with
+type SharesForm struct {
+	Albums  []string
+	Link    string
+	Share   *Share
+	Message string
+	Csrf    string
+}
+
+// The link to jump up to seven files back or forward, Count is 0 when there isn't one
+type SevenLink struct {
+	Url   string
+	Count int
+}
+
+// A thumbnail in the strip above a single image or video, or of the photos like it
+type StripLink struct {
+	Url     string
+	Src     string
+	Current bool
+	Video   bool
+}
+
+type CaptionFile struct {
+	Html       string
+	CaptionMap map[string]string
+}
+
+// Create with New, the zero value is not usable
+type Album struct {
+	appConfig    *AppConfig
+	albumsConfig *AlbumsConfig
+	albumsDir    string
+	prefix       string
+	logger       *log.Logger
+	pool         *pond.WorkerPool
+
+	// original filename -> conversion state, and thumbnail formats whose encoder
+	// isn't installed, guarded by workingLock
+	workingMap     map[string]string
+	failedEncoders map[string]bool
+	workingLock    sync.Mutex
+
+	// used to sign session cookies, but not share links, when auth has no sessionKey, and
+	// the users files by name as last read
+	sessionKey     []byte
+	verifiedLogins map[string]bool
+	loadedUsers    map[string]loadedUsers
+	authLock       sync.Mutex
+
+	// thumbDir -> when its similar photos index was last updated, zero while it's being
+	// updated, and the indexes as last read, guarded by similarLock
+	similarIndexed map[string]time.Time
+	similarIndexes map[string]loadedIndex
+	similarLock    sync.Mutex
+
+	// held from loading a directory's .info.json to saving it, requests for its grid and
+	// its thumbnails change it at the same time, the photos being hashed in the
+	// background by their path in thumbDir, those getting placeholders made the same way,
+	// and the versions of the thumbnails in each .info.json as last read
+	infoLock          sync.Mutex
+	hashing           map[string]bool
+	placeholding      map[string]bool
+	thumbnailVersions map[string]loadedVersions
+}
+
+type AlbumTitle struct {
+	Key   string
+	Title string
+}
+
+var (
+	prefixMap = map[string]string{
+		"sm":  "640x480_",
+		"med": "800x600_",
+		"lg":  "1024x768_",
+	}
+	sizeWidths = map[string]int{
+		"sm":  640,
+		"med": 800,
+		"lg":  1024,
+	}
+)
+
+// The functions below only know the registered media types, Config has the same ones
+// for an album with extraTypes
+
+func GetImageFiles(files []os.DirEntry) []os.DirEntry {
+	return Config{}.GetImageFiles(files)
+}
+
+func IsViewableFile(filename string) bool {
+	return Config{}.IsViewableFile(filename)
+}
+
+func IsImageFile(filename string) bool {
+	return Config{}.IsImageFile(filename)
+}
+
+func IsVideoFile(filename string) bool {
+	return Config{}.IsVideoFile(filename)
+}
+
+func VideoNeedsConversion(filename string) bool {
+	return Config{}.VideoNeedsConversion(filename)
+}
+
+func CanHtmlPlay(filename string) bool {
+	return Config{}.CanHtmlPlay(filename)
+}
+
+func IsFfmpegAvailable() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+func GenerateVideoThumbnail(inFilename, size, outFilename string) error {
+	cmd := exec.Command("ffmpeg", "-i", inFilename, "-frames:v", "1", "-s", size, outFilename)
+	return cmd.Run()
+}
+
+func ConvertVideoFile(inFilename, outFilename string) error {
+	cmd := exec.Command("ffmpeg", "-i", inFilename, outFilename)
+	return cmd.Run()
+}
+
+// Queues a background conversion of originalFilename unless one is already running or has failed
+func (a *Album) SubmitConversion(originalFilename, convertedFilename string) {
+	a.workingLock.Lock()
+	defer a.workingLock.Unlock()
+	if state := a.workingMap[originalFilename]; state == CONVERSION_PENDING || state == CONVERSION_FAILED {
+		return
+	}
+
+	a.logger.Printf("Converting %s to %s\n", originalFilename, convertedFilename)
+	a.workingMap[originalFilename] = CONVERSION_PENDING
+	a.pool.Submit(func() {
+		state := CONVERSION_DONE
+		if err := ConvertVideoFile(originalFilename, convertedFilename); err != nil {
+			a.logger.Printf("Error converting %s: %v\n", originalFilename, err)
+			state = CONVERSION_FAILED
+		}
+		a.workingLock.Lock()
+		a.workingMap[originalFilename] = state
+		a.workingLock.Unlock()
+	})
+}
+
+// State of the conversion of a video that needs one
+func (a *Album) ConversionState(originalFilename, convertedFilename string) string {
+	a.workingLock.Lock()
+	state, ok := a.workingMap[originalFilename]
+	a.workingLock.Unlock()
+	if ok && state != CONVERSION_DONE {
+		return state
+	}
+
+	if _, err := os.Stat(convertedFilename); err != nil {
+		return CONVERSION_MISSING
+	}
+	return CONVERSION_DONE
+}
+
+func ChangeExtension(filename, ext string) string {
+	return fmt.Sprintf("%s.%s", strings.TrimSuffix(filename, filepath.Ext(filename)), ext)
+}
+
+func (a AppConfig) String() string {
+	return fmt.Sprintf("AppConfig:{Port:%d,AlbumsDir:%s,BasePath:%s,TemplateDir:%s}", a.Port, a.AlbumsDir, a.BasePath, a.TemplateDir)
+}
+
+// bodyArgs is written by whoever runs the albums, so it goes into <BODY> as is
+func (a AlbumsConfig) BodyAttrs() template.HTMLAttr {
+	return template.HTMLAttr(a.BodyArgs)
+}
+
+func (c Config) BodyAttrs() template.HTMLAttr {
+	return template.HTMLAttr(c.BodyArgs)
+}
+
+func (a AlbumsConfig) String() string {
+	return fmt.Sprintf("AlbumsConfig:{Default:%v,Albums:%v,Hosts:%v,Auth:%v,Shares:%v}", a.Default, a.Albums, a.Hosts, a.Auth, a.Shares)
+}
+
+func (h HostConfig) String() string {
+	return fmt.Sprintf("HostConfig:{Album:%s,Albums:%v,BodyArgs:%s,Config:%v}", h.Album, h.Albums, h.BodyArgs, h.Config)
+}
+
+func (a AlbumConfig) String() string {
+	return fmt.Sprintf("AlbumConfig:{AlbumTitle:%s,AlbumDir:%s,ThumbDir:%s,AllowedUsers:%v,AllowedGroups:%v,FollowSymlinks:%v,CaptionPolicy:%s,TemplateDir:%s,Config:%v}", a.AlbumTitle, a.AlbumDir, a.ThumbDir, a.AllowedUsers, a.AllowedGroups, a.FollowSymlinks, a.CaptionPolicy, a.TemplateDir, a.Config)
+}
+
+// width, square, or fill WxH
+func (c Config) GetThumbnailUse() string {
+	if c.ThumbnailUse == "" {
+		return THUMBNAIL_WIDTH
+	}
+	return c.ThumbnailUse
+}
+
+func (c Config) GetThumbnailQuality() int {
+	if c.ThumbnailQuality <= 0 || c.ThumbnailQuality > 100 {
+		return DEFAULT_THUMBNAIL_QUALITY
+	}
+	return c.ThumbnailQuality
+}
+
+func (c Config) GetThumbnailWidth() int {
+	if c.ThumbnailWidth == 0 {
+		return 100
+	}
+	return c.ThumbnailWidth
+}
+
+func (c Config) GetColorScheme() string {
+	switch c.ColorScheme {
+	case "light", "dark":
+		return c.ColorScheme
+	}
+	return "auto"
+}
+
+// Thumbnails of animated GIFs are animated unless this is static
+func (c Config) GetGifThumbnails() string {
+	if c.GifThumbnails == GIF_STATIC {
+		return GIF_STATIC
+	}
+	return GIF_ANIMATED
+}
+
+// webp or mp4 to convert animated GIFs to, or "" to leave them GIFs
+func (c Config) GetAnimationFormat() string {
+	switch format := strings.ToLower(c.AnimationFormat); format {
+	case FORMAT_WEBP, FORMAT_MP4:
+		return format
+	}
+	return ""
+}
+
+// How many seconds apart photos that look alike can be and still be stacked
+func (c Config) GetStackSeconds() int {
+	if c.StackSeconds <= 0 {
+		return DEFAULT_STACK_SECONDS
+	}
+	return c.StackSeconds
+}
+
+// How many bits of their hashes photos taken together can differ in and still be stacked
+func (c Config) GetStackDistance() int {
+	if c.StackDistance <= 0 {
+		return DEFAULT_STACK_DISTANCE
+	}
+	return c.StackDistance
+}
+
+func (c Config) GetVideoThumbnailSize() string {
+	if c.VideoThumbnailSize == "" {
+		return "200x150"
+	}
+	return c.VideoThumbnailSize
+}
+
+func (c Config) GetDefaultBrowserWidth() int {
+	if c.DefaultBrowserWidth == 0 {
+		return 640
+	}
+	return c.DefaultBrowserWidth
+}
+
+func (c Config) GetThumbnailAspect() float64 {
+	if c.ThumbnailAspect == "" {
+		return DEFAULT_ASPECT
+	}
+
+	aspect, err := strconv.ParseFloat(strings.TrimSpace(c.ThumbnailAspect), 64)
+	if err == nil {
+		return aspect
+	}
+
+	// If it's not already a float see if it's a simple division
+	split := strings.Split(c.ThumbnailAspect, "/")
+	if len(split) != 2 {
+		return DEFAULT_ASPECT
+	}
+
+	num, err := strconv.ParseFloat(strings.TrimSpace(split[0]), 64)
+	if err != nil {
+		fmt.Printf("Could not parse:'%s', err:%v\n", split[0], err)
+		return DEFAULT_ASPECT
+	}
+	den, err := strconv.ParseFloat(strings.TrimSpace(split[1]), 64)
+	if err != nil {
+		fmt.Printf("Could not parse:'%s', err:%v\n", split[1], err)
+		return DEFAULT_ASPECT
+	}
+	return num / den
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("Config:{BodyArgs:%s,VideoThumbnailSize:%s,ThumbnailUse:%s,ThumbnailWidth:%d,ThumbnailAspect:%s,SlideShowDelay:%d,NumberOfColumns:%d,EditMode:%v,AllowFinalResize:%v,ReverseDirs:%v,ReversePics:%v,ThumbnailFormats:%v,ThumbnailQuality:%d,Theme:%s,ColorScheme:%s,ExtraTypes:%v,GifThumbnails:%s,AnimationFormat:%s,StackBursts:%v,StackSeconds:%d,StackDistance:%d,SimilarPhotos:%v,Placeholders:%v,Access:%v}",
+		c.BodyArgs, c.VideoThumbnailSize, c.ThumbnailUse, c.ThumbnailWidth, c.ThumbnailAspect, c.SlideShowDelay, c.NumberOfColumns, c.EditMode, c.AllowFinalResize, c.ReverseDirs, c.ReversePics, c.ThumbnailFormats, c.ThumbnailQuality, c.Theme, c.ColorScheme, c.ExtraTypes, c.GifThumbnails, c.AnimationFormat, c.StackBursts, c.StackSeconds, c.StackDistance, c.SimilarPhotos, c.Placeholders, c.Access)
+}
+
+func (t TemplateSource) String() string {
+	return fmt.Sprintf(`TemplateSource:{AppConfig:%v,AlbumsConfig:%v,AlbumConfig:%v,Current:%v,Prefix:%s,AlbumsRoot:%s,ThumbsRoot:%s,Root:%s,BasePath:%s,PathInfo:%s,DirInfo:%s,Files:%v,Dirs:%v,ImageCount:%v,FullTitle:%s,PageTitle:%s,ActualPath:%s,Mp4Path:%s,BaseFilename:%s,FileIndex:%d,PrevSeven:%v,NextSeven:%v,CaptionHtml:%s,CaptionMap:%v}`,
+		t.AppConfig, t.AlbumsConfig, t.AlbumConfig, t.Current, t.Prefix, t.AlbumsRoot, t.ThumbsRoot, t.Root, t.BasePath, t.PathInfo, t.DirInfo, t.Files, t.Dirs, t.ImageCount, t.FullTitle, t.PageTitle, t.ActualPath, t.Mp4Path, t.BaseFilename, t.FileIndex, t.PrevSeven, t.NextSeven, t.CaptionHtml, t.CaptionMap)
+}
+
+func (a AlbumTitle) String() string {
+	return fmt.Sprintf(`AlbumTitle:{Key:%s,Title:%s}`, a.Key, a.Title)
+}
+
+func NewCaptionFile(f io.Reader) *CaptionFile {
+	html := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && scanner.Text() != "__END__" {
+		html += scanner.Text() + "\n"
+	}
+
+	captionMap := make(map[string]string)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, ":")
+		if i > -1 {
+			captionMap[line[0:i]] = line[i+1:]
+		}
+	}
+
+	return &CaptionFile{
+		Html:       html,
+		CaptionMap: captionMap,
+	}
+}
+
+// Returns the view of the albums for a Host header, or the albums unchanged if the host
+// has no entry in hosts.  The copy only holds the albums the host may serve, with the
+// host's config merged over each album's config.
+func (a *AlbumsConfig) ForHost(host string) (*AlbumsConfig, *HostConfig) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	hostConfig, ok := a.Hosts[strings.ToLower(host)]
+	if !ok {
+		return a, nil
+	}
+
+	keys := hostConfig.Albums
+	if hostConfig.Album != "" {
+		keys = []string{hostConfig.Album}
+	}
+
+	copied := *a
+	copied.Albums = make(map[string]AlbumConfig)
+	if hostConfig.BodyArgs != "" {
+		copied.BodyArgs = hostConfig.BodyArgs
+	}
+	for _, key := range keys {
+		albumConfig, ok := a.Albums[key]
+		if !ok {
+			continue
+		}
+		Merge(&albumConfig.Config, &hostConfig.Config)
+		copied.Albums[key] = albumConfig
+	}
+	return &copied, &hostConfig
+}
+
+// merges any non-default values in b into a
+func Merge(a, b *Config) {
+	if b.BodyArgs != "" {
+		a.BodyArgs = b.BodyArgs
+	}
+
+	if b.VideoThumbnailSize != "" {
+		a.VideoThumbnailSize = b.VideoThumbnailSize
+	}
+
+	if b.ThumbnailUse != "" {
+		a.ThumbnailUse = b.ThumbnailUse
+	}
+
+	if b.ThumbnailWidth > 0 {
+		a.ThumbnailWidth = b.ThumbnailWidth
+	}
+
+	if b.ThumbnailAspect != "" {
+		a.ThumbnailAspect = b.ThumbnailAspect
+	}
+
+	if b.SlideShowDelay > 0 {
+		a.SlideShowDelay = b.SlideShowDelay
+	}
+
+	if b.NumberOfColumns > 0 {
+		a.NumberOfColumns = b.NumberOfColumns
+	}
+
+	if b.EditMode {
+		a.EditMode = true
+	}
+
+	if b.AllowFinalResize {
+		a.AllowFinalResize = true
+	}
+	if b.ReverseDirs {
+		a.ReverseDirs = true
+	}
+
+	if b.ReversePics {
+		a.ReversePics = true
+	}
+
+	if len(b.ThumbnailFormats) > 0 {
+		a.ThumbnailFormats = b.ThumbnailFormats
+	}
+
+	if b.ThumbnailQuality > 0 {
+		a.ThumbnailQuality = b.ThumbnailQuality
+	}
+
+	if b.Theme != "" {
+		a.Theme = b.Theme
+	}
+
+	if b.ColorScheme != "" {
+		a.ColorScheme = b.ColorScheme
+	}
+
+	// A directory adds to the types of the album rather than replacing them
+	if len(b.ExtraTypes) > 0 {
+		a.ExtraTypes = append(append([]ExtraType{}, a.ExtraTypes...), b.ExtraTypes...)
+	}
+
+	if b.GifThumbnails != "" {
+		a.GifThumbnails = b.GifThumbnails
+	}
+
+	if b.AnimationFormat != "" {
+		a.AnimationFormat = b.AnimationFormat
+	}
+
+	if b.StackBursts {
+		a.StackBursts = true
+	}
+
+	if b.StackSeconds > 0 {
+		a.StackSeconds = b.StackSeconds
+	}
+
+	if b.StackDistance > 0 {
+		a.StackDistance = b.StackDistance
+	}
+
+	if b.SimilarPhotos {
+		a.SimilarPhotos = true
+	}
+
+	if b.Placeholders {
+		a.Placeholders = true
+	}
+
+	if b.Access.Mode != "" {
+		a.Access = b.Access
+	}
+
+	a.cacheMediaTypes()
+}
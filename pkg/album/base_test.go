@@ -67,3 +67,17 @@ john5.jpg: This is <A HREF="mailto:johndoe@nowhere.com">John</A>
 		}
 	}
 }
+
+func TestString(t *testing.T) {
+	config := Config{VideoThumbnailSize: "640x480", ThumbnailUse: "square"}
+	if s := config.String(); !strings.Contains(s, "VideoThumbnailSize:640x480,ThumbnailUse:square,") {
+		t.Errorf("Expecting each setting after its own label, was %s", s)
+	}
+	tmplSource := TemplateSource{AlbumsConfig: &AlbumsConfig{}, AlbumConfig: AlbumConfig{AlbumTitle: "Test Album"}}
+	if s := tmplSource.String(); strings.Count(s, "AlbumConfig:AlbumConfig:") != 1 || !strings.Contains(s, "AlbumsConfig:AlbumsConfig:") || strings.Contains(s, ",,") {
+		t.Errorf("Expecting AlbumsConfig and AlbumConfig once each, was %s", s)
+	}
+	if s := (AlbumTitle{Key: "test", Title: "Test Album"}).String(); s != "AlbumTitle:{Key:test,Title:Test Album}" {
+		t.Errorf("Expecting the key and title, was %s", s)
+	}
+}
@@ -0,0 +1,296 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	VERSION_PARAM     = "v"
+	IMMUTABLE_MAX_AGE = 365 * 24 * 60 * 60
+
+	// Smaller pages aren't worth compressing
+	MIN_COMPRESS_SIZE = 1024
+)
+
+// The templates are built in, so a restart can change every page
+var startTime = time.Now()
+
+// A short strong validator for whatever was made from a file with params
+func fileVersion(stat os.FileInfo, params ...interface{}) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d", stat.Size(), stat.ModTime().UnixNano())
+	for _, param := range params {
+		fmt.Fprintf(h, " %v", param)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Version of every thumbnail and size variant made from an original with config, and of
+// a cropped thumbnail with the focal point it was cropped around.  Everything in config
+// that changes the bytes served, or their type, is part of it.
+func thumbnailVersion(config Config, stat os.FileInfo, focus ...string) string {
+	formats := make([]string, len(config.ThumbnailFormats))
+	for i, format := range config.ThumbnailFormats {
+		formats[i] = strings.ToLower(format)
+	}
+	params := []interface{}{config.GetThumbnailWidth(), config.GetThumbnailQuality(), config.GetVideoThumbnailSize(), config.GetThumbnailUse(),
+		config.GetGifThumbnails(), config.GetAnimationFormat(), strings.Join(formats, ",")}
+	for _, point := range focus {
+		params = append(params, point)
+	}
+	return fileVersion(stat, params...)
+}
+
+// The versions the thumbnails in an .info.json were made with, by filename
+type loadedVersions struct {
+	size     int64
+	modTime  time.Time
+	versions map[string]string
+}
+
+// Whether thumbnail was made with version, as saved in the .info.json at infoFilename by
+// saveThumbnailVersion.  It's asked for every thumbnail served, so what's in the file is
+// kept until it changes.
+func (a *Album) thumbnailMadeWith(infoFilename, thumbnail, version string) bool {
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	stat, err := os.Stat(infoFilename)
+	if err != nil {
+		return false
+	}
+	loaded, ok := a.thumbnailVersions[infoFilename]
+	if !ok || loaded.size != stat.Size() || !loaded.modTime.Equal(stat.ModTime()) {
+		loaded = loadedVersions{size: stat.Size(), modTime: stat.ModTime(), versions: make(map[string]string)}
+		for _, info := range loadDirInfo(infoFilename) {
+			for name, version := range info.Thumbnails {
+				loaded.versions[name] = version
+			}
+		}
+		a.thumbnailVersions[infoFilename] = loaded
+	}
+	return loaded.versions[filepath.Base(thumbnail)] == version
+}
+
+// Saves the version thumbnail was just made with from the original at source, pathInfo in
+// the album, so it's made again when it no longer matches
+func (a *Album) saveThumbnailVersion(thumbDir, pathInfo, source, thumbnail, version string) {
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(path.Dir(pathInfo)), INFO_FILENAME)
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	infos := loadDirInfo(infoFilename)
+	info, _ := infos.lookup(source, filepath.Base(source))
+	if info == nil {
+		return
+	}
+	if info.Thumbnails == nil {
+		info.Thumbnails = make(map[string]string)
+	}
+	info.Thumbnails[filepath.Base(thumbnail)] = version
+	if err := infos.save(infoFilename); err != nil {
+		a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+	}
+}
+
+// Versioned links never change, so they can be kept for a year.  Anything else is checked
+// with its ETag or Last-Modified each time.
+func cacheControl(public, immutable bool) string {
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	if immutable {
+		return fmt.Sprintf("%s, max-age=%d, immutable", scope, IMMUTABLE_MAX_AGE)
+	}
+	return scope + ", no-cache"
+}
+
+// Adds the version of name in the current directory to a link to one of its thumbnails,
+// thumbnails are only made with the album's own config so config.yaml files don't count
+func (t TemplateSource) versioned(link, name string) string {
+	return t.versionedPath(link, path.Join(t.currentDir(), name))
+}
+
+// Adds the version of the file at pathInfo in the album to a link to one of its thumbnails
+func (t TemplateSource) versionedPath(link, pathInfo string) string {
+	stat, err := os.Stat(filepath.Join(t.baseDir(), filepath.FromSlash(pathInfo)))
+	if err != nil {
+		return link
+	}
+	config := t.AlbumsConfig.Default
+	Merge(&config, &t.AlbumConfig.Config)
+	version := thumbnailVersion(config, stat)
+	if config.CropsThumbnails() && strings.HasPrefix(path.Base(link), "tn__") && config.IsImageFile(pathInfo) {
+		focus, _ := focusPoint(t.baseDir(), pathInfo)
+		version = thumbnailVersion(config, stat, focus)
+	}
+	separator := "?"
+	if strings.Contains(link, "?") {
+		separator = "&"
+	}
+	return link + separator + VERSION_PARAM + "=" + version
+}
+
+// A page depends on the entries of its directory, the caption.txt and config.yaml files in it
+// and above it, the albums config, the templates, for a photo the similar photos index, and
+// for a directory what's cached of its photos as their thumbnails are made.
+// When none of them are newer than the browser's copy, it gets a 304 before any of the work
+// of making the page is done.
+func (a *Album) pageNotModified(w http.ResponseWriter, req *http.Request, t TemplateSource, albumDir string, dirEntries []os.DirEntry) bool {
+	modTime := startTime
+	newer := func(stat os.FileInfo) {
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+
+	files := []string{albumDir, filepath.Join(t.AppConfig.AlbumsDir, ALBUMS_CONFIG_FILENAME)}
+	dir := t.baseDir()
+	files = append(files, filepath.Join(dir, CONFIG_FILENAME))
+	if rel, err := filepath.Rel(dir, albumDir); err == nil && rel != "." {
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, elem)
+			files = append(files, filepath.Join(dir, CONFIG_FILENAME))
+		}
+	}
+	if t.ActualPath != "" {
+		// A photo's page shows the photos like it
+		files = append(files, filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir, SIMILAR_FILENAME))
+	} else {
+		// The grid shows the placeholders of thumbnails made since
+		files = append(files, filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir, t.currentDir(), INFO_FILENAME))
+	}
+	for _, templateDir := range t.templateDirs() {
+		glob, _ := filepath.Glob(filepath.Join(templateDir, "*.html"))
+		files = append(files, glob...)
+	}
+	for _, file := range files {
+		if stat, err := os.Stat(file); err == nil {
+			newer(stat)
+		}
+	}
+	for _, dirEntry := range dirEntries {
+		if stat, err := dirEntry.Info(); err == nil {
+			newer(stat)
+		}
+	}
+
+	// The same page looks different to other users, behind other proxies, and on screens
+	// that a full sized slide show sends other widths to
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %s %s %d", modTime.UnixNano(), t.Prefix, t.HostConfig, t.FinalWidth)
+	if t.User != nil {
+		fmt.Fprintf(h, " %s %v", t.User.Name, t.User.Groups)
+	}
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil))[:16] + `"`
+
+	w.Header().Set("Cache-Control", cacheControl(false, false))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err != nil || modTime.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func etagMatches(match, etag string) bool {
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a page compressed with brotli or gzip when the browser takes them
+func writeCompressed(w http.ResponseWriter, req *http.Request, status int, body []byte) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := ""
+	if len(body) >= MIN_COMPRESS_SIZE {
+		encoding = acceptedEncoding(req.Header.Get("Accept-Encoding"))
+	}
+	if encoding == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+
+	var buf bytes.Buffer
+	var compressor io.WriteCloser
+	if encoding == "br" {
+		compressor = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	} else {
+		compressor = gzip.NewWriter(&buf)
+	}
+	compressor.Write(body)
+	compressor.Close()
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// br if the browser takes it, otherwise gzip, otherwise ""
+func acceptedEncoding(accept string) string {
+	encodings := parseAccept(accept)
+	for _, encoding := range []string{"br", "gzip"} {
+		if encodings[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// The values listed in an Accept or Accept-Encoding header, false for those with q=0
+func parseAccept(accept string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[value] = true
+		for _, param := range params[1:] {
+			nameValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(nameValue) < 2 || nameValue[0] != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(nameValue[1], 64); err == nil && q <= 0 {
+				accepted[value] = false
+			}
+		}
+	}
+	return accepted
+}
+
+// Strong validator for an original in the album
+func originalEtag(stat os.FileInfo) string {
+	return `"` + fileVersion(stat) + `"`
+}
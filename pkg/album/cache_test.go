@@ -0,0 +1,192 @@
+package album
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestThumbnailCaching(t *testing.T) {
+	a := setupAuthAlbum(t, true)
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	versioned := regexp.MustCompile(`src="(/test/thumbs/tn__Bob_and_Jenny.jpg\?v=[0-9a-f]+)"`).FindStringSubmatch(page)
+	if versioned == nil {
+		t.Fatalf("Expecting a versioned thumbnail link, was %s", page)
+	}
+
+	rec := serve(a, httptest.NewRequest("GET", versioned[1], nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("GET %s: expecting an immutable thumbnail with an ETag, was %d %v", versioned[1], rec.Code, rec.Header())
+	}
+
+	var tests = []struct {
+		url          string
+		ifNoneMatch  string
+		user         string
+		wantStatus   int
+		cacheControl string
+	}{
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg", "", "", http.StatusOK, "public, no-cache"},
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg?v=stale", "", "", http.StatusOK, "public, no-cache"},
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg", etag, "", http.StatusNotModified, "public, no-cache"},
+		{"/family/thumbs/tn__Bob_and_Jenny.jpg", "", "jenny", http.StatusOK, "private, no-cache"},
+		{"/test/albums/Bob_and_Jenny.jpg", "", "", http.StatusOK, "public, no-cache"},
+		{"/family/albums/Bob_and_Jenny.jpg", "", "jenny", http.StatusOK, "private, no-cache"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "secret")
+		}
+		rec := serve(a, req)
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if rec.Header().Get("Cache-Control") != test.cacheControl {
+			t.Errorf("GET %s: expecting Cache-Control %s, was %s", test.url, test.cacheControl, rec.Header().Get("Cache-Control"))
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("GET %s: expecting an ETag", test.url)
+		}
+	}
+
+	// A changed original makes a new thumbnail with a new version
+	thumbnail := filepath.Join(a.appConfig.AlbumsDir, "thumbs", "tn__Bob_and_Jenny.jpg")
+	changed, made := time.Now().Add(-time.Hour), time.Now().Add(-2*time.Hour)
+	if err := os.Chtimes(filepath.Join(a.appConfig.AlbumsDir, "source", "Bob_and_Jenny.jpg"), changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(thumbnail, made, made); err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(a, httptest.NewRequest("GET", versioned[1], nil))
+	if rec.Header().Get("ETag") == etag || strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("Expecting a new version after the original changed, was %v", rec.Header())
+	}
+	if stat, err := os.Stat(thumbnail); err != nil || !stat.ModTime().After(changed) {
+		t.Errorf("Expecting the thumbnail to be made again: %v", err)
+	}
+
+	// So do settings it wasn't made with, the old one isn't served under the new version
+	before, err := os.ReadFile(thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := map[string]bool{}
+	for _, config := range []Config{{ThumbnailQuality: 10}, {ThumbnailQuality: 10, GifThumbnails: GIF_STATIC}, {ThumbnailQuality: 10, ThumbnailFormats: []string{"webp"}}} {
+		albumConfig := albumsConfig.Albums["test"]
+		albumConfig.Config = config
+		albumsConfig.Albums["test"] = albumConfig
+		a.albumsConfig = albumsConfig
+		page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+		link := regexp.MustCompile(`src="(/test/thumbs/tn__Bob_and_Jenny.jpg\?v=[0-9a-f]+)"`).FindStringSubmatch(page)
+		if link == nil || versions[link[1]] {
+			t.Fatalf("Expecting a new version with %v, was %v", config, link)
+		}
+		versions[link[1]] = true
+		serve(a, httptest.NewRequest("GET", link[1], nil))
+	}
+	if after, err := os.ReadFile(thumbnail); err != nil || string(after) == string(before) {
+		t.Errorf("Expecting the thumbnail to be made again with the new quality: %v", err)
+	}
+}
+
+func TestPageCaching(t *testing.T) {
+	a := setupTestAlbum(t)
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/albums/", nil))
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("Expecting validators on a directory page, was %d %v", rec.Code, rec.Header())
+	}
+
+	var tests = []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"If-None-Match", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"If-Modified-Since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `W/"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{"old copy", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/test/albums/", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if rec := serve(a, req); rec.Code != test.wantStatus {
+			t.Errorf("%s: expecting status %d, was %d", test.name, test.wantStatus, rec.Code)
+		}
+	}
+
+	// Editing caption.txt doesn't change the directory, but does change the page
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(a.appConfig.AlbumsDir, "source", "caption.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/test/albums/", nil)
+	req.Header.Set("If-None-Match", etag)
+	if rec := serve(a, req); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("Expecting a new page after caption.txt changed, was %d %s", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	a := setupTestAlbum(t)
+
+	var tests = []struct {
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"", ""},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/test/albums/", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := serve(a, req)
+		if rec.Header().Get("Content-Encoding") != test.wantEncoding {
+			t.Errorf("Accept-Encoding %q: expecting %q, was %q", test.acceptEncoding, test.wantEncoding, rec.Header().Get("Content-Encoding"))
+		}
+		if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("Accept-Encoding %q: expecting Vary: Accept-Encoding, was %v", test.acceptEncoding, rec.Header())
+		}
+
+		var body io.Reader = rec.Body
+		switch test.wantEncoding {
+		case "gzip":
+			reader, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = reader
+		case "br":
+			body = brotli.NewReader(rec.Body)
+		}
+		html, err := io.ReadAll(body)
+		if err != nil || !strings.Contains(string(html), "tn__Bob_and_Jenny.jpg") {
+			t.Errorf("Accept-Encoding %q: expecting the page, was %v %s", test.acceptEncoding, err, html)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	THUMBNAIL_WIDTH  = "width"
+	THUMBNAIL_SQUARE = "square"
+	THUMBNAIL_FILL   = "fill"
+
+	// The focal points of the photos in a directory, a line of "name: x% y%" each
+	FOCUS_FILENAME = "focus.txt"
+
+	// The longest side of the copy of a photo its edges are found on
+	SALIENCY_SIZE = 64
+
+	// How much less the edges at the very side of a photo count than those in the middle
+	CENTER_BIAS = 0.3
+
+	// What the modern grid shows thumbnails as when they aren't cropped
+	DEFAULT_THUMBNAIL_RATIO = 4.0 / 3.0
+)
+
+// The size thumbnails are cropped to with thumbnailUse square or fill WxH, false when
+// they're only resized to thumbnailWidth
+func (c Config) thumbnailCrop() (int, int, bool) {
+	fields := strings.Fields(strings.ToLower(c.GetThumbnailUse()))
+	if len(fields) == 0 {
+		return 0, 0, false
+	}
+	switch fields[0] {
+	case THUMBNAIL_SQUARE:
+		return c.GetThumbnailWidth(), c.GetThumbnailWidth(), true
+	case THUMBNAIL_FILL:
+		if len(fields) != 2 {
+			return 0, 0, false
+		}
+		var width, height int
+		if _, err := fmt.Sscanf(fields[1], "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+			return 0, 0, false
+		}
+		return width, height, true
+	}
+	return 0, 0, false
+}
+
+// Whether the thumbnails of images are cropped to a fixed size
+func (c Config) CropsThumbnails() bool {
+	_, _, crop := c.thumbnailCrop()
+	return crop
+}
+
+// Whether the thumbnails of the album are cropped, they're made with the album's own config
+// so config.yaml files don't count
+func (t TemplateSource) CropsThumbnails() bool {
+	config := t.AlbumsConfig.Default
+	Merge(&config, &t.AlbumConfig.Config)
+	return config.CropsThumbnails()
+}
+
+// Width over height of the thumbnails of the album in the grid
+func (t TemplateSource) ThumbnailRatio() float64 {
+	config := t.AlbumsConfig.Default
+	Merge(&config, &t.AlbumConfig.Config)
+	if width, height, crop := config.thumbnailCrop(); crop {
+		return float64(width) / float64(height)
+	}
+	return DEFAULT_THUMBNAIL_RATIO
+}
+
+// Where the cropped thumbnail of the image at pathInfo is cached, apart from its tn__
+// thumbnail as the hashes of similar photos and duplicates are made from that
+func cropFilename(pathInfo string, width, height int) string {
+	return path.Join(path.Dir(pathInfo), fmt.Sprintf("tn%dx%d__%s", width, height, path.Base(pathInfo)))
+}
+
+// The focal point of the photo at pathInfo in the album at albumDir from the focus.txt next
+// to it, and when that was changed.  "" when it doesn't have one.
+func focusPoint(albumDir, pathInfo string) (string, os.FileInfo) {
+	filename := filepath.Join(albumDir, filepath.FromSlash(path.Dir(pathInfo)), FOCUS_FILENAME)
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", nil
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return "", nil
+	}
+
+	name := path.Base(pathInfo)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.LastIndex(line, ":"); i > -1 && strings.TrimSpace(line[:i]) == name {
+			return strings.TrimSpace(line[i+1:]), stat
+		}
+	}
+	return "", stat
+}
+
+// A focal point of "x% y%" across and down the photo as fractions of its width and height
+func parseFocus(focus string) (float64, float64, bool) {
+	fields := strings.Fields(focus)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	var fractions [2]float64
+	for i, field := range fields {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, false
+		}
+		fractions[i] = percent / 100
+	}
+	return fractions[0], fractions[1], true
+}
+
+// Crops img to the shape of width x height around focus, or else around the part of it
+// with the most edges, and resizes it to them
+func smartCrop(img image.Image, width, height int, focus string) image.Image {
+	bounds := img.Bounds()
+	cropWidth, cropHeight := bounds.Dx(), bounds.Dy()
+	if cropWidth*height > cropHeight*width {
+		cropWidth = int(math.Round(float64(cropHeight) * float64(width) / float64(height)))
+	} else {
+		cropHeight = int(math.Round(float64(cropWidth) * float64(height) / float64(width)))
+	}
+	if cropWidth < 1 {
+		cropWidth = 1
+	}
+	if cropHeight < 1 {
+		cropHeight = 1
+	}
+
+	var x, y int
+	if focusX, focusY, ok := parseFocus(focus); ok {
+		x = int(focusX*float64(bounds.Dx())) - cropWidth/2
+		y = int(focusY*float64(bounds.Dy())) - cropHeight/2
+	} else {
+		x, y = salientOffset(img, cropWidth, cropHeight)
+	}
+	x = clamp(x, 0, bounds.Dx()-cropWidth)
+	y = clamp(y, 0, bounds.Dy()-cropHeight)
+	cropped := imaging.Crop(img, image.Rect(bounds.Min.X+x, bounds.Min.Y+y, bounds.Min.X+x+cropWidth, bounds.Min.Y+y+cropHeight))
+	return imaging.Resize(cropped, width, height, imaging.Box)
+}
+
+// Where a cropWidth x cropHeight window over img takes in the most edges, sliding along the
+// side it's shorter than img on.  Edges are found on a gray copy no bigger than
+// SALIENCY_SIZE, and count for less towards the sides so a plain photo is cropped in the middle.
+func salientOffset(img image.Image, cropWidth, cropHeight int) (int, int) {
+	bounds := img.Bounds()
+	across := cropWidth < bounds.Dx()
+	if !across && cropHeight >= bounds.Dy() {
+		return 0, 0
+	}
+	small := imaging.Grayscale(imaging.Fit(img, SALIENCY_SIZE, SALIENCY_SIZE, imaging.Box))
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+	gray := func(x, y int) float64 {
+		return float64(small.Pix[y*small.Stride+x*4])
+	}
+
+	// The edges in each column, or row, of the copy
+	length, window := height, int(math.Round(float64(cropHeight)*float64(height)/float64(bounds.Dy())))
+	if across {
+		length, window = width, int(math.Round(float64(cropWidth)*float64(width)/float64(bounds.Dx())))
+	}
+	window = clamp(window, 1, length)
+	sums := make([]float64, length+1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			edge := 0.0
+			if x+1 < width {
+				edge += math.Abs(gray(x+1, y) - gray(x, y))
+			}
+			if y+1 < height {
+				edge += math.Abs(gray(x, y+1) - gray(x, y))
+			}
+			if across {
+				sums[x+1] += edge
+			} else {
+				sums[y+1] += edge
+			}
+		}
+	}
+	for i := 1; i <= length; i++ {
+		sums[i] += sums[i-1]
+	}
+
+	best, bestScore, bestOffCenter := 0, -1.0, 1.0
+	for start := 0; start+window <= length; start++ {
+		offCenter := math.Abs(float64(start)+float64(window)/2-float64(length)/2) / float64(length)
+		score := (sums[start+window] - sums[start]) * (1 - CENTER_BIAS*2*offCenter)
+		if score > bestScore || score == bestScore && offCenter < bestOffCenter {
+			best, bestScore, bestOffCenter = start, score, offCenter
+		}
+	}
+	if across {
+		return best * bounds.Dx() / width, 0
+	}
+	return 0, best * bounds.Dy() / height
+}
+
+func clamp(n, lo, hi int) int {
+	if n > hi {
+		n = hi
+	}
+	if n < lo {
+		n = lo
+	}
+	return n
+}
+
+// Makes the cropped thumbnail of source, whose type is mediaType
+func cropThumbnail(mediaType MediaType, source, thumbnail string, opts ThumbnailOptions, width, height int, focus string) error {
+	decoder, ok := mediaType.(ImageDecoder)
+	if !ok {
+		return fmt.Errorf("can't decode %s", source)
+	}
+	img, err := decoder.Decode(source, opts.Rendition)
+	if err != nil {
+		return err
+	}
+	return saveThumbnail(smartCrop(img, width, height, focus), thumbnail, opts.Quality)
+}
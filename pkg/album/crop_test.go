@@ -0,0 +1,131 @@
+package album
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestThumbnailCrop(t *testing.T) {
+	var tests = []struct {
+		use                   string
+		wantWidth, wantHeight int
+		wantCrop              bool
+	}{
+		{"", 0, 0, false},
+		{"width", 0, 0, false},
+		{"aspect", 0, 0, false},
+		{"square", 50, 50, true},
+		{"Fill 200x150", 200, 150, true},
+		{"fill", 0, 0, false},
+		{"fill 200", 0, 0, false},
+		{"fill 0x150", 0, 0, false},
+	}
+	for _, test := range tests {
+		config := Config{ThumbnailUse: test.use, ThumbnailWidth: 50}
+		if width, height, crop := config.thumbnailCrop(); width != test.wantWidth || height != test.wantHeight || crop != test.wantCrop {
+			t.Errorf("%q: expecting %dx%d %v, was %dx%d %v", test.use, test.wantWidth, test.wantHeight, test.wantCrop, width, height, crop)
+		}
+	}
+}
+
+func TestParseFocus(t *testing.T) {
+	if x, y, ok := parseFocus("25% 75%"); !ok || x != 0.25 || y != 0.75 {
+		t.Errorf("Expecting 0.25 0.75, was %f %f %v", x, y, ok)
+	}
+	for _, focus := range []string{"", "25%", "a% 10%", "110% 10%", "10% 10% 10%"} {
+		if _, _, ok := parseFocus(focus); ok {
+			t.Errorf("Expecting %q not to be a focal point", focus)
+		}
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// A plain panorama with a checkerboard towards its right
+	img := image.NewGray(image.Rect(0, 0, 120, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 120; x++ {
+			level := uint8(128)
+			if x >= 80 && (x/4+y/4)%2 == 0 {
+				level = 255
+			}
+			img.SetGray(x, y, color.Gray{Y: level})
+		}
+	}
+	if x, y := salientOffset(img, 40, 40); x < 60 || y != 0 {
+		t.Errorf("Expecting the checkerboard to be kept, was %d %d", x, y)
+	}
+	// Edges are found on a smaller copy so the middle is only within a pixel or two
+	if x, y := salientOffset(image.NewGray(image.Rect(0, 0, 120, 40)), 40, 40); x < 38 || x > 42 || y != 0 {
+		t.Errorf("Expecting a plain photo to be cropped in the middle, was %d %d", x, y)
+	}
+	if x, y := salientOffset(image.NewGray(image.Rect(0, 0, 40, 120)), 40, 40); x != 0 || y < 38 || y > 42 {
+		t.Errorf("Expecting a tall plain photo to be cropped in the middle, was %d %d", x, y)
+	}
+
+	cropped := smartCrop(img, 20, 20, "0% 50%")
+	if cropped.Bounds().Dx() != 20 || cropped.Bounds().Dy() != 20 {
+		t.Fatalf("Expecting 20x20, was %v", cropped.Bounds())
+	}
+	if r, _, _, _ := cropped.At(19, 0).RGBA(); r>>8 != 128 {
+		t.Errorf("Expecting the focal point to keep the plain side, was %d", r>>8)
+	}
+}
+
+func TestCroppedThumbnails(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsDir := a.appConfig.AlbumsDir
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.ThumbnailUse = "square"
+	albumsConfig.Albums["test"] = albumConfig
+	a.albumsConfig = albumsConfig
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/tn__Bob_and_Jenny.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting the thumbnail, was %d: %s", rec.Code, rec.Body.String())
+	}
+	thumbnail, _, err := image.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail.Bounds().Dx() != 50 || thumbnail.Bounds().Dy() != 50 {
+		t.Errorf("Expecting a 50x50 thumbnail, was %v", thumbnail.Bounds())
+	}
+	if _, err := os.Stat(filepath.Join(albumsDir, "thumbs", "tn50x50__Bob_and_Jenny.jpg")); err != nil {
+		t.Errorf("Expecting the crop to be cached apart, %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(albumsDir, "thumbs", "tn__Bob_and_Jenny.jpg")); err == nil {
+		t.Error("Expecting the tn__ thumbnail to be left for hashing")
+	}
+
+	versioned := regexp.MustCompile(`src="/test/thumbs/tn__Bob_and_Jenny.jpg\?v=([0-9a-f]+)"`)
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	before := versioned.FindStringSubmatch(page)
+	if before == nil {
+		t.Fatalf("Expecting a versioned thumbnail, was %s", page)
+	}
+	if regexp.MustCompile(`srcset="[^"]*Bob_and_Jenny`).MatchString(page) {
+		t.Error("Expecting no srcset for cropped thumbnails")
+	}
+
+	// Moving the focal point makes a new crop
+	if err := os.WriteFile(filepath.Join(albumsDir, "source", FOCUS_FILENAME), []byte("Bob_and_Jenny.jpg: 10% 50%\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	after := versioned.FindStringSubmatch(serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String())
+	if after == nil || after[1] == before[1] {
+		t.Errorf("Expecting the focal point to change the version, was %v %v", before, after)
+	}
+	if focus, _ := focusPoint(filepath.Join(albumsDir, "source"), "Bob_and_Jenny.jpg"); focus != "10% 50%" {
+		t.Errorf("Expecting the focal point from %s, was %q", FOCUS_FILENAME, focus)
+	}
+}
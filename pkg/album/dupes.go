@@ -0,0 +1,386 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// How many bits the hashes of two photos can differ in and still be copies of each other
+	DEFAULT_DUPE_DISTANCE = 4
+)
+
+// A photo in an album, Path is relative to albumDir
+type Duplicate struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// Photos that look the same.  Keep is the biggest of them, Copies the rest biggest first.
+type DuplicateCluster struct {
+	Keep   Duplicate   `json:"keep"`
+	Copies []Duplicate `json:"copies"`
+}
+
+func (d Duplicate) String() string {
+	return fmt.Sprintf("%s\t%dx%d\t%d", d.Path, d.Width, d.Height, d.Size)
+}
+
+// Walks album key for photos whose hashes are within distance bits of each other.  Hashes
+// are made from the tn__ thumbnails when they're up to date, so an album that's been
+// browsed is quick, and are cached in the .info.json of each directory of thumbDir.
+func (a *Album) FindDuplicates(key string, distance int) ([]DuplicateCluster, error) {
+	appConfig, albumsConfig, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	albumConfig, ok := albumsConfig.Albums[key]
+	if !ok {
+		return nil, fmt.Errorf("no album %s", key)
+	}
+	config := albumsConfig.Default
+	Merge(&config, &albumConfig.Config)
+	albumDir := filepath.Join(appConfig.AlbumsDir, albumConfig.AlbumDir)
+	thumbDir := filepath.Join(appConfig.AlbumsDir, albumConfig.ThumbDir)
+
+	var photos []Duplicate
+	err = walkPhotos(config, albumDir, func(dir string, config Config, names []string) error {
+		photos = append(photos, a.dirPhotos(config, albumDir, thumbDir, dir, names)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusterDuplicates(photos, distance), nil
+}
+
+// Calls fn with each directory of the album at albumDir that isn't hidden, relative to it,
+// config with that of the config.yaml in it, and the names of the photos in it.  Links
+// aren't photos, and neither is a raw file with a jpeg of the same name, it's the same photo.
+func walkPhotos(config Config, albumDir string, fn func(dir string, config Config, names []string) error) error {
+	albumDir, err := filepath.EvalSymlinks(albumDir)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(albumDir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if filename != albumDir && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(albumDir, filename)
+		if err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(filename)
+		if err != nil {
+			return err
+		}
+		dirConfig := config
+		if loaded, err := LoadConfigFile(filepath.Join(filename, CONFIG_FILENAME)); err == nil {
+			Merge(&dirConfig, loaded)
+		}
+
+		images := make(map[string]bool)
+		var candidates []string
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") || !dirConfig.IsImageFile(entry.Name()) {
+				continue
+			}
+			candidates = append(candidates, entry.Name())
+			if !dirConfig.IsRawFile(entry.Name()) {
+				images[strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))] = true
+			}
+		}
+		var names []string
+		for _, name := range candidates {
+			if !dirConfig.IsRawFile(name) || !images[strings.TrimSuffix(name, path.Ext(name))] {
+				names = append(names, name)
+			}
+		}
+		return fn(filepath.ToSlash(rel), dirConfig, names)
+	})
+}
+
+// The photos names in dir of the album with their hashes and sizes.  Hashing can take a
+// while, so what's found is merged into the .info.json of dir once it's done.
+func (a *Album) dirPhotos(config Config, albumDir, thumbDir, dir string, names []string) []Duplicate {
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(dir), INFO_FILENAME)
+	a.infoLock.Lock()
+	infos := loadDirInfo(infoFilename)
+	a.infoLock.Unlock()
+	var changed []string
+	var photos []Duplicate
+	for _, name := range names {
+		source := filepath.Join(albumDir, filepath.FromSlash(dir), name)
+		pathInfo := path.Join(dir, name)
+		info, fresh := infos.lookup(source, name)
+		if info == nil {
+			continue
+		}
+		if info.Hash == "" {
+			info.Hash = NO_HASH
+			if hash, err := photoHash(config, source, thumbDir, pathInfo); err == nil {
+				info.Hash = fmt.Sprintf("%016x", hash)
+			} else {
+				a.logger.Printf("Error hashing %s: %v\n", pathInfo, err)
+			}
+			fresh = true
+		}
+		if info.Hash != NO_HASH && info.Width == 0 {
+			var err error
+			if info.Width, info.Height, err = photoSize(config, source, filepath.Join(thumbDir, heifRendition(pathInfo))); err != nil {
+				a.logger.Printf("Error sizing %s: %v\n", pathInfo, err)
+			}
+			fresh = true
+		}
+		if fresh {
+			changed = append(changed, name)
+		}
+		if info.Hash == NO_HASH {
+			continue
+		}
+		photos = append(photos, Duplicate{Path: pathInfo, Size: info.Size, Width: info.Width, Height: info.Height, Hash: info.Hash})
+	}
+
+	if len(changed) > 0 {
+		if err := a.mergeDirInfo(infoFilename, infos, changed); err != nil {
+			a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+		}
+	}
+	return photos
+}
+
+// The width and height of the image at source, from its header when imaging can read it
+func photoSize(config Config, source, rendition string) (int, int, error) {
+	if !config.IsRawFile(source) {
+		if in, err := os.Open(source); err == nil {
+			imgConfig, _, err := image.DecodeConfig(in)
+			in.Close()
+			if err == nil {
+				return imgConfig.Width, imgConfig.Height, nil
+			}
+		}
+	}
+	decoder, ok := config.DetectMediaType(source).(ImageDecoder)
+	if !ok {
+		return 0, 0, fmt.Errorf("can't decode %s", source)
+	}
+	img, err := decoder.Decode(source, rendition)
+	if err != nil {
+		return 0, 0, err
+	}
+	return img.Bounds().Dx(), img.Bounds().Dy(), nil
+}
+
+// Groups photos whose hashes are within distance bits of the biggest of the group, the
+// one kept.  Going by the one kept rather than any photo in the group means a chain of
+// photos a little different from the one before doesn't make copies of very different
+// ones.  Photos with no copies are left out.
+func clusterDuplicates(photos []Duplicate, distance int) []DuplicateCluster {
+	photos = append([]Duplicate{}, photos...)
+	sort.Slice(photos, func(i, j int) bool {
+		if pixels, other := photos[i].Width*photos[i].Height, photos[j].Width*photos[j].Height; pixels != other {
+			return pixels > other
+		}
+		if photos[i].Size != photos[j].Size {
+			return photos[i].Size > photos[j].Size
+		}
+		return photos[i].Path < photos[j].Path
+	})
+	hashes := make([]uint64, len(photos))
+	for i, photo := range photos {
+		hashes[i], _ = strconv.ParseUint(photo.Hash, 16, 64)
+	}
+
+	clustered := make([]bool, len(photos))
+	var clusters []DuplicateCluster
+	for i := range photos {
+		if clustered[i] {
+			continue
+		}
+		cluster := DuplicateCluster{Keep: photos[i]}
+		for j := i + 1; j < len(photos); j++ {
+			if !clustered[j] && hashDistance(hashes[i], hashes[j]) <= distance {
+				clustered[j] = true
+				cluster.Copies = append(cluster.Copies, photos[j])
+			}
+		}
+		if len(cluster.Copies) > 0 {
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Keep.Path < clusters[j].Keep.Path
+	})
+	return clusters
+}
+
+// Moves the copies in clusters of album key into quarantineDir under the paths they had
+// in the album, keeping the biggest of each.  The raw file or live photo video that goes
+// with a copy goes with it, or it would be shown on its own.  quarantineDir has to be
+// outside albumDir or they'd still be shown, and nothing already in it is overwritten.
+func (a *Album) QuarantineDuplicates(key string, clusters []DuplicateCluster, quarantineDir string) error {
+	appConfig, albumsConfig, err := a.loadConfig()
+	if err != nil {
+		return err
+	}
+	albumConfig, ok := albumsConfig.Albums[key]
+	if !ok {
+		return fmt.Errorf("no album %s", key)
+	}
+	config := albumsConfig.Default
+	Merge(&config, &albumConfig.Config)
+	albumDir, err := filepath.Abs(filepath.Join(appConfig.AlbumsDir, albumConfig.AlbumDir))
+	if err != nil {
+		return err
+	}
+	if quarantineDir, err = filepath.Abs(quarantineDir); err != nil {
+		return err
+	}
+	if isWithin(albumDir, quarantineDir) {
+		return fmt.Errorf("quarantine directory %s is inside %s", quarantineDir, albumDir)
+	}
+	// The album is walked with its symlinks followed, so one into it is inside it too
+	resolvedAlbumDir, err := filepath.EvalSymlinks(albumDir)
+	if err != nil {
+		return err
+	}
+	resolvedQuarantineDir, err := evalExistingSymlinks(quarantineDir)
+	if err != nil {
+		return err
+	}
+	if isWithin(resolvedAlbumDir, resolvedQuarantineDir) {
+		return fmt.Errorf("quarantine directory %s is inside %s", quarantineDir, albumDir)
+	}
+
+	for _, cluster := range clusters {
+		for _, dupe := range cluster.Copies {
+			source, err := ResolvePath(albumDir, dupe.Path, false)
+			if err != nil {
+				return err
+			}
+			names, err := companions(withDirTypes(config, albumDir, path.Dir(dupe.Path)), source)
+			if err != nil {
+				return err
+			}
+			paths := []string{dupe.Path}
+			for _, name := range names {
+				paths = append(paths, path.Join(path.Dir(dupe.Path), name))
+			}
+			for _, pathInfo := range paths {
+				if _, err := os.Lstat(filepath.Join(quarantineDir, filepath.FromSlash(pathInfo))); err == nil {
+					return fmt.Errorf("%s already exists", filepath.Join(quarantineDir, filepath.FromSlash(pathInfo)))
+				}
+			}
+			if err := os.MkdirAll(filepath.Join(quarantineDir, filepath.FromSlash(path.Dir(dupe.Path))), 0775); err != nil {
+				return err
+			}
+			for _, pathInfo := range paths {
+				target := filepath.Join(quarantineDir, filepath.FromSlash(pathInfo))
+				if err := moveFile(filepath.Join(albumDir, filepath.FromSlash(pathInfo)), target); err != nil {
+					return err
+				}
+				a.logger.Printf("Moved %s to %s, a copy of %s\n", pathInfo, target, cluster.Keep.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// name with the symlinks resolved in as much of it as exists, the rest is left as it is
+func evalExistingSymlinks(name string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return filepath.Join(name, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+}
+
+// The names of the files next to the photo at source that the grid shows as part of it, a
+// raw file or a live photo video of the same name.  They stay when another image of that
+// name does, the grid would show them with it.
+func companions(config Config, source string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(source))
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Base(source)
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == filename || !entry.Type().IsRegular() || strings.TrimSuffix(name, filepath.Ext(name)) != base {
+			continue
+		}
+		switch {
+		case config.IsVideoFile(name), config.IsRawFile(name) && !config.IsRawFile(filename):
+			names = append(names, name)
+		case config.IsImageFile(name) && !config.IsRawFile(name):
+			return nil, nil
+		}
+	}
+	return names, nil
+}
+
+// Renames source to target, or copies it when that can't be done, ie they're on different
+// file systems
+func moveFile(source, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return os.Remove(source)
+}
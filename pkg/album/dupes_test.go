@@ -0,0 +1,135 @@
+package album
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsDir := a.appConfig.AlbumsDir
+	save := func(name string, width int, reversed bool) {
+		os.MkdirAll(filepath.Dir(filepath.Join(albumsDir, name)), 0775)
+		if err := imaging.Save(imaging.Resize(gradient(reversed, 0), width, 0, imaging.Box), filepath.Join(albumsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("source/lighter.jpg", 90, false)
+	save("source/2020/lighter copy.jpg", 45, false)
+	bands := image.NewGray(image.Rect(0, 0, 90, 60))
+	for x := 0; x < 90; x++ {
+		for y := 0; y < 60; y++ {
+			bands.SetGray(x, y, color.Gray{Y: uint8(x / 20 % 2 * 200)})
+		}
+	}
+	if err := imaging.Save(bands, filepath.Join(albumsDir, "source/bands.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	save("source/.hiddenDir/lighter.jpg", 90, false)
+
+	// The thumbnail is hashed instead of the original when it's up to date
+	save("source/2020/(01)January/thumbed.jpg", 60, true)
+	save("thumbs/2020/(01)January/tn__thumbed.jpg", 30, false)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(albumsDir, "thumbs/2020/(01)January/tn__thumbed.jpg"), later, later)
+
+	clusters, err := a.FindDuplicates("test", DEFAULT_DUPE_DISTANCE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"2020/(01)January/party.jpg", "Bob_and_Jenny.jpg"},
+		{"lighter.jpg", "2020/(01)January/thumbed.jpg", "2020/lighter copy.jpg"},
+	}
+	if len(clusters) != len(want) {
+		t.Fatalf("Expecting %d clusters, was %v", len(want), clusters)
+	}
+	for i, cluster := range clusters {
+		paths := []string{cluster.Keep.Path}
+		for _, dupe := range cluster.Copies {
+			paths = append(paths, dupe.Path)
+		}
+		if len(paths) != len(want[i]) {
+			t.Errorf("Expecting cluster %v, was %v", want[i], paths)
+			continue
+		}
+		for j := range paths {
+			if paths[j] != want[i][j] {
+				t.Errorf("Expecting cluster %v, was %v", want[i], paths)
+				break
+			}
+		}
+	}
+	if keep := clusters[1].Keep; keep.Width != 90 || keep.Height != 60 || keep.Size == 0 {
+		t.Errorf("Expecting the size of lighter.jpg, was %v", keep)
+	}
+	if infos := loadDirInfo(filepath.Join(albumsDir, "thumbs", INFO_FILENAME)); infos["lighter.jpg"] == nil || infos["lighter.jpg"].Width != 90 {
+		t.Errorf("Expecting the hash and size to be cached, was %v", infos)
+	}
+
+	if _, err := a.FindDuplicates("missing", DEFAULT_DUPE_DISTANCE); err == nil {
+		t.Error("Expecting an error for an unknown album")
+	}
+}
+
+func TestClusterDuplicates(t *testing.T) {
+	// b is a copy of a and c of b, but a and c are too far apart to be copies
+	photos := []Duplicate{
+		{Path: "c.jpg", Hash: "00000000000000ff", Width: 30, Height: 20},
+		{Path: "b.jpg", Hash: "000000000000000f", Width: 60, Height: 40},
+		{Path: "a.jpg", Hash: "0000000000000000", Width: 90, Height: 60},
+	}
+	clusters := clusterDuplicates(photos, 4)
+	if len(clusters) != 1 || clusters[0].Keep.Path != "a.jpg" || len(clusters[0].Copies) != 1 || clusters[0].Copies[0].Path != "b.jpg" {
+		t.Errorf("Expecting only b.jpg to be a copy of a.jpg, was %v", clusters)
+	}
+	if photos[0].Path != "c.jpg" {
+		t.Error("Expecting the photos to be left in their order")
+	}
+}
+
+func TestQuarantineDuplicates(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	clusters := []DuplicateCluster{{Keep: Duplicate{Path: "Bob_and_Jenny.jpg"}, Copies: []Duplicate{{Path: "2020/(01)January/party.jpg"}}}}
+
+	if err := a.QuarantineDuplicates("test", clusters, filepath.Join(source, "quarantine")); err == nil {
+		t.Error("Expecting a quarantine inside albumDir to be refused")
+	}
+	link := filepath.Join(t.TempDir(), "album")
+	if err := os.Symlink(source, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.QuarantineDuplicates("test", clusters, filepath.Join(link, "quarantine", "2024")); err == nil {
+		t.Error("Expecting a quarantine reached through a symlink into albumDir to be refused")
+	}
+
+	// The raw and live photo video of the copy go with it, the grid shows them as part of it
+	for _, name := range []string{"party.dng", "party.mov"} {
+		if err := os.WriteFile(filepath.Join(source, "2020/(01)January", name), []byte(name), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quarantine := t.TempDir()
+	if err := a.QuarantineDuplicates("test", clusters, quarantine); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"party.jpg", "party.dng", "party.mov"} {
+		if _, err := os.Stat(filepath.Join(quarantine, "2020/(01)January", name)); err != nil {
+			t.Errorf("Expecting %s to be moved: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(source, "2020/(01)January", name)); !os.IsNotExist(err) {
+			t.Errorf("Expecting %s to be gone from the album, was %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(source, "Bob_and_Jenny.jpg")); err != nil {
+		t.Errorf("Expecting the biggest copy to be kept: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	FORMAT_WEBP = "webp"
+	FORMAT_AVIF = "avif"
+	FORMAT_MP4  = "mp4"
+
+	// Asks for an animation as an mp4, browsers don't list video/mp4 in Accept for a <video>
+	FORMAT_PARAM = "format"
+
+	DEFAULT_THUMBNAIL_QUALITY = 85
+)
+
+// Commands that re-encode a thumbnail into a format, quality is 1 to 100.  The output
+// format is given with -f since out doesn't end in the format's extension.  mp4 is only
+// made from animated GIFs.
+var imageEncoders = map[string]func(in, out string, quality int) *exec.Cmd{
+	FORMAT_WEBP: func(in, out string, quality int) *exec.Cmd {
+		return exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", in, "-c:v", "libwebp", "-quality", strconv.Itoa(quality), "-loop", "0", "-f", "webp", out)
+	},
+	FORMAT_MP4: func(in, out string, quality int) *exec.Cmd {
+		crf := 18 + (100-quality)*33/100
+		return exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", in, "-c:v", "libx264", "-crf", strconv.Itoa(crf), "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-movflags", "+faststart", "-an", "-f", "mp4", out)
+	},
+	FORMAT_AVIF: func(in, out string, quality int) *exec.Cmd {
+		crf := 63 - quality*63/100
+		return exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", in, "-c:v", "libaom-av1", "-still-picture", "1", "-crf", strconv.Itoa(crf), "-f", "avif", out)
+	},
+}
+
+// The formats the browser listed in its Accept header, in the order of preference in formats.
+// Wildcards don't count, browsers name the formats they can show.
+func acceptedFormats(accept string, formats []string) []string {
+	accepted := parseAccept(accept)
+	var matched []string
+	for _, format := range formats {
+		format = strings.ToLower(format)
+		if _, ok := imageEncoders[format]; ok && accepted["image/"+format] {
+			matched = append(matched, format)
+		}
+	}
+	return matched
+}
+
+// Serves the thumbnail at filename in the best format the browser accepts, the other formats
+// are made from it the first time they're asked for and cached next to it, ie tn__a.jpg.webp
+func (a *Album) serveThumbnail(w http.ResponseWriter, req *http.Request, config Config, filename, version string) {
+	if config.IsJpegRendition(filename) {
+		w.Header().Set("Content-Type", "image/jpeg")
+	}
+
+	// Converted videos are in thumbDir too
+	var formats []string
+	animated := false
+	if config.IsImageFile(filename) {
+		formats = config.ThumbnailFormats
+		if _, ok := config.MediaType(filename).(*GifType); ok && isAnimatedGif(filename) {
+			animated = true
+			formats = animationFormats(config)
+		}
+	}
+
+	if animated && config.GetAnimationFormat() == FORMAT_MP4 && req.URL.Query().Get(FORMAT_PARAM) == FORMAT_MP4 {
+		if a.serveEncoded(w, req, config, FORMAT_MP4, filename, version) {
+			return
+		}
+	} else if len(formats) > 0 {
+		w.Header().Add("Vary", "Accept")
+		for _, format := range acceptedFormats(req.Header.Get("Accept"), formats) {
+			if a.serveEncoded(w, req, config, format, filename, version) {
+				return
+			}
+		}
+	}
+	setEtag(w, version, "")
+	http.ServeFile(w, req, filename)
+}
+
+// Of the formats, only webp keeps an animation, an avif would just be the first frame
+func animationFormats(config Config) []string {
+	if config.GetAnimationFormat() == FORMAT_WEBP {
+		return []string{FORMAT_WEBP}
+	}
+	for _, format := range config.ThumbnailFormats {
+		if strings.ToLower(format) == FORMAT_WEBP {
+			return []string{FORMAT_WEBP}
+		}
+	}
+	return nil
+}
+
+// Serves filename encoded as format, false when it can't be
+func (a *Album) serveEncoded(w http.ResponseWriter, req *http.Request, config Config, format, filename, version string) bool {
+	if a.encoderFailed(format) {
+		return false
+	}
+	encoded := filename + "." + format
+	if err := a.encodeThumbnail(format, filename, encoded, config.GetThumbnailQuality()); err != nil {
+		a.logger.Printf("Error encoding %s as %s: %v\n", filename, format, err)
+		return false
+	}
+	setEtag(w, version, format)
+	w.Header().Del("Content-Type")
+	if format == FORMAT_MP4 {
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	http.ServeFile(w, req, encoded)
+	return true
+}
+
+// The same version is a different set of bytes in each format
+func setEtag(w http.ResponseWriter, version, format string) {
+	if version == "" {
+		return
+	}
+	if format != "" {
+		version += "-" + format
+	}
+	w.Header().Set("ETag", `"`+version+`"`)
+}
+
+// Encodes in as format to out unless out is already newer than in
+func (a *Album) encodeThumbnail(format, in, out string, quality int) error {
+	inStat, err := os.Stat(in)
+	if err != nil {
+		return err
+	}
+	if outStat, err := os.Stat(out); err == nil && !outStat.ModTime().Before(inStat.ModTime()) {
+		return nil
+	}
+
+	// Written under another name first so nothing is served half written
+	tmp, err := tempName(out)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if output, err := imageEncoders[format](in, tmp, quality).CombinedOutput(); err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			// The encoder isn't installed, don't try again until a restart
+			a.workingLock.Lock()
+			a.failedEncoders[format] = true
+			a.workingLock.Unlock()
+		}
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.Rename(tmp, out)
+}
+
+// An empty file in the directory of name, to be written and then renamed over it.  Every
+// request making name at the same time gets its own.
+func tempName(name string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	return tmp.Name(), tmp.Close()
+}
+
+func (a *Album) encoderFailed(format string) bool {
+	a.workingLock.Lock()
+	defer a.workingLock.Unlock()
+	return a.failedEncoders[format]
+}
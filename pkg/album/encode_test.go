@@ -0,0 +1,112 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAcceptedFormats(t *testing.T) {
+	var tests = []struct {
+		accept  string
+		formats []string
+		want    []string
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", []string{"avif", "webp"}, []string{"avif", "webp"}},
+		{"image/avif,image/webp,*/*", []string{"webp", "avif"}, []string{"webp", "avif"}},
+		{"image/webp,*/*", []string{"avif", "webp"}, []string{"webp"}},
+		{"image/avif;q=0, image/webp;q=0.5", []string{"AVIF", "webp"}, []string{"webp"}},
+		{"image/*,*/*", []string{"avif", "webp"}, nil},
+		{"image/webp", []string{"jxl", "webp"}, []string{"webp"}},
+		{"", []string{"webp"}, nil},
+	}
+	for _, test := range tests {
+		if got := acceptedFormats(test.accept, test.formats); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("acceptedFormats(%q, %v): expecting %v, was %v", test.accept, test.formats, test.want, got)
+		}
+	}
+}
+
+func TestThumbnailFormats(t *testing.T) {
+	encoders := imageEncoders
+	defer func() { imageEncoders = encoders }()
+	imageEncoders = map[string]func(in, out string, quality int) *exec.Cmd{
+		FORMAT_WEBP: func(in, out string, quality int) *exec.Cmd { return exec.Command("cp", in, out) },
+		FORMAT_AVIF: func(in, out string, quality int) *exec.Cmd { return exec.Command("no-such-avif-encoder", in, out) },
+	}
+
+	a := setupTestAlbum(t)
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.ThumbnailFormats = []string{FORMAT_AVIF, FORMAT_WEBP}
+	albumsConfig.Albums["test"] = albumConfig
+	albumsConfig.Albums["plain"] = AlbumConfig{AlbumTitle: "Plain", AlbumDir: "source", ThumbDir: "thumbs"}
+	a.albumsConfig = albumsConfig
+
+	var tests = []struct {
+		url         string
+		accept      string
+		wantType    string
+		wantVary    bool
+		wantEncoded string
+	}{
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg", "image/jpeg,*/*", "image/jpeg", true, ""},
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg", "image/avif,image/webp,*/*", "image/webp", true, "thumbs/tn__Bob_and_Jenny.jpg.webp"},
+		{"/test/thumbs/640x480_Bob_and_Jenny.jpg", "image/avif,image/webp,*/*", "image/webp", true, "thumbs/640x480_Bob_and_Jenny.jpg.webp"},
+		{"/test/thumbs/tn__Bob_and_Jenny.jpg", "image/avif", "image/jpeg", true, ""},
+		{"/plain/thumbs/tn__Bob_and_Jenny.jpg", "image/avif,image/webp,*/*", "image/jpeg", false, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		rec := serve(a, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expecting status 200, was %d", test.url, rec.Code)
+		}
+		if rec.Header().Get("Content-Type") != test.wantType {
+			t.Errorf("GET %s with %s: expecting %s, was %s", test.url, test.accept, test.wantType, rec.Header().Get("Content-Type"))
+		}
+		if (rec.Header().Get("Vary") == "Accept") != test.wantVary {
+			t.Errorf("GET %s: expecting Vary: Accept %v, was %q", test.url, test.wantVary, rec.Header().Get("Vary"))
+		}
+		if test.wantEncoded != "" {
+			if _, err := os.Stat(filepath.Join(a.appConfig.AlbumsDir, test.wantEncoded)); err != nil {
+				t.Errorf("GET %s: expecting %s to be cached: %v", test.url, test.wantEncoded, err)
+			}
+		}
+	}
+	if !a.encoderFailed(FORMAT_AVIF) || a.encoderFailed(FORMAT_WEBP) {
+		t.Errorf("Expecting only the missing avif encoder to be remembered, was %v", a.failedEncoders)
+	}
+}
+
+func TestConcurrentEncodes(t *testing.T) {
+	encoders := imageEncoders
+	defer func() { imageEncoders = encoders }()
+	imageEncoders = map[string]func(in, out string, quality int) *exec.Cmd{
+		FORMAT_WEBP: func(in, out string, quality int) *exec.Cmd { return exec.Command("cp", in, out) },
+	}
+
+	a := setupTestAlbum(t)
+	in := filepath.Join(a.appConfig.AlbumsDir, "source", "Bob_and_Jenny.jpg")
+	out := filepath.Join(a.appConfig.AlbumsDir, "thumbs", "tn__Bob_and_Jenny.jpg.webp")
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() { errs <- a.encodeThumbnail(FORMAT_WEBP, in, out, 85) }()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expecting requests for the same thumbnail not to get in each other's way, was %v", err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(out)); len(entries) != 1 {
+		t.Errorf("Expecting only %s to be left, was %v", out, entries)
+	}
+}
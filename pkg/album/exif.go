@@ -0,0 +1,345 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tags of the EXIF in jpegs and raw files
+const (
+	EXIF_IFD                   = 0x8769
+	EXIF_DATE_TIME_ORIGINAL    = 0x9003
+	EXIF_MAKER_NOTE            = 0x927c
+	EXIF_SUB_SEC_TIME_ORIGINAL = 0x9291
+
+	// In the maker note of an iPhone, the same for every photo of a burst
+	APPLE_BURST_UUID = 0x000b
+
+	EXIF_HEADER      = "Exif\x00\x00"
+	APPLE_MAKER_NOTE = "Apple iOS\x00"
+	EXIF_TIME_LAYOUT = "2006:01:02 15:04:05"
+
+	// Bound on the bytes of a single value
+	MAX_TAG_BYTES = 64 * 1024
+
+	// The photos of a directory are cached in thumbDir under this name
+	INFO_FILENAME = ".info.json"
+
+	// Hash of a photo that couldn't be decoded
+	NO_HASH = "-"
+)
+
+var (
+	xmpBurstId      = regexp.MustCompile(`BurstID(?:="|>)([^"<]+)`)
+	xmpBurstPrimary = regexp.MustCompile(`BurstPrimary(?:="|>)1`)
+)
+
+// What stacking, the duplicate finder and the grid need to know about a photo, kept until
+// its size or time changes.  Hash is the dHash in hex, "" until it's needed, and Width and
+// Height are 0 until they are.  Color and Placeholder are "" until its thumbnail is made.
+type photoInfo struct {
+	Size        int64     `json:"size"`
+	ModTime     int64     `json:"modTime"`
+	Taken       time.Time `json:"taken"`
+	BurstId     string    `json:"burstId,omitempty"`
+	BurstPick   bool      `json:"burstPick,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Color       string    `json:"color,omitempty"`
+	Placeholder string    `json:"placeholder,omitempty"`
+	// The version each of its thumbnails and sizes was made with, by filename
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+	// Where the video of a motion photo is, MotionLength is 0 until it's been looked for
+	MotionOffset int64 `json:"motionOffset,omitempty"`
+	MotionLength int64 `json:"motionLength,omitempty"`
+}
+
+// The photos of a directory by name
+type dirInfo map[string]*photoInfo
+
+// An info file that's missing or can't be read is an empty one, it's only a cache
+func loadDirInfo(filename string) dirInfo {
+	infos := make(dirInfo)
+	if contents, err := os.ReadFile(filename); err == nil {
+		json.Unmarshal(contents, &infos)
+	}
+	return infos
+}
+
+func (d dirInfo) save(filename string) error {
+	return saveJson(filename, d)
+}
+
+// Saves the photos names of infos into the .info.json at filename as it is now, as the
+// server or an album command may have saved it since infos was loaded.  What either found
+// of a photo is kept, unless it's changed in between.
+func (a *Album) mergeDirInfo(filename string, infos dirInfo, names []string) error {
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	saved := loadDirInfo(filename)
+	for _, name := range names {
+		info := infos[name]
+		if info == nil {
+			continue
+		}
+		if old := saved[name]; old != nil && old.Size == info.Size && old.ModTime == info.ModTime {
+			if info.Hash == "" {
+				info.Hash = old.Hash
+			}
+			if info.Width == 0 {
+				info.Width, info.Height = old.Width, old.Height
+			}
+			if info.Color == "" {
+				info.Color, info.Placeholder = old.Color, old.Placeholder
+			}
+			if info.Thumbnails == nil {
+				info.Thumbnails = old.Thumbnails
+			}
+			if info.MotionLength == 0 {
+				info.MotionOffset, info.MotionLength = old.MotionOffset, old.MotionLength
+			}
+		}
+		saved[name] = info
+	}
+	return saved.save(filename)
+}
+
+// Writes v to filename as JSON, two requests could be saving it at once so it's written
+// to a temporary file that's renamed over it
+func saveJson(filename string, v interface{}) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0775); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// The info of the photo name at filename, read again when it's new or has changed since it
+// was cached.  Reports whether it was, nil when the photo can't be found.
+func (d dirInfo) lookup(filename, name string) (*photoInfo, bool) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, false
+	}
+	info := d[name]
+	if info != nil && info.Size == stat.Size() && info.ModTime == stat.ModTime().UnixNano() {
+		return info, false
+	}
+	fresh := readPhotoInfo(filename)
+	fresh.Size, fresh.ModTime = stat.Size(), stat.ModTime().UnixNano()
+	d[name] = &fresh
+	return &fresh, true
+}
+
+// When the photo at filename was taken and the burst it's part of, from the EXIF of a jpeg
+// or raw file, an iPhone's maker note, and the XMP a Pixel writes
+func readPhotoInfo(filename string) photoInfo {
+	var info photoInfo
+	in, err := os.Open(filename)
+	if err != nil {
+		return info
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return info
+	}
+
+	if tiff, err := exifTiff(in, stat.Size()); err == nil {
+		info.Taken, info.BurstId, _ = readExif(tiff)
+	}
+	if xmp, err := jpegSegment(bufio.NewReader(io.NewSectionReader(in, 0, stat.Size())), XMP_NAMESPACE); err == nil {
+		if match := xmpBurstId.FindSubmatch(xmp); match != nil {
+			info.BurstId = string(match[1])
+		}
+		info.BurstPick = xmpBurstPrimary.Match(xmp)
+	}
+	return info
+}
+
+// The TIFF structure the EXIF is in, inside the APP1 segment of a jpeg or the whole of a raw file
+func exifTiff(in io.ReaderAt, size int64) (io.ReaderAt, error) {
+	header := make([]byte, 2)
+	if _, err := in.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	switch string(header) {
+	case "\xff\xd8":
+		segment, err := jpegSegment(bufio.NewReader(io.NewSectionReader(in, 0, size)), EXIF_HEADER)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(segment), nil
+	case "II", "MM":
+		return in, nil
+	}
+	return nil, errors.New("no EXIF")
+}
+
+// DateTimeOriginal, with its fraction of a second, and the burst of an iPhone photo.  The
+// time has no zone, only how far apart photos were is used.
+func readExif(r io.ReaderAt) (time.Time, string, error) {
+	var taken time.Time
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return taken, "", err
+	}
+	order := tiffOrder(header)
+	if order == nil {
+		return taken, "", errors.New("not TIFF")
+	}
+	tags, _, err := readIfd(r, order, int64(order.Uint32(header[4:])))
+	if err != nil {
+		return taken, "", err
+	}
+	if len(tags[EXIF_IFD]) == 0 {
+		return taken, "", errors.New("no EXIF IFD")
+	}
+	values, err := ifdValues(r, order, tags[EXIF_IFD][0], EXIF_DATE_TIME_ORIGINAL, EXIF_SUB_SEC_TIME_ORIGINAL, EXIF_MAKER_NOTE)
+	if err != nil {
+		return taken, "", err
+	}
+
+	if taken, err = time.Parse(EXIF_TIME_LAYOUT, tiffString(values[EXIF_DATE_TIME_ORIGINAL])); err == nil {
+		if fraction, err := strconv.ParseFloat("0."+tiffString(values[EXIF_SUB_SEC_TIME_ORIGINAL]), 64); err == nil {
+			taken = taken.Add(time.Duration(fraction * float64(time.Second)))
+		}
+	}
+	burstId := ""
+	if note := values[EXIF_MAKER_NOTE]; note != nil {
+		burstId = appleBurstUuid(note)
+	}
+	return taken, burstId, nil
+}
+
+// The burst in an iPhone's maker note, which is an IFD with offsets from the start of the note
+func appleBurstUuid(note *io.SectionReader) string {
+	header := make([]byte, 16)
+	if _, err := note.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, []byte(APPLE_MAKER_NOTE)) {
+		return ""
+	}
+	order := tiffOrder(header[12:])
+	if order == nil {
+		return ""
+	}
+	values, err := ifdValues(note, order, 14, APPLE_BURST_UUID)
+	if err != nil {
+		return ""
+	}
+	return tiffString(values[APPLE_BURST_UUID])
+}
+
+func tiffOrder(header []byte) binary.ByteOrder {
+	switch string(header[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// Where the value of each of tags in the IFD at offset is, whatever its type
+func ifdValues(r io.ReaderAt, order binary.ByteOrder, offset int64, tags ...uint16) (map[uint16]*io.SectionReader, error) {
+	count := make([]byte, 2)
+	if _, err := r.ReadAt(count, offset); err != nil {
+		return nil, err
+	}
+	n := int(order.Uint16(count))
+	if n > MAX_IFD_ENTRIES {
+		return nil, fmt.Errorf("%d entries in IFD at %d", n, offset)
+	}
+	entries := make([]byte, n*12)
+	if _, err := r.ReadAt(entries, offset+2); err != nil {
+		return nil, err
+	}
+
+	values := make(map[uint16]*io.SectionReader)
+	for i := 0; i < n; i++ {
+		entry := entries[i*12 : i*12+12]
+		tag := order.Uint16(entry)
+		wanted := false
+		for _, t := range tags {
+			wanted = wanted || t == tag
+		}
+		if !wanted {
+			continue
+		}
+		size := int64(order.Uint32(entry[4:])) * tiffTypeSize(order.Uint16(entry[2:]))
+		if size <= 0 || size > MAX_TAG_BYTES {
+			continue
+		}
+		at := offset + 2 + int64(i*12) + 8
+		if size > 4 {
+			at = int64(order.Uint32(entry[8:]))
+		}
+		values[tag] = io.NewSectionReader(r, at, size)
+	}
+	return values, nil
+}
+
+// Bytes in each value of a TIFF type
+func tiffTypeSize(kind uint16) int64 {
+	switch kind {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11, 13:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return 0
+}
+
+// An ASCII value up to its NUL, "" when there isn't one
+func tiffString(value *io.SectionReader) string {
+	if value == nil {
+		return ""
+	}
+	contents := make([]byte, value.Size())
+	if _, err := value.ReadAt(contents, 0); err != nil {
+		return ""
+	}
+	if i := bytes.IndexByte(contents, 0); i >= 0 {
+		contents = contents[:i]
+	}
+	return strings.TrimSpace(string(contents))
+}
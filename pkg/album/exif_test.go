@@ -0,0 +1,174 @@
+package album
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The TIFF structure of EXIF with a DateTimeOriginal, its SubSecTimeOriginal and, when
+// burst isn't "", an iPhone maker note with it as the BurstUUID
+func makeExif(t testing.TB, order binary.ByteOrder, taken, subSec, burst string) []byte {
+	var note bytes.Buffer
+	if burst != "" {
+		note.WriteString(APPLE_MAKER_NOTE + "\x00\x01MM")
+		for _, value := range []interface{}{uint16(1), uint16(APPLE_BURST_UUID), uint16(2), uint32(len(burst) + 1), uint32(32), uint32(0)} {
+			binary.Write(&note, binary.BigEndian, value)
+		}
+		note.WriteString(burst + "\x00")
+	}
+
+	const exifIfd, data = 26, 68
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	write := func(v ...interface{}) {
+		for _, value := range v {
+			binary.Write(&buf, order, value)
+		}
+	}
+	write(uint16(42), uint32(8))
+	write(uint16(1), uint16(EXIF_IFD), uint16(4), uint32(1), uint32(exifIfd), uint32(0))
+
+	write(uint16(3))
+	write(uint16(EXIF_DATE_TIME_ORIGINAL), uint16(2), uint32(len(taken)+1), uint32(data))
+	write(uint16(EXIF_SUB_SEC_TIME_ORIGINAL), uint16(2), uint32(len(subSec)+1))
+	buf.WriteString((subSec + "\x00\x00\x00\x00")[:4])
+	write(uint16(EXIF_MAKER_NOTE), uint16(7), uint32(note.Len()), uint32(data+len(taken)+1))
+	write(uint32(0))
+
+	if buf.Len() != data {
+		t.Fatalf("Expecting the values at %d, was %d", data, buf.Len())
+	}
+	buf.WriteString(taken + "\x00")
+	buf.Write(note.Bytes())
+	return buf.Bytes()
+}
+
+// A jpeg of img with tiff as its EXIF and xmp, when they aren't empty
+func makeExifJpeg(t testing.TB, img image.Image, tiff []byte, xmp string) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(encoded.Bytes()[:2])
+	segment := func(contents string) {
+		buf.Write([]byte{0xff, 0xe1})
+		binary.Write(&buf, binary.BigEndian, uint16(2+len(contents)))
+		buf.WriteString(contents)
+	}
+	if tiff != nil {
+		segment(EXIF_HEADER + string(tiff))
+	}
+	if xmp != "" {
+		segment(XMP_NAMESPACE + xmp)
+	}
+	buf.Write(encoded.Bytes()[2:])
+	return buf.Bytes()
+}
+
+func TestReadPhotoInfo(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 12))
+	files := map[string][]byte{
+		"plain.jpg":  makeExifJpeg(t, img, nil, ""),
+		"iphone.jpg": makeExifJpeg(t, img, makeExif(t, binary.BigEndian, "2021:07:04 10:30:15", "25", "2A1F-BURST"), ""),
+		"pixel.jpg":  makeExifJpeg(t, img, makeExif(t, binary.LittleEndian, "2021:07:04 10:30:16", "5", ""), `<rdf:Description GCamera:BurstID="a8c0" GCamera:BurstPrimary="1"/>`),
+		"raw.dng":    makeExif(t, binary.LittleEndian, "2021:07:04 10:30:17", "", ""),
+		"bad.jpg":    makeExifJpeg(t, img, makeExif(t, binary.BigEndian, "not a time", "", ""), ""),
+		"junk.jpg":   []byte("not a photo"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	at := func(value string) time.Time {
+		taken, err := time.Parse("2006-01-02 15:04:05.999", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return taken
+	}
+	var tests = []struct {
+		name      string
+		wantTaken time.Time
+		wantBurst string
+		wantPick  bool
+	}{
+		{"plain.jpg", time.Time{}, "", false},
+		{"iphone.jpg", at("2021-07-04 10:30:15.25"), "2A1F-BURST", false},
+		{"pixel.jpg", at("2021-07-04 10:30:16.5"), "a8c0", true},
+		{"raw.dng", at("2021-07-04 10:30:17"), "", false},
+		{"bad.jpg", time.Time{}, "", false},
+		{"junk.jpg", time.Time{}, "", false},
+		{"missing.jpg", time.Time{}, "", false},
+	}
+	for _, test := range tests {
+		info := readPhotoInfo(filepath.Join(dir, test.name))
+		if !info.Taken.Equal(test.wantTaken) || info.BurstId != test.wantBurst || info.BurstPick != test.wantPick {
+			t.Errorf("readPhotoInfo(%s): expecting %v %q %v, was %v %q %v", test.name, test.wantTaken, test.wantBurst, test.wantPick, info.Taken, info.BurstId, info.BurstPick)
+		}
+	}
+}
+
+func TestDirInfo(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "2020", INFO_FILENAME)
+	if infos := loadDirInfo(filename); len(infos) != 0 {
+		t.Errorf("Expecting a missing file to be empty, was %v", infos)
+	}
+	infos := dirInfo{"a.jpg": {Size: 10, ModTime: 20, BurstId: "b", Hash: "00ff00ff00ff00ff", Thumbnails: map[string]string{"tn__a.jpg": "0123456789abcdef"}}}
+	if err := infos.save(filename); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadDirInfo(filename); loaded["a.jpg"] == nil || !reflect.DeepEqual(*loaded["a.jpg"], *infos["a.jpg"]) {
+		t.Errorf("Expecting %v back, was %v", infos, loaded)
+	}
+	os.WriteFile(filename, []byte("{not json"), 0664)
+	if infos := loadDirInfo(filename); len(infos) != 0 {
+		t.Errorf("Expecting a broken file to be empty, was %v", infos)
+	}
+}
+
+func TestMergeDirInfo(t *testing.T) {
+	a := setupTestAlbum(t)
+	filename := filepath.Join(t.TempDir(), INFO_FILENAME)
+	loaded := dirInfo{
+		"a.jpg": {Size: 10, ModTime: 20, Hash: "00ff00ff00ff00ff"},
+		"b.jpg": {Size: 10, ModTime: 20, Hash: "ff00ff00ff00ff00"},
+	}
+
+	// Saved by another request since
+	saved := dirInfo{
+		"a.jpg": {Size: 10, ModTime: 20, Color: "#102030", Placeholder: "data:x"},
+		"b.jpg": {Size: 11, ModTime: 30, Color: "#102030"},
+		"c.jpg": {Size: 10, ModTime: 20, Hash: "0000000000000000"},
+	}
+	if err := saved.save(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.mergeDirInfo(filename, loaded, []string{"a.jpg", "b.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	merged := loadDirInfo(filename)
+	if info := merged["a.jpg"]; info == nil || info.Hash != "00ff00ff00ff00ff" || info.Color != "#102030" || info.Placeholder != "data:x" {
+		t.Errorf("Expecting what both found of a.jpg, was %+v", info)
+	}
+	if info := merged["b.jpg"]; info == nil || info.Size != 10 || info.Color != "" {
+		t.Errorf("Expecting b.jpg as it was loaded, was %+v", info)
+	}
+	if merged["c.jpg"] == nil {
+		t.Error("Expecting photos that weren't saved to be kept")
+	}
+}
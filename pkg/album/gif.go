@@ -0,0 +1,218 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	GIF_ANIMATED = "animated"
+	GIF_STATIC   = "static"
+)
+
+// GIFs are resized a frame at a time so they stay animated
+type GifType struct {
+	ImageType
+}
+
+func (g *GifType) Thumbnail(source, thumbnail string, opts ThumbnailOptions) error {
+	if opts.Static || !isAnimatedGif(source) {
+		return g.ImageType.Thumbnail(source, thumbnail, opts)
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	anim, err := gif.DecodeAll(in)
+	if err != nil {
+		return err
+	}
+	width := opts.Width
+	if opts.NoUpscale && width > anim.Config.Width && anim.Config.Width > 0 {
+		width = anim.Config.Width
+	}
+
+	out, err := os.Create(thumbnail)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(out, resizeGif(anim, width)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Scales every frame, and where it sits, by the same amount.  The delays, disposal and
+// palettes stay as they were.
+func resizeGif(anim *gif.GIF, width int) *gif.GIF {
+	w, h := anim.Config.Width, anim.Config.Height
+	if w <= 0 || h <= 0 {
+		var bounds image.Rectangle
+		for _, frame := range anim.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+		w, h = bounds.Max.X, bounds.Max.Y
+	}
+	height := h * width / w
+	if height < 1 {
+		height = 1
+	}
+
+	resized := *anim
+	resized.Config.Width, resized.Config.Height = width, height
+	resized.Image = make([]*image.Paletted, len(anim.Image))
+	for i, frame := range anim.Image {
+		b := frame.Bounds()
+		var r image.Rectangle
+		r.Min.X, r.Max.X = scaleSpan(b.Min.X, b.Max.X, w, width)
+		r.Min.Y, r.Max.Y = scaleSpan(b.Min.Y, b.Max.Y, h, height)
+
+		// Blending with a transparent pixel would let the frame before show through at the edges
+		filter := imaging.Box
+		if hasTransparency(frame.Palette) {
+			filter = imaging.NearestNeighbor
+		}
+		scaled := imaging.Resize(frame, r.Dx(), r.Dy(), filter)
+		dst := image.NewPaletted(r, frame.Palette)
+		draw.Draw(dst, r, scaled, image.Point{}, draw.Src)
+		resized.Image[i] = dst
+	}
+	return &resized
+}
+
+// Where lo to hi out of from ends up out of to, at least a pixel wide
+func scaleSpan(lo, hi, from, to int) (int, int) {
+	lo, hi = lo*to/from, hi*to/from
+	if hi > to {
+		hi = to
+	}
+	if lo >= hi {
+		lo = hi - 1
+	}
+	if lo < 0 {
+		lo, hi = 0, 1
+	}
+	return lo, hi
+}
+
+func hasTransparency(palette color.Palette) bool {
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a < 0xffff {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the GIF at filename has more than one frame, found by skipping over its blocks
+// rather than decoding them
+func isAnimatedGif(filename string) bool {
+	in, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte("GIF8")) {
+		return false
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := r.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return false
+		}
+	}
+
+	frames := 0
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch block {
+		case 0x21:
+			// Extension label then its data
+			if _, err := r.ReadByte(); err != nil || !skipSubBlocks(r) {
+				return false
+			}
+		case 0x2c:
+			frames++
+			if frames > 1 {
+				return true
+			}
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return false
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := r.Discard(3 << (descriptor[8]&0x07 + 1)); err != nil {
+					return false
+				}
+			}
+			// LZW minimum code size then the image data
+			if _, err := r.ReadByte(); err != nil || !skipSubBlocks(r) {
+				return false
+			}
+		default:
+			// The trailer, or something that isn't a GIF
+			return false
+		}
+	}
+}
+
+func skipSubBlocks(r *bufio.Reader) bool {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if size == 0 {
+			return true
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return false
+		}
+	}
+}
+
+// With animationFormat mp4, link to the thumbnail or size variant of name at link as an mp4
+// when name is an animated GIF, otherwise "".  The modern theme shows it in a <video>.
+func (t TemplateSource) AnimationUrl(name, link string) string {
+	if t.Current.GetAnimationFormat() != FORMAT_MP4 || !strings.HasPrefix(link, t.ThumbsRootFor(t.BasePath)+"/") {
+		return ""
+	}
+	if t.Current.GetGifThumbnails() == GIF_STATIC && strings.HasPrefix(path.Base(strings.SplitN(link, "?", 2)[0]), "tn__") {
+		return ""
+	}
+	if _, ok := t.Current.MediaType(name).(*GifType); !ok || !isAnimatedGif(filepath.Join(t.baseDir(), t.currentDir(), name)) {
+		return ""
+	}
+	separator := "?"
+	if strings.Contains(link, "?") {
+		separator = "&"
+	}
+	return link + separator + FORMAT_PARAM + "=" + FORMAT_MP4
+}
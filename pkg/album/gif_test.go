@@ -0,0 +1,194 @@
+package album
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Three frames on a 40x30 canvas, the second only covering part of it
+func makeGif(t testing.TB, frames int) []byte {
+	palette := color.Palette{color.Transparent, color.White, color.Black}
+	anim := &gif.GIF{Config: image.Config{ColorModel: palette, Width: 40, Height: 30}}
+	bounds := []image.Rectangle{image.Rect(0, 0, 40, 30), image.Rect(10, 10, 30, 20), image.Rect(0, 0, 40, 30)}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(bounds[i], palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(1 + i%2)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeGif(t *testing.T) {
+	anim, err := gif.DecodeAll(bytes.NewReader(makeGif(t, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resized := resizeGif(anim, 20)
+	if resized.Config.Width != 20 || resized.Config.Height != 15 || len(resized.Image) != 3 {
+		t.Fatalf("Expecting 3 frames of 20x15, was %d of %dx%d", len(resized.Image), resized.Config.Width, resized.Config.Height)
+	}
+	if !reflect.DeepEqual(resized.Delay, []int{10, 20, 30}) || !reflect.DeepEqual(resized.Disposal, anim.Disposal) {
+		t.Errorf("Expecting the timing and disposal to stay, was %v %v", resized.Delay, resized.Disposal)
+	}
+	if resized.Image[1].Bounds() != image.Rect(5, 5, 15, 10) {
+		t.Errorf("Expecting the second frame to move with the canvas, was %v", resized.Image[1].Bounds())
+	}
+	if resized.Image[1].ColorIndexAt(5, 5) != 2 {
+		t.Errorf("Expecting the frame's own colors, was %d", resized.Image[1].ColorIndexAt(5, 5))
+	}
+
+	var spans = []struct {
+		lo, hi, from, to int
+		wantLo, wantHi   int
+	}{
+		{0, 40, 40, 20, 0, 20},
+		{10, 11, 40, 20, 4, 5},
+		{39, 40, 40, 2, 1, 2},
+		{0, 1, 400, 2, 0, 1},
+	}
+	for _, span := range spans {
+		if lo, hi := scaleSpan(span.lo, span.hi, span.from, span.to); lo != span.wantLo || hi != span.wantHi {
+			t.Errorf("scaleSpan(%d, %d, %d, %d): expecting %d-%d, was %d-%d", span.lo, span.hi, span.from, span.to, span.wantLo, span.wantHi, lo, hi)
+		}
+	}
+}
+
+func TestIsAnimatedGif(t *testing.T) {
+	dir := t.TempDir()
+	animated := makeGif(t, 3)
+	files := map[string][]byte{
+		"animated.gif":  animated,
+		"still.gif":     makeGif(t, 1),
+		"truncated.gif": animated[:40],
+		"jpeg.gif":      {0xff, 0xd8, 0xff, 0xe0},
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name string
+		want bool
+	}{
+		{"animated.gif", true},
+		{"still.gif", false},
+		{"truncated.gif", false},
+		{"jpeg.gif", false},
+		{"missing.gif", false},
+	}
+	for _, test := range tests {
+		if got := isAnimatedGif(filepath.Join(dir, test.name)); got != test.want {
+			t.Errorf("isAnimatedGif(%s): expecting %v, was %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestAnimatedGifs(t *testing.T) {
+	encoders := imageEncoders
+	defer func() { imageEncoders = encoders }()
+	imageEncoders = map[string]func(in, out string, quality int) *exec.Cmd{
+		FORMAT_WEBP: func(in, out string, quality int) *exec.Cmd { return exec.Command("cp", in, out) },
+		FORMAT_AVIF: func(in, out string, quality int) *exec.Cmd { return exec.Command("cp", in, out) },
+		FORMAT_MP4:  func(in, out string, quality int) *exec.Cmd { return exec.Command("cp", in, out) },
+	}
+
+	var tests = []struct {
+		name       string
+		config     Config
+		url        string
+		accept     string
+		wantFrames int
+		wantWidth  int
+		wantType   string
+	}{
+		{"thumbnail", Config{}, "/test/thumbs/tn__anim.gif", "", 3, 50, "image/gif"},
+		{"size", Config{}, "/test/thumbs/640x480_anim.gif", "", 3, 640, "image/gif"},
+		{"final", Config{AllowFinalResize: true}, "/test/thumbs/anim.gif?w=480", "", 3, 40, "image/gif"},
+		{"static thumbnail", Config{GifThumbnails: GIF_STATIC}, "/test/thumbs/tn__anim.gif", "", 1, 50, "image/gif"},
+		{"static size", Config{GifThumbnails: GIF_STATIC}, "/test/thumbs/640x480_anim.gif", "", 3, 640, "image/gif"},
+		{"no avif", Config{ThumbnailFormats: []string{FORMAT_AVIF}}, "/test/thumbs/tn__anim.gif", "image/avif,image/webp", 3, 50, "image/gif"},
+		{"webp", Config{ThumbnailFormats: []string{FORMAT_AVIF, FORMAT_WEBP}}, "/test/thumbs/tn__anim.gif", "image/avif,image/webp", 3, 50, "image/webp"},
+		{"animation webp", Config{AnimationFormat: FORMAT_WEBP}, "/test/thumbs/tn__anim.gif", "image/webp", 3, 50, "image/webp"},
+		{"mp4", Config{AnimationFormat: FORMAT_MP4}, "/test/thumbs/tn__anim.gif?format=mp4", "", 3, 50, "video/mp4"},
+		{"mp4 not on", Config{}, "/test/thumbs/tn__anim.gif?format=mp4", "", 3, 50, "image/gif"},
+	}
+	for _, test := range tests {
+		a := setupTestAlbum(t)
+		if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source", "anim.gif"), makeGif(t, 3), 0664); err != nil {
+			t.Fatal(err)
+		}
+		albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		albumConfig := albumsConfig.Albums["test"]
+		albumConfig.Config = test.config
+		albumsConfig.Albums["test"] = albumConfig
+		a.albumsConfig = albumsConfig
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		rec := serve(a, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != test.wantType {
+			t.Errorf("%s: expecting %s, was %d %v", test.name, test.wantType, rec.Code, rec.Header())
+		}
+		anim, err := gif.DecodeAll(rec.Body)
+		if err != nil {
+			t.Errorf("%s: expecting a gif: %v", test.name, err)
+			continue
+		}
+		if len(anim.Image) != test.wantFrames || anim.Config.Width != test.wantWidth {
+			t.Errorf("%s: expecting %d frames %d wide, was %d %d wide", test.name, test.wantFrames, test.wantWidth, len(anim.Image), anim.Config.Width)
+		}
+	}
+}
+
+func TestAnimationUrl(t *testing.T) {
+	a := setupTestAlbum(t)
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source", "anim.gif"), makeGif(t, 3), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source", "still.gif"), makeGif(t, 1), 0664); err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.AnimationFormat = FORMAT_MP4
+	albumsConfig.Albums["test"] = albumConfig
+	a.albumsConfig = albumsConfig
+
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if !strings.Contains(page, `<video src="/test/thumbs/tn__anim.gif?v=`) || !strings.Contains(page, `&amp;format=mp4" autoplay muted loop playsinline>`) {
+		t.Errorf("Expecting a video of the animated gif, was %s", page)
+	}
+	if strings.Contains(page, "tn__still.gif?format") || strings.Contains(page, "tn__Bob_and_Jenny.jpg?format") {
+		t.Errorf("Expecting only the animated gif in a video, was %s", page)
+	}
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/640x480_anim.gif", nil)).Body.String()
+	if !strings.Contains(page, `<video src="/test/thumbs/640x480_anim.gif?format=mp4"`) {
+		t.Errorf("Expecting a video on the single page, was %s", page)
+	}
+}
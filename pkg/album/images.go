@@ -0,0 +1,91 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// Extensions of the images browsers can show as they are, thumbnails of anything else are jpegs
+var webImageTypes = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".png":  true,
+}
+
+// Decodes a HEIC or HEIF image to a jpeg, imaging can't read them
+var heifDecoder = func(in, out string) *exec.Cmd {
+	return exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", in, "-frames:v", "1", "-q:v", "2", "-f", "image2", "-c:v", "mjpeg", out)
+}
+
+// Whether the thumbnails of filename are jpegs whatever its extension says
+func IsJpegRendition(filename string) bool {
+	return Config{}.IsJpegRendition(filename)
+}
+
+func (c Config) IsJpegRendition(filename string) bool {
+	return c.IsImageFile(filename) && !webImageTypes[strings.ToLower(filepath.Ext(filename))]
+}
+
+// Where the jpeg a HEIC original is decoded to is cached in thumbDir
+func heifRendition(pathInfo string) string {
+	return pathInfo + ".jpg"
+}
+
+// Decodes a HEIC original at source through ffmpeg into rendition and opens that
+func decodeHeif(source, rendition string) (image.Image, error) {
+	sourceStat, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := os.Stat(rendition); err != nil || stat.ModTime().Before(sourceStat.ModTime()) {
+		if err := os.MkdirAll(filepath.Dir(rendition), 0775); err != nil {
+			return nil, err
+		}
+		tmp, err := tempName(rendition)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp)
+		if output, err := heifDecoder(source, tmp).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v %s", source, err, strings.TrimSpace(string(output)))
+		}
+		if err := os.Rename(tmp, rendition); err != nil {
+			return nil, err
+		}
+	}
+	// ffmpeg has already turned it the right way up
+	return imaging.Open(rendition)
+}
+
+// Saves a thumbnail of filename as a jpeg when browsers can't show its own format
+func saveThumbnail(img image.Image, filename string, quality int) error {
+	if webImageTypes[strings.ToLower(filepath.Ext(filename))] {
+		return imaging.Save(img, filename, imaging.JPEGQuality(quality))
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := imaging.Encode(out, img, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
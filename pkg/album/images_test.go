@@ -0,0 +1,105 @@
+package album
+
+import (
+	"encoding/base64"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// A 1x1 lossless webp, x/image can only decode them
+const testWebp = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestImageTypes(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for _, name := range []string{"shot.png", "scan.tif", "old.bmp"} {
+		if err := imaging.Save(img, filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	webp, _ := base64.StdEncoding.DecodeString(testWebp)
+	if err := os.WriteFile(filepath.Join(source, "pic.webp"), webp, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "phone.heic"), []byte("not really a heic"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := heifDecoder
+	defer func() { heifDecoder = decoder }()
+	heifDecoder = func(in, out string) *exec.Cmd {
+		return exec.Command("cp", filepath.Join(source, "Bob_and_Jenny.jpg"), out)
+	}
+
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	for _, name := range []string{"tn__shot.png", "tn__scan.tif", "tn__old.bmp", "tn__pic.webp", "tn__phone.heic"} {
+		if !strings.Contains(page, "/test/thumbs/"+name+"?v=") {
+			t.Errorf("Expecting %s in the grid, was %s", name, page)
+		}
+	}
+
+	var tests = []struct {
+		url         string
+		wantStatus  int
+		contentType string
+	}{
+		{"/test/thumbs/tn__shot.png", http.StatusOK, "image/png"},
+		{"/test/thumbs/tn__scan.tif", http.StatusOK, "image/jpeg"},
+		{"/test/thumbs/tn__old.bmp", http.StatusOK, "image/jpeg"},
+		{"/test/thumbs/tn__pic.webp", http.StatusOK, "image/jpeg"},
+		{"/test/thumbs/tn__phone.heic", http.StatusOK, "image/jpeg"},
+		{"/test/thumbs/640x480_phone.heic", http.StatusOK, "image/jpeg"},
+	}
+	for _, test := range tests {
+		rec := serve(a, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if rec.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("GET %s: expecting %s, was %s", test.url, test.contentType, rec.Header().Get("Content-Type"))
+		}
+		if _, err := imaging.Decode(rec.Body); err != nil {
+			t.Errorf("GET %s: expecting an image: %v", test.url, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(a.appConfig.AlbumsDir, "thumbs", "phone.heic.jpg")); err != nil {
+		t.Errorf("Expecting the decoded heic to be cached: %v", err)
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/test/albums/phone.heic", nil)); rec.Code != http.StatusOK || rec.Body.String() != "not really a heic" {
+		t.Errorf("Expecting the original heic, was %d", rec.Code)
+	}
+}
+
+func TestThumbnailSource(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	if err := imaging.Save(image.NewRGBA(image.Rect(0, 0, 8, 8)), filepath.Join(source, "shot.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		pathInfo string
+		want     string
+	}{
+		{"tn__shot.png", "shot.png"},
+		{"640x480_shot.png", "shot.png"},
+		{"tn__movie.png", "movie.avi"},
+		{"tn__Bob_and_Jenny.jpg", "Bob_and_Jenny.jpg"},
+	}
+	for _, test := range tests {
+		got, err := thumbnailSource(Config{}, source, test.pathInfo, false)
+		if err != nil || got != filepath.Join(source, test.want) {
+			t.Errorf("thumbnailSource(%s): expecting %s, was %s %v", test.pathInfo, test.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// XMP is kept in an APP1 segment that starts with this
+	XMP_NAMESPACE = "http://ns.adobe.com/xap/1.0/\x00"
+
+	// Bound on the segments read looking for it
+	MAX_JPEG_SEGMENTS = 64
+
+	// MotionLength of a photo that's been looked at and has no video in it
+	NO_MOTION = -1
+)
+
+var (
+	microVideoOffset = regexp.MustCompile(`MicroVideoOffset(?:="|>)(\d+)`)
+	containerItem    = regexp.MustCompile(`<Container:Item\s[^>]*>`)
+	itemLength       = regexp.MustCompile(`Item:Length="(\d+)"`)
+)
+
+// An image with a video of the same name, ie IMG_1234.HEIC and IMG_1234.MOV from an iPhone,
+// is a live photo shown as the image, Lives has the video for the name of the image.  A
+// Pixel motion photo has its video inside the jpeg, Lives has the name of the image itself.
+func (a *Album) pairLives(t *TemplateSource) {
+	videos := make(map[string]string)
+	for _, file := range t.Files {
+		if t.Current.IsVideoFile(file.Name()) {
+			videos[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = file.Name()
+		}
+	}
+
+	paired := make(map[string]bool)
+	var jpegs []string
+	for _, file := range t.Files {
+		name := file.Name()
+		if !t.Current.IsImageFile(name) || videos[strings.TrimSuffix(name, path.Ext(name))] != "" {
+			continue
+		}
+		if mediaType := t.Current.MediaType(name); mediaType != nil && mediaType.Name() == "jpeg" {
+			jpegs = append(jpegs, name)
+		}
+	}
+	motions := a.motionPhotos(t, jpegs)
+	for _, file := range t.Files {
+		name := file.Name()
+		if !t.Current.IsImageFile(name) {
+			continue
+		}
+		live := videos[strings.TrimSuffix(name, path.Ext(name))]
+		if live != "" {
+			paired[live] = true
+		} else if motions[name] {
+			live = name
+		}
+		if live != "" {
+			if t.Lives == nil {
+				t.Lives = make(map[string]string)
+			}
+			t.Lives[name] = live
+		}
+	}
+
+	var files []os.DirEntry
+	for _, file := range t.Files {
+		if !paired[file.Name()] {
+			files = append(files, file)
+		}
+	}
+	t.Files = files
+}
+
+// Which of the jpegs in the current directory are motion photos.  Every page of the directory
+// asks, so whether each has a video and where is cached in its .info.json, and only the
+// ones that are new or changed since are read.
+func (a *Album) motionPhotos(t *TemplateSource, names []string) map[string]bool {
+	motions := make(map[string]bool)
+	if len(names) == 0 {
+		return motions
+	}
+	dir := t.currentDir()
+	infoFilename := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir, dir, INFO_FILENAME)
+	a.infoLock.Lock()
+	infos := loadDirInfo(infoFilename)
+	a.infoLock.Unlock()
+
+	var changed []string
+	for _, name := range names {
+		source := filepath.Join(t.baseDir(), dir, name)
+		info, fresh := infos.lookup(source, name)
+		if info == nil {
+			continue
+		}
+		if info.MotionLength == 0 {
+			info.MotionLength = NO_MOTION
+			if offset, length, err := motionClip(source); err == nil {
+				info.MotionOffset, info.MotionLength = offset, length
+			}
+			fresh = true
+		}
+		if fresh {
+			changed = append(changed, name)
+		}
+		motions[name] = info.MotionLength > 0
+	}
+	if len(changed) > 0 {
+		if err := a.mergeDirInfo(infoFilename, infos, changed); err != nil {
+			a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+		}
+	}
+	return motions
+}
+
+// Link to the video that goes with name in the current directory, "" if it isn't a live photo
+func (t TemplateSource) LiveUrl(name string) string {
+	live := t.Lives[name]
+	switch {
+	case live == "":
+		return ""
+	case live == name:
+		return t.versioned(t.ThumbsRootFor(t.BasePath)+"/"+path.Join(t.currentDir(), motionRendition(name)), name)
+	case t.Current.CanHtmlPlay(live):
+		return t.AlbumsRootFor(t.BasePath) + "/" + path.Join(t.currentDir(), live)
+	}
+	return t.ThumbsRootFor(t.BasePath) + "/" + path.Join(t.currentDir(), ChangeExtension(live, "webm"))
+}
+
+// Where the video taken out of a motion photo is cached in thumbDir
+func motionRendition(pathInfo string) string {
+	return pathInfo + ".mp4"
+}
+
+// The image pathInfo in thumbDir is the video of, "" when it isn't one
+func motionSource(config Config, pathInfo string) string {
+	source := strings.TrimSuffix(pathInfo, ".mp4")
+	if source == pathInfo || !config.IsImageFile(source) || strings.HasPrefix(path.Base(source), "tn__") {
+		return ""
+	}
+	return source
+}
+
+// Copies the video out of the motion photo at source to clip unless clip is already newer
+func extractMotionClip(source, clip string) error {
+	sourceStat, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(clip); err == nil && !stat.ModTime().Before(sourceStat.ModTime()) {
+		return nil
+	}
+	offset, length, err := motionClip(source)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(clip), 0775); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(clip), filepath.Base(clip)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, io.NewSectionReader(in, offset, length)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), clip)
+}
+
+// Where the mp4 at the end of a motion photo starts and how long it is, the XMP says how far
+// from the end it is as either a MicroVideoOffset or the Length of the MotionPhoto item
+func motionClip(filename string) (int64, int64, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	xmp, err := jpegSegment(bufio.NewReader(in), XMP_NAMESPACE)
+	if err != nil {
+		return 0, 0, err
+	}
+	var length int64
+	if match := microVideoOffset.FindSubmatch(xmp); match != nil {
+		length, _ = strconv.ParseInt(string(match[1]), 10, 64)
+	}
+	for _, item := range containerItem.FindAll(xmp, -1) {
+		if bytes.Contains(item, []byte(`Item:Semantic="MotionPhoto"`)) {
+			if match := itemLength.FindSubmatch(item); match != nil {
+				length, _ = strconv.ParseInt(string(match[1]), 10, 64)
+			}
+		}
+	}
+	if length <= 0 || length >= stat.Size() {
+		return 0, 0, fmt.Errorf("no motion photo video in %s", filename)
+	}
+
+	offset := stat.Size() - length
+	box := make([]byte, 8)
+	if _, err := in.ReadAt(box, offset); err != nil || string(box[4:]) != "ftyp" {
+		return 0, 0, fmt.Errorf("no mp4 at %d in %s", offset, filename)
+	}
+	return offset, length, nil
+}
+
+// The rest of the first APP1 segment of a jpeg that starts with prefix, ie the XMP packet after
+// XMP_NAMESPACE.  Only the segments before the image data are read.
+func jpegSegment(r *bufio.Reader, prefix string) ([]byte, error) {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errors.New("not a jpeg")
+	}
+	marker := make([]byte, 4)
+	for i := 0; i < MAX_JPEG_SEGMENTS; i++ {
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, err
+		}
+		// Start of scan, or something that isn't a marker
+		if marker[0] != 0xff || marker[1] == 0xda {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if size < 0 {
+			break
+		}
+		if marker[1] != 0xe1 || size < len(prefix) {
+			if _, err := r.Discard(size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(segment, []byte(prefix)) {
+			return segment[len(prefix):], nil
+		}
+	}
+	return nil, fmt.Errorf("no %q segment", prefix)
+}
+
+// Serves the video of the motion photo pathInfo, taking it out into clip the first time
+func (a *Album) serveMotionClip(w http.ResponseWriter, req *http.Request, config Config, fullAlbumDir, pathInfo, clip string, followSymlinks, public bool) {
+	source, err := ResolvePath(fullAlbumDir, pathInfo, followSymlinks)
+	if err != nil {
+		a.pathError(w, pathInfo, err)
+		return
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		a.pathError(w, pathInfo, err)
+		return
+	}
+	if err := extractMotionClip(source, clip); err != nil {
+		a.logger.Printf("Error extracting %s from %s: %v\n", clip, source, err)
+		http.NotFound(w, req)
+		return
+	}
+
+	version := thumbnailVersion(config, stat)
+	w.Header().Set("Cache-Control", cacheControl(public, req.URL.Query().Get(VERSION_PARAM) == version))
+	w.Header().Set("Content-Type", "video/mp4")
+	setEtag(w, version, "")
+	http.ServeFile(w, req, clip)
+}
@@ -0,0 +1,196 @@
+package album
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testClip = []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom and the rest of the video")
+
+// A jpeg with xmp in an APP1 segment after the SOI and clip on the end, as a Pixel writes them
+func makeMotionPhoto(t testing.TB, xmp string, clip []byte) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(img.Bytes()[:2])
+	if xmp != "" {
+		buf.Write([]byte{0xff, 0xe1})
+		binary.Write(&buf, binary.BigEndian, uint16(2+len(XMP_NAMESPACE)+len(xmp)))
+		buf.WriteString(XMP_NAMESPACE + xmp)
+	}
+	buf.Write(img.Bytes()[2:])
+	buf.Write(clip)
+	return buf.Bytes()
+}
+
+func motionXmp(length int) string {
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF><rdf:Description GCamera:MotionPhoto="1"><Container:Directory><rdf:Seq>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Mime="image/jpeg" Item:Semantic="Primary" Item:Length="0" Item:Padding="0"/></rdf:li>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Mime="video/mp4" Item:Semantic="MotionPhoto" Item:Length="` + strconv.Itoa(length) + `"/></rdf:li>` +
+		`</rdf:Seq></Container:Directory></rdf:Description></rdf:RDF></x:xmpmeta>`
+}
+
+func TestMotionClip(t *testing.T) {
+	dir := t.TempDir()
+	length := len(testClip)
+	files := map[string][]byte{
+		"container.jpg": makeMotionPhoto(t, motionXmp(length), testClip),
+		"micro.jpg":     makeMotionPhoto(t, `<rdf:Description GCamera:MicroVideo="1" GCamera:MicroVideoOffset="`+strconv.Itoa(length)+`"/>`, testClip),
+		"plain.jpg":     makeMotionPhoto(t, "", nil),
+		"no_video.jpg":  makeMotionPhoto(t, `<rdf:Description GCamera:MicroVideo="0"/>`, testClip),
+		"wrong.jpg":     makeMotionPhoto(t, motionXmp(length+3), testClip),
+		"huge.jpg":      makeMotionPhoto(t, motionXmp(1<<40), testClip),
+		"not_jpeg.jpg":  []byte("GIF89a"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name string
+		want bool
+	}{
+		{"container.jpg", true},
+		{"micro.jpg", true},
+		{"plain.jpg", false},
+		{"no_video.jpg", false},
+		{"wrong.jpg", false},
+		{"huge.jpg", false},
+		{"not_jpeg.jpg", false},
+		{"missing.jpg", false},
+	}
+	for _, test := range tests {
+		offset, clipLength, err := motionClip(filepath.Join(dir, test.name))
+		if (err == nil) != test.want {
+			t.Errorf("motionClip(%s): expecting %v, was %v", test.name, test.want, err)
+			continue
+		}
+		if test.want && (offset != int64(len(files[test.name])-length) || clipLength != int64(length)) {
+			t.Errorf("motionClip(%s): expecting the last %d bytes, was %d at %d", test.name, length, clipLength, offset)
+		}
+	}
+
+	clip := filepath.Join(dir, "thumbs", "container.jpg.mp4")
+	if err := extractMotionClip(filepath.Join(dir, "container.jpg"), clip); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(clip); err != nil || !bytes.Equal(contents, testClip) {
+		t.Errorf("Expecting the clip to be taken out, was %q %v", contents, err)
+	}
+}
+
+func TestLivePhotos(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	files := map[string][]byte{
+		"Bob_and_Jenny.MOV": []byte("the live part"),
+		"PXL_0001.MP.jpg":   makeMotionPhoto(t, motionXmp(len(testClip)), testClip),
+		"clip.mp4":          []byte("a video on its own"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(source, name), contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if strings.Contains(page, "Bob_and_Jenny.MOV") || !strings.Contains(page, "tn__clip.png") {
+		t.Errorf("Expecting the MOV to go with its jpeg and the mp4 on its own, was %s", page)
+	}
+	for _, name := range []string{"Bob_and_Jenny.jpg", "PXL_0001.MP.jpg"} {
+		if !strings.Contains(page, `<a href="1024x768_`+name+`" class="live">`) {
+			t.Errorf("Expecting %s to have a live badge, was %s", name, page)
+		}
+	}
+	if strings.Contains(page, `<a href="1024x768_Bob_and_Jenny.MOV"`) {
+		t.Errorf("Expecting the MOV not to be in the grid, was %s", page)
+	}
+
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/640x480_Bob_and_Jenny.jpg", nil)).Body.String()
+	if !strings.Contains(page, `<video class="live" src="/test/albums/Bob_and_Jenny.MOV" poster="/test/thumbs/640x480_Bob_and_Jenny.jpg"`) {
+		t.Errorf("Expecting the MOV to play on the single page, was %s", page)
+	}
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/640x480_PXL_0001.MP.jpg", nil)).Body.String()
+	if !strings.Contains(page, `<video class="live" src="/test/thumbs/PXL_0001.MP.jpg.mp4?v=`) {
+		t.Errorf("Expecting the embedded clip to play on the single page, was %s", page)
+	}
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/PXL_0001.MP.jpg.mp4", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "video/mp4" || !bytes.Equal(rec.Body.Bytes(), testClip) {
+		t.Errorf("Expecting the embedded clip, was %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(a.appConfig.AlbumsDir, "thumbs", "PXL_0001.MP.jpg.mp4")); err != nil {
+		t.Errorf("Expecting the clip to be cached in thumbDir: %v", err)
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/Bob_and_Jenny.jpg.mp4", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("Expecting no clip in a plain jpeg, was %d", rec.Code)
+	}
+
+	var media ApiMedia
+	if err := json.Unmarshal(serve(a, httptest.NewRequest("GET", "/api/v1/test/media/Bob_and_Jenny.jpg", nil)).Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.LiveUrl != "/test/albums/Bob_and_Jenny.MOV" {
+		t.Errorf("Expecting the liveUrl in the api, was %q", media.LiveUrl)
+	}
+}
+
+func TestMotionCache(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	filename := filepath.Join(source, "PXL_0002.MP.jpg")
+	contents := makeMotionPhoto(t, motionXmp(len(testClip)), testClip)
+	if err := os.WriteFile(filename, contents, 0664); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve(a, httptest.NewRequest("GET", "/test/albums/", nil))
+	infos := loadDirInfo(filepath.Join(a.appConfig.AlbumsDir, "thumbs", INFO_FILENAME))
+	if info := infos["PXL_0002.MP.jpg"]; info == nil || info.MotionLength != int64(len(testClip)) {
+		t.Fatalf("Expecting the clip to be cached in %s, was %+v", INFO_FILENAME, info)
+	}
+	if info := infos["Bob_and_Jenny.jpg"]; info == nil || info.MotionLength != NO_MOTION {
+		t.Errorf("Expecting a plain jpeg to be cached without a clip, was %+v", info)
+	}
+
+	// Same size and time, so the cache is used rather than reading it again
+	broken := bytes.Replace(contents, []byte(`Semantic="MotionPhoto"`), []byte(`Semantic="MotionFotos"`), 1)
+	if err := os.WriteFile(filename, broken, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if !strings.Contains(page, `<a href="1024x768_PXL_0002.MP.jpg" class="live">`) {
+		t.Errorf("Expecting the cached clip to be used, was %s", page)
+	}
+
+	// Changed, so it's read again
+	if err := os.Chtimes(filename, stat.ModTime().Add(time.Hour), stat.ModTime().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if strings.Contains(page, `<a href="1024x768_PXL_0002.MP.jpg" class="live">`) {
+		t.Errorf("Expecting the changed jpeg to be read again, was %s", page)
+	}
+}
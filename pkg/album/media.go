@@ -0,0 +1,332 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	MEDIA_IMAGE = "image"
+	MEDIA_VIDEO = "video"
+
+	// Enough of a file to find any of the signatures
+	SNIFF_SIZE = 64
+)
+
+// A kind of file the album shows.  The built in types are registered when the package
+// loads, integrators can add their own with RegisterMediaType and albums with extraTypes.
+type MediaType interface {
+	Name() string
+	// MEDIA_IMAGE or MEDIA_VIDEO
+	Kind() string
+	// Lower case and without the dot
+	Extensions() []string
+	// Whether the first bytes of a file are this type, false when it has no signatures
+	Sniff(header []byte) bool
+	// Videos browsers can't play are converted to webm in the background
+	NeedsConversion() bool
+	// The template one of them is shown with on its own
+	Viewer() string
+	// Makes the thumbnail, or size variant, of source
+	Thumbnail(source, thumbnail string, opts ThumbnailOptions) error
+}
+
+// Implemented by image types, so sizes other than the thumbnails can be made
+type ImageDecoder interface {
+	Decode(source, rendition string) (image.Image, error)
+}
+
+type ThumbnailOptions struct {
+	Width     int
+	Quality   int
+	VideoSize string
+	// Where an original imaging can't read may be cached once it's decoded
+	Rendition string
+	// Only the first frame of an animation
+	Static bool
+	// Never wider than the original
+	NoUpscale bool
+}
+
+// Magic is hex for the bytes found at Offset
+type Signature struct {
+	Offset int    `yaml:"offset" json:"offset"`
+	Magic  string `yaml:"magic" json:"magic"`
+}
+
+// A media type added to an album by its config, Kind is image or video
+type ExtraType struct {
+	Name            string      `yaml:"name" json:"name"`
+	Kind            string      `yaml:"kind" json:"kind"`
+	Extensions      []string    `yaml:"extensions" json:"extensions"`
+	Signatures      []Signature `yaml:"signatures" json:"signatures"`
+	NeedsConversion bool        `yaml:"needsConversion" json:"needsConversion"`
+	Viewer          string      `yaml:"viewer" json:"viewer"`
+	Raw             bool        `yaml:"raw" json:"raw"`
+}
+
+// Images imaging can open, or Decoder can.  Raw camera files are shown with the jpeg of
+// the same name when there is one.
+type ImageType struct {
+	TypeName   string
+	Exts       []string
+	Signatures []Signature
+	Page       string
+	Decoder    func(source, rendition string) (image.Image, error)
+	Raw        bool
+}
+
+// Videos ffmpeg can take a frame from
+type VideoType struct {
+	TypeName   string
+	Exts       []string
+	Signatures []Signature
+	Convert    bool
+	Page       string
+}
+
+var (
+	mediaTypes = []MediaType{
+		&ImageType{TypeName: "jpeg", Exts: []string{"jpg", "jpeg"}, Signatures: []Signature{{0, "ffd8ff"}}},
+		&GifType{ImageType{TypeName: "gif", Exts: []string{"gif"}, Signatures: []Signature{{0, "474946383761"}, {0, "474946383961"}}}},
+		&ImageType{TypeName: "png", Exts: []string{"png"}, Signatures: []Signature{{0, "89504e470d0a1a0a"}}},
+		&ImageType{TypeName: "webp", Exts: []string{"webp"}, Signatures: []Signature{{8, "57454250"}}},
+		&ImageType{TypeName: "tiff", Exts: []string{"tif", "tiff"}, Signatures: []Signature{{0, "49492a00"}, {0, "4d4d002a"}}},
+		&ImageType{TypeName: "raw", Exts: []string{"cr2", "nef", "arw", "dng"}, Signatures: []Signature{{0, "49492a00"}, {0, "4d4d002a"}}, Decoder: decodeRaw, Raw: true},
+		&ImageType{TypeName: "bmp", Exts: []string{"bmp"}, Signatures: []Signature{{0, "424d"}}},
+		&ImageType{TypeName: "heif", Exts: []string{"heic", "heif"}, Signatures: []Signature{{4, "6674797068656963"}, {4, "6674797068656978"}, {4, "667479706d696631"}, {4, "667479706d736631"}}, Decoder: decodeHeif},
+		&VideoType{TypeName: "avi", Exts: []string{"avi"}, Signatures: []Signature{{8, "41564920"}}, Convert: true},
+		&VideoType{TypeName: "mpeg", Exts: []string{"mpeg", "mpg"}, Signatures: []Signature{{0, "000001ba"}, {0, "000001b3"}}, Convert: true},
+		&VideoType{TypeName: "ogg", Exts: []string{"ogg", "ogv"}, Signatures: []Signature{{0, "4f676753"}}},
+		&VideoType{TypeName: "webm", Exts: []string{"webm"}, Signatures: []Signature{{0, "1a45dfa3"}}},
+		&VideoType{TypeName: "mov", Exts: []string{"mov"}, Signatures: []Signature{{4, "6674797071742020"}, {4, "6d6f6f76"}}},
+		&VideoType{TypeName: "mp4", Exts: []string{"mp4", "m4v"}, Signatures: []Signature{{4, "66747970"}}},
+	}
+	mediaTypesLock sync.RWMutex
+	// Bumped as types are registered, so the types a Config cached are known to be stale
+	mediaTypesGeneration int
+)
+
+// The types a Config knows, from its extraTypes and the registry as it was at generation
+type mediaTypeCache struct {
+	generation int
+	extraTypes int
+	types      []MediaType
+}
+
+// Adds mediaType to every album, it takes over any extensions a type registered before it had
+func RegisterMediaType(mediaType MediaType) {
+	mediaTypesLock.Lock()
+	defer mediaTypesLock.Unlock()
+	mediaTypes = append(mediaTypes, mediaType)
+	mediaTypesGeneration++
+}
+
+// The types an album with config knows, its extraTypes first.  They're cached by Merge,
+// a config that wasn't merged, or whose types were registered since, works them out.
+func (c Config) allMediaTypes() []MediaType {
+	mediaTypesLock.RLock()
+	defer mediaTypesLock.RUnlock()
+	if cache := c.mediaTypes; cache != nil && cache.generation == mediaTypesGeneration && cache.extraTypes == len(c.ExtraTypes) {
+		return cache.types
+	}
+	return c.buildMediaTypes()
+}
+
+// Caches the types c knows, for when c has just been merged or had extraTypes added
+func (c *Config) cacheMediaTypes() {
+	mediaTypesLock.RLock()
+	defer mediaTypesLock.RUnlock()
+	c.mediaTypes = &mediaTypeCache{generation: mediaTypesGeneration, extraTypes: len(c.ExtraTypes), types: c.buildMediaTypes()}
+}
+
+// Has to be called with mediaTypesLock held
+func (c Config) buildMediaTypes() []MediaType {
+	var types []MediaType
+	for i := len(c.ExtraTypes) - 1; i >= 0; i-- {
+		if mediaType := c.ExtraTypes[i].mediaType(); mediaType != nil {
+			types = append(types, mediaType)
+		}
+	}
+	for i := len(mediaTypes) - 1; i >= 0; i-- {
+		types = append(types, mediaTypes[i])
+	}
+	return types
+}
+
+// The type of filename going by its extension, nil when the album doesn't show them
+func (c Config) MediaType(filename string) MediaType {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	if ext == "" {
+		return nil
+	}
+	for _, mediaType := range c.allMediaTypes() {
+		for _, candidate := range mediaType.Extensions() {
+			if strings.ToLower(candidate) == ext {
+				return mediaType
+			}
+		}
+	}
+	return nil
+}
+
+// The type of the file at filename.  When its first bytes aren't what its extension says
+// they should be, a type of the same kind whose signature they match wins, ie a HEIC saved
+// as .jpg.  Types whose signatures nothing matches go by their extension.
+func (c Config) DetectMediaType(filename string) MediaType {
+	mediaType := c.MediaType(filename)
+	if mediaType == nil {
+		return nil
+	}
+	in, err := os.Open(filename)
+	if err != nil {
+		return mediaType
+	}
+	defer in.Close()
+	header := make([]byte, SNIFF_SIZE)
+	n, _ := io.ReadFull(in, header)
+	header = header[:n]
+	if mediaType.Sniff(header) {
+		return mediaType
+	}
+	for _, other := range c.allMediaTypes() {
+		if other.Kind() == mediaType.Kind() && other.Sniff(header) {
+			return other
+		}
+	}
+	return mediaType
+}
+
+func (c Config) IsImageFile(filename string) bool {
+	mediaType := c.MediaType(filename)
+	return mediaType != nil && mediaType.Kind() == MEDIA_IMAGE
+}
+
+func (c Config) IsVideoFile(filename string) bool {
+	mediaType := c.MediaType(filename)
+	return mediaType != nil && mediaType.Kind() == MEDIA_VIDEO
+}
+
+func (c Config) IsViewableFile(filename string) bool {
+	return c.IsImageFile(filename) || c.IsVideoFile(filename)
+}
+
+func (c Config) VideoNeedsConversion(filename string) bool {
+	return c.IsVideoFile(filename) && c.MediaType(filename).NeedsConversion()
+}
+
+func (c Config) CanHtmlPlay(filename string) bool {
+	return c.IsVideoFile(filename) && !c.MediaType(filename).NeedsConversion()
+}
+
+func (c Config) GetImageFiles(files []os.DirEntry) []os.DirEntry {
+	var imageFiles []os.DirEntry
+	for _, file := range files {
+		if c.IsImageFile(file.Name()) {
+			imageFiles = append(imageFiles, file)
+		}
+	}
+	return imageFiles
+}
+
+// Thumbnails are made with the album's own config, but the extraTypes in the config.yaml
+// of dir in the album are needed to know the types it added
+func withDirTypes(config Config, albumDir, dir string) Config {
+	if dirConfig, err := LoadConfigFile(filepath.Join(albumDir, filepath.FromSlash(path.Clean("/"+dir)), CONFIG_FILENAME)); err == nil {
+		config.ExtraTypes = append(append([]ExtraType{}, config.ExtraTypes...), dirConfig.ExtraTypes...)
+		config.cacheMediaTypes()
+	}
+	return config
+}
+
+func (e ExtraType) mediaType() MediaType {
+	switch strings.ToLower(e.Kind) {
+	case MEDIA_IMAGE:
+		if e.Raw {
+			return &ImageType{TypeName: e.Name, Exts: e.Extensions, Signatures: e.Signatures, Page: e.Viewer, Decoder: decodeRaw, Raw: true}
+		}
+		return &ImageType{TypeName: e.Name, Exts: e.Extensions, Signatures: e.Signatures, Page: e.Viewer}
+	case MEDIA_VIDEO:
+		return &VideoType{TypeName: e.Name, Exts: e.Extensions, Signatures: e.Signatures, Convert: e.NeedsConversion, Page: e.Viewer}
+	}
+	return nil
+}
+
+func sniff(signatures []Signature, header []byte) bool {
+	for _, signature := range signatures {
+		magic, err := hex.DecodeString(signature.Magic)
+		if err != nil || len(magic) == 0 || signature.Offset < 0 || signature.Offset+len(magic) > len(header) {
+			continue
+		}
+		if bytes.Equal(header[signature.Offset:signature.Offset+len(magic)], magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ImageType) Name() string             { return i.TypeName }
+func (i *ImageType) Kind() string             { return MEDIA_IMAGE }
+func (i *ImageType) Extensions() []string     { return i.Exts }
+func (i *ImageType) Sniff(header []byte) bool { return sniff(i.Signatures, header) }
+func (i *ImageType) NeedsConversion() bool    { return false }
+
+func (i *ImageType) Viewer() string {
+	if i.Page == "" {
+		return "single.html"
+	}
+	return i.Page
+}
+
+func (i *ImageType) Decode(source, rendition string) (image.Image, error) {
+	if i.Decoder != nil {
+		return i.Decoder(source, rendition)
+	}
+	return imaging.Open(source, imaging.AutoOrientation(true))
+}
+
+func (i *ImageType) Thumbnail(source, thumbnail string, opts ThumbnailOptions) error {
+	img, err := i.Decode(source, opts.Rendition)
+	if err != nil {
+		return err
+	}
+	if !opts.NoUpscale || img.Bounds().Dx() > opts.Width {
+		img = imaging.Resize(img, opts.Width, 0, imaging.Box)
+	}
+	return saveThumbnail(img, thumbnail, opts.Quality)
+}
+
+func (v *VideoType) Name() string             { return v.TypeName }
+func (v *VideoType) Kind() string             { return MEDIA_VIDEO }
+func (v *VideoType) Extensions() []string     { return v.Exts }
+func (v *VideoType) Sniff(header []byte) bool { return sniff(v.Signatures, header) }
+func (v *VideoType) NeedsConversion() bool    { return v.Convert }
+
+func (v *VideoType) Viewer() string {
+	if v.Page == "" {
+		return "video.html"
+	}
+	return v.Page
+}
+
+// Saves a frame
+func (v *VideoType) Thumbnail(source, thumbnail string, opts ThumbnailOptions) error {
+	return GenerateVideoThumbnail(source, opts.VideoSize, thumbnail)
+}
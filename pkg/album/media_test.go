@@ -0,0 +1,158 @@
+package album
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestMediaType(t *testing.T) {
+	config := Config{ExtraTypes: []ExtraType{
+		{Name: "jfif", Kind: "image", Extensions: []string{"jfif"}},
+		{Name: "mkv", Kind: "video", Extensions: []string{"mkv"}, NeedsConversion: true},
+		{Name: "mov", Kind: "video", Extensions: []string{"MOV"}, NeedsConversion: true},
+		{Name: "bad", Kind: "audio", Extensions: []string{"mp3"}},
+	}}
+
+	var tests = []struct {
+		filename   string
+		config     Config
+		wantKind   string
+		wantConv   bool
+		wantViewer string
+	}{
+		{"photo.jpg", Config{}, MEDIA_IMAGE, false, "single.html"},
+		{"PHOTO.JPEG", Config{}, MEDIA_IMAGE, false, "single.html"},
+		{"2020/tn__shot.png", Config{}, MEDIA_IMAGE, false, "single.html"},
+		{"photo.notjpg", Config{}, "", false, ""},
+		{"photojpg", Config{}, "", false, ""},
+		{"clip.notmpeg", Config{}, "", false, ""},
+		{"clip.mpeg", Config{}, MEDIA_VIDEO, true, "video.html"},
+		{"movie.avi", Config{}, MEDIA_VIDEO, true, "video.html"},
+		{"clip.MP4", Config{}, MEDIA_VIDEO, false, "video.html"},
+		{"clip.mov", Config{}, MEDIA_VIDEO, false, "video.html"},
+		{"scan.jfif", Config{}, "", false, ""},
+		{"scan.jfif", config, MEDIA_IMAGE, false, "single.html"},
+		{"clip.mkv", config, MEDIA_VIDEO, true, "video.html"},
+		{"clip.mov", config, MEDIA_VIDEO, true, "video.html"},
+		{"song.mp3", config, "", false, ""},
+	}
+	for _, test := range tests {
+		mediaType := test.config.MediaType(test.filename)
+		if mediaType == nil {
+			if test.wantKind != "" {
+				t.Errorf("MediaType(%s): expecting %s, was nil", test.filename, test.wantKind)
+			}
+			continue
+		}
+		if mediaType.Kind() != test.wantKind || mediaType.NeedsConversion() != test.wantConv || mediaType.Viewer() != test.wantViewer {
+			t.Errorf("MediaType(%s): expecting %s %v %s, was %s %v %s", test.filename, test.wantKind, test.wantConv, test.wantViewer, mediaType.Kind(), mediaType.NeedsConversion(), mediaType.Viewer())
+		}
+		if test.config.IsViewableFile(test.filename) != (test.wantKind != "") {
+			t.Errorf("IsViewableFile(%s): expecting %v", test.filename, test.wantKind != "")
+		}
+		if test.config.VideoNeedsConversion(test.filename) != test.wantConv || test.config.CanHtmlPlay(test.filename) != (test.wantKind == MEDIA_VIDEO && !test.wantConv) {
+			t.Errorf("%s: expecting conversion %v", test.filename, test.wantConv)
+		}
+	}
+}
+
+func TestDetectMediaType(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"jpeg.jpg":   "\xff\xd8\xff\xe0\x00\x10JFIF",
+		"heic.jpg":   "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic",
+		"png.jpg":    "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR",
+		"junk.jpg":   "not really a jpeg",
+		"movie.avi":  "\x1a\x45\xdf\xa3 a webm",
+		"empty.heic": "",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		filename string
+		want     string
+	}{
+		{"jpeg.jpg", "jpeg"},
+		{"heic.jpg", "heif"},
+		{"png.jpg", "png"},
+		{"junk.jpg", "jpeg"},
+		{"movie.avi", "webm"},
+		{"empty.heic", "heif"},
+		{"missing.png", "png"},
+	}
+	for _, test := range tests {
+		mediaType := Config{}.DetectMediaType(filepath.Join(dir, test.filename))
+		if mediaType == nil || mediaType.Name() != test.want {
+			t.Errorf("DetectMediaType(%s): expecting %s, was %v", test.filename, test.want, mediaType)
+		}
+	}
+	if mediaType := (Config{}).DetectMediaType(filepath.Join(dir, "notes.txt")); mediaType != nil {
+		t.Errorf("Expecting no type for notes.txt, was %s", mediaType.Name())
+	}
+}
+
+func TestRegisterMediaType(t *testing.T) {
+	registered := mediaTypes
+	defer func() { mediaTypes = registered; mediaTypesGeneration++ }()
+
+	if IsImageFile("scan.jfif") {
+		t.Fatal("Expecting jfif not to be registered yet")
+	}
+	var merged Config
+	Merge(&merged, &Config{})
+	if types := merged.allMediaTypes(); &types[0] != &merged.allMediaTypes()[0] {
+		t.Error("Expecting a merged config to keep its types")
+	}
+	RegisterMediaType(&ImageType{TypeName: "jfif", Exts: []string{"jfif"}})
+	if !merged.IsImageFile("scan.jfif") {
+		t.Error("Expecting a merged config to know types registered since")
+	}
+	RegisterMediaType(&VideoType{TypeName: "avi", Exts: []string{"avi"}, Page: "player.html"})
+	if !IsImageFile("scan.jfif") || !IsJpegRendition("scan.jfif") {
+		t.Error("Expecting a registered jfif to be an image with jpeg thumbnails")
+	}
+	if VideoNeedsConversion("movie.avi") || !CanHtmlPlay("movie.avi") || (Config{}).MediaType("movie.avi").Viewer() != "player.html" {
+		t.Error("Expecting the avi registered last to win")
+	}
+}
+
+func TestExtraTypes(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	if err := imaging.Save(image.NewRGBA(image.Rect(0, 0, 64, 48)), filepath.Join(source, "2020", "(01)January", "scan.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(source, "2020", "(01)January", "scan.jpg"), filepath.Join(source, "2020", "(01)January", "scan.jfif")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "2020", "(01)January", "config.yaml"), []byte("extraTypes:\n  - name: jfif\n    kind: image\n    extensions: [jfif]\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "2020", "(01)January", "photo.notjpg"), []byte("not an image"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/2020/(01)January/", nil)).Body.String()
+	if !strings.Contains(page, "tn__scan.jfif") || strings.Contains(page, "photo.notjpg") {
+		t.Errorf("Expecting only scan.jfif to be added to the grid, was %s", page)
+	}
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/2020/(01)January/tn__scan.jfif", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expecting a jpeg thumbnail of scan.jfif, was %d %v", rec.Code, rec.Header())
+	}
+	if _, err := imaging.Decode(rec.Body); err != nil {
+		t.Errorf("Expecting an image: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"time"
+
+	"github.com/alitto/pond"
+)
+
+type Option func(*Album)
+
+// Creates an album http.Handler.  Without WithAppConfig, appconfig.yaml is read from the
+// working directory on every request, and without WithAlbumsConfig albumsconfig.yaml is
+// read from the albums directory on every request, so edits take effect without a restart.
+func New(opts ...Option) *Album {
+	a := &Album{
+		logger:            log.New(os.Stdout, "", log.LstdFlags),
+		workingMap:        make(map[string]string),
+		failedEncoders:    make(map[string]bool),
+		sessionKey:        make([]byte, 32),
+		verifiedLogins:    make(map[string]bool),
+		loadedUsers:       make(map[string]loadedUsers),
+		similarIndexed:    make(map[string]time.Time),
+		similarIndexes:    make(map[string]loadedIndex),
+		hashing:           make(map[string]bool),
+		placeholding:      make(map[string]bool),
+		thumbnailVersions: make(map[string]loadedVersions),
+	}
+	rand.Read(a.sessionKey)
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.pool == nil {
+		a.pool = pond.New(3, 750)
+	}
+	return a
+}
+
+func WithAppConfig(appConfig *AppConfig) Option {
+	return func(a *Album) {
+		a.appConfig = appConfig
+	}
+}
+
+func WithAlbumsConfig(albumsConfig *AlbumsConfig) Option {
+	return func(a *Album) {
+		a.albumsConfig = albumsConfig
+	}
+}
+
+// The directory albumDir and thumbDir are relative to, overrides AppConfig.AlbumsDir
+func WithAlbumsDir(albumsDir string) Option {
+	return func(a *Album) {
+		a.albumsDir = albumsDir
+	}
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(a *Album) {
+		a.logger = logger
+	}
+}
+
+// The path the handler is mounted at, ie /photos.  It is stripped from requests
+// and added to every generated link.  Overrides AppConfig.BasePath.
+func WithPrefix(prefix string) Option {
+	return func(a *Album) {
+		a.prefix = cleanPrefix(prefix)
+	}
+}
+
+// Pool used for background video conversions, shared with other handlers if desired
+func WithPool(pool *pond.WorkerPool) Option {
+	return func(a *Album) {
+		a.pool = pool
+	}
+}
+
+func (a *Album) loadConfig() (*AppConfig, *AlbumsConfig, error) {
+	appConfig := a.appConfig
+	if appConfig == nil {
+		var err error
+		appConfig, err = LoadAppConfigFile()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if a.albumsDir != "" {
+		copied := *appConfig
+		copied.AlbumsDir = a.albumsDir
+		appConfig = &copied
+	}
+
+	if a.albumsConfig != nil {
+		return appConfig, a.albumsConfig, nil
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(appConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return appConfig, albumsConfig, nil
+}
@@ -0,0 +1,232 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Width of the copy of a thumbnail shown, blurred by the browser, while it loads
+	PLACEHOLDER_WIDTH   = 16
+	PLACEHOLDER_QUALITY = 40
+
+	// Color of a photo whose thumbnail is see through, nothing's shown behind it
+	NO_PLACEHOLDER = "-"
+)
+
+var (
+	placeholderColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+	placeholderImage = regexp.MustCompile(`^data:image/jpeg;base64,[A-Za-z0-9+/]+=*$`)
+)
+
+// What an image in the grid shows until its thumbnail loads, its dominant color as #rrggbb
+// and a tiny copy of it as a data: url
+type Placeholder struct {
+	Color string
+	Image string
+}
+
+// The placeholders of the images in the grid, from the .info.json of the directory.  Those
+// that haven't got one yet are made from the originals in the background, and are in the
+// grid once they have been.
+func (a *Album) placeholderFiles(t *TemplateSource) {
+	dir := t.currentDir()
+	thumbDir := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir)
+	infoFilename := filepath.Join(thumbDir, dir, INFO_FILENAME)
+	a.infoLock.Lock()
+	infos := loadDirInfo(infoFilename)
+	a.infoLock.Unlock()
+
+	var changed, missing []string
+	for _, file := range t.Files {
+		name := file.Name()
+		if !t.Current.IsImageFile(name) {
+			continue
+		}
+		info, fresh := infos.lookup(filepath.Join(t.baseDir(), dir, name), name)
+		if info == nil {
+			continue
+		}
+		if fresh {
+			changed = append(changed, name)
+		}
+		if info.Color == "" {
+			missing = append(missing, name)
+		} else if info.Color != NO_PLACEHOLDER {
+			if t.Placeholders == nil {
+				t.Placeholders = make(map[string]Placeholder)
+			}
+			t.Placeholders[name] = Placeholder{Color: info.Color, Image: info.Placeholder}
+		}
+	}
+	if len(changed) > 0 {
+		if err := a.mergeDirInfo(infoFilename, infos, changed); err != nil {
+			a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+		}
+	}
+
+	var pending []string
+	a.infoLock.Lock()
+	for _, name := range missing {
+		key := filepath.Join(thumbDir, dir, name)
+		if !a.placeholding[key] {
+			a.placeholding[key] = true
+			pending = append(pending, name)
+		}
+	}
+	a.infoLock.Unlock()
+
+	// Submitting can wait for a free worker, which could be waiting for infoLock
+	if len(pending) > 0 {
+		config, albumDir := t.Current, t.baseDir()
+		a.pool.Submit(func() {
+			a.makePlaceholders(config, albumDir, thumbDir, dir, pending)
+		})
+	}
+}
+
+// Makes the placeholders of the photos names in dir of the album at albumDir, from their
+// thumbnails when they've been made or else the originals, into its .info.json.  A photo
+// that changes meanwhile is left to be done again.
+func (a *Album) makePlaceholders(config Config, albumDir, thumbDir, dir string, names []string) {
+	type made struct {
+		size, modTime      int64
+		color, placeholder string
+	}
+	placeholders := make(map[string]made)
+	for _, name := range names {
+		pathInfo := path.Join(dir, name)
+		source := filepath.Join(albumDir, filepath.FromSlash(pathInfo))
+		stat, err := os.Stat(source)
+		if err != nil {
+			continue
+		}
+		img, err := thumbnailImage(config, source, thumbDir, pathInfo)
+		if err != nil {
+			a.logger.Printf("Error making placeholder of %s: %v\n", pathInfo, err)
+			continue
+		}
+		var info photoInfo
+		if err := info.setPlaceholder(img); err != nil {
+			a.logger.Printf("Error making placeholder of %s: %v\n", pathInfo, err)
+			continue
+		}
+		placeholders[name] = made{size: stat.Size(), modTime: stat.ModTime().UnixNano(), color: info.Color, placeholder: info.Placeholder}
+	}
+
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(dir), INFO_FILENAME)
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	infos := loadDirInfo(infoFilename)
+	for _, name := range names {
+		delete(a.placeholding, filepath.Join(thumbDir, filepath.FromSlash(dir), name))
+		photo, ok := placeholders[name]
+		if !ok {
+			continue
+		}
+		info, _ := infos.lookup(filepath.Join(albumDir, filepath.FromSlash(dir), name), name)
+		if info != nil && info.Size == photo.size && info.ModTime == photo.modTime {
+			info.Color, info.Placeholder = photo.color, photo.placeholder
+		}
+	}
+	if err := infos.save(infoFilename); err != nil {
+		a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+	}
+}
+
+// Caches the placeholder of the image at source, pathInfo in the album, from the thumbnail
+// just made of it, so the grid has it next time
+func (a *Album) savePlaceholder(thumbDir, pathInfo, source, thumbnail string) {
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(path.Dir(pathInfo)), INFO_FILENAME)
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	infos := loadDirInfo(infoFilename)
+	info, _ := infos.lookup(source, path.Base(pathInfo))
+	if info == nil {
+		return
+	}
+	img, err := imaging.Open(thumbnail)
+	if err == nil {
+		err = info.setPlaceholder(img)
+	}
+	if err != nil {
+		a.logger.Printf("Error making placeholder of %s: %v\n", pathInfo, err)
+		return
+	}
+	if err := infos.save(infoFilename); err != nil {
+		a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+	}
+}
+
+// Fills in the dominant color and tiny copy of a photo from img of it
+func (p *photoInfo) setPlaceholder(img image.Image) error {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		p.Color, p.Placeholder = NO_PLACEHOLDER, ""
+		return nil
+	}
+
+	small := imaging.Resize(img, PLACEHOLDER_WIDTH, 0, imaging.Box)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, small, imaging.JPEG, imaging.JPEGQuality(PLACEHOLDER_QUALITY)); err != nil {
+		return err
+	}
+	p.Color = dominantColor(small)
+	p.Placeholder = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return nil
+}
+
+// The average of the pixels of img in the most common of the HISTOGRAM_LEVELS cubed colors,
+// so a photo of a red car on a lot of blue sky is blue rather than purple
+func dominantColor(img *image.NRGBA) string {
+	const levels = HISTOGRAM_LEVELS * HISTOGRAM_LEVELS * HISTOGRAM_LEVELS
+	var counts [levels]int
+	var sums [levels][3]int
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		level := (r*HISTOGRAM_LEVELS/256*HISTOGRAM_LEVELS+g*HISTOGRAM_LEVELS/256)*HISTOGRAM_LEVELS + b*HISTOGRAM_LEVELS/256
+		counts[level]++
+		sums[level][0] += r
+		sums[level][1] += g
+		sums[level][2] += b
+	}
+	best := 0
+	for level, count := range counts {
+		if count > counts[best] {
+			best = level
+		}
+	}
+	if counts[best] == 0 {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/counts[best], sums[best][1]/counts[best], sums[best][2]/counts[best])
+}
+
+// The style of the thumbnail of name that shows its placeholder behind it until it loads,
+// "" when it hasn't got one yet
+func (t TemplateSource) PlaceholderStyle(name string) template.CSS {
+	placeholder, ok := t.Placeholders[name]
+	if !ok || !placeholderColor.MatchString(placeholder.Color) {
+		return ""
+	}
+	if !placeholderImage.MatchString(placeholder.Image) {
+		return template.CSS("background: " + placeholder.Color)
+	}
+	return template.CSS(fmt.Sprintf("background: %s url(%s) center / cover no-repeat", placeholder.Color, placeholder.Image))
+}
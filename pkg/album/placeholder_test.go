@@ -0,0 +1,115 @@
+package album
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alitto/pond"
+)
+
+func TestDominantColor(t *testing.T) {
+	// Mostly sky with a red car
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 12))
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 16; x++ {
+			if x < 4 && y > 8 {
+				img.Set(x, y, color.NRGBA{240, 10, 10, 255})
+			} else {
+				img.Set(x, y, color.NRGBA{20, 40, 200, 255})
+			}
+		}
+	}
+	if c := dominantColor(img); c != "#1428c8" {
+		t.Errorf("Expecting the sky's color, was %s", c)
+	}
+}
+
+func TestPlaceholderStyle(t *testing.T) {
+	tmplSource := TemplateSource{Placeholders: map[string]Placeholder{
+		"a.jpg": {Color: "#102030", Image: "data:image/jpeg;base64,AAAA"},
+		"b.jpg": {Color: "#102030", Image: "javascript:x()"},
+		"c.jpg": {Color: "red; x: y", Image: "data:image/jpeg;base64,AAAA"},
+	}}
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"a.jpg", "background: #102030 url(data:image/jpeg;base64,AAAA) center / cover no-repeat"},
+		{"b.jpg", "background: #102030"},
+		{"c.jpg", ""},
+		{"d.jpg", ""},
+	}
+	for _, test := range tests {
+		if style := string(tmplSource.PlaceholderStyle(test.name)); style != test.want {
+			t.Errorf("%s: expecting %q, was %q", test.name, test.want, style)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsDir := a.appConfig.AlbumsDir
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.Placeholders = true
+	albumsConfig.Albums["test"] = albumConfig
+	a.albumsConfig = albumsConfig
+
+	// Nothing to show the first time, they're made from the originals in the background
+	rec := serve(a, httptest.NewRequest("GET", "/test/albums/", nil))
+	if strings.Contains(rec.Body.String(), "style=") {
+		t.Errorf("Expecting no placeholders yet, was %s", rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	a.pool.StopAndWait()
+	a.pool = pond.New(1, 10)
+
+	infoFilename := filepath.Join(albumsDir, "thumbs", INFO_FILENAME)
+	info := loadDirInfo(infoFilename)["Bob_and_Jenny.jpg"]
+	if info == nil || info.Color != "#000000" || !strings.HasPrefix(info.Placeholder, "data:image/jpeg;base64,") {
+		t.Fatalf("Expecting a placeholder made in the background, was %+v", info)
+	}
+	if _, err := os.Stat(filepath.Join(albumsDir, "thumbs", "tn__Bob_and_Jenny.jpg")); err == nil {
+		t.Error("Expecting the placeholder without making the thumbnail")
+	}
+
+	req := httptest.NewRequest("GET", "/test/albums/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = serve(a, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting the page to change with the placeholders, was %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `style="background: #000000 url(data:image/jpeg;base64,`) {
+		t.Errorf("Expecting the placeholder behind the thumbnail, was %s", body)
+	}
+
+	// The legacy theme shows them too
+	legacy := albumConfig
+	legacy.Config.Theme = THEME_LEGACY
+	albumsConfig.Albums["legacy"] = legacy
+	if body := serve(a, httptest.NewRequest("GET", "/legacy/albums/", nil)).Body.String(); !strings.Contains(body, `STYLE="background: #000000 url(data:image/jpeg;base64,`) {
+		t.Errorf("Expecting the placeholder in the legacy grid, was %s", body)
+	}
+
+	// Making a thumbnail makes its placeholder too
+	os.Remove(infoFilename)
+	if rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/tn__Bob_and_Jenny.jpg", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("Expecting the thumbnail, was %d", rec.Code)
+	}
+	if info := loadDirInfo(infoFilename)["Bob_and_Jenny.jpg"]; info == nil || info.Color != "#000000" {
+		t.Errorf("Expecting a placeholder when the thumbnail is made, was %+v", info)
+	}
+	body := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if !strings.Contains(body, `style="background: #000000 url(`) {
+		t.Errorf("Expecting the placeholder from the thumbnail, was %s", body)
+	}
+}
@@ -0,0 +1,253 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Tags of the TIFF structure CR2, NEF, ARW and DNG files are built on
+const (
+	TIFF_COMPRESSION       = 0x0103
+	TIFF_STRIP_OFFSETS     = 0x0111
+	TIFF_ORIENTATION       = 0x0112
+	TIFF_STRIP_BYTE_COUNTS = 0x0117
+	TIFF_SUB_IFDS          = 0x014a
+	TIFF_JPEG_OFFSET       = 0x0201
+	TIFF_JPEG_LENGTH       = 0x0202
+
+	// Old and new style jpeg compression
+	TIFF_OJPEG = 6
+	TIFF_JPEG  = 7
+
+	// Bounds on what's read from a damaged or hostile file
+	MAX_IFDS        = 32
+	MAX_IFD_ENTRIES = 1024
+	MAX_TAG_VALUES  = 64
+)
+
+// Where an embedded jpeg is in a raw file
+type rawPreview struct {
+	offset int64
+	length int64
+}
+
+// Decodes the biggest jpeg preview a raw file has, turned the way the camera was held.
+// A file without one is opened as the TIFF it is.
+func decodeRaw(source, rendition string) (image.Image, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	previews, orientation, err := rawPreviews(in, stat.Size())
+	if err != nil {
+		// x/image/tiff would buffer up to wherever a broken file points
+		return nil, fmt.Errorf("reading %s: %v", source, err)
+	}
+	for _, preview := range previews {
+		// Lossless jpeg raw data looks like a preview too, but won't decode
+		if img, err := jpeg.Decode(io.NewSectionReader(in, preview.offset, preview.length)); err == nil {
+			return orient(img, orientation), nil
+		}
+	}
+	if img, err := imaging.Open(source, imaging.AutoOrientation(true)); err == nil {
+		return img, nil
+	}
+	return nil, fmt.Errorf("no preview in %s", source)
+}
+
+// Walks every IFD and sub IFD for jpegs, biggest first, and the orientation in IFD0
+func rawPreviews(r io.ReaderAt, size int64) ([]rawPreview, int, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 0, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("not a TIFF based raw file")
+	}
+
+	ifd0 := int64(order.Uint32(header[4:]))
+	if ifd0 < 8 || ifd0 >= size {
+		return nil, 0, fmt.Errorf("IFD0 at %d is outside the file", ifd0)
+	}
+
+	var previews []rawPreview
+	orientation := 0
+	queue := []int64{ifd0}
+	seen := make(map[int64]bool)
+	for len(queue) > 0 && len(seen) < MAX_IFDS {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset <= 0 || offset >= size || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		tags, next, err := readIfd(r, order, offset)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, next)
+		queue = append(queue, tags[TIFF_SUB_IFDS]...)
+
+		if orientation == 0 && len(tags[TIFF_ORIENTATION]) > 0 {
+			orientation = int(tags[TIFF_ORIENTATION][0])
+		}
+		if len(tags[TIFF_JPEG_OFFSET]) > 0 && len(tags[TIFF_JPEG_LENGTH]) > 0 {
+			previews = append(previews, rawPreview{tags[TIFF_JPEG_OFFSET][0], tags[TIFF_JPEG_LENGTH][0]})
+		}
+		if compression := tags[TIFF_COMPRESSION]; len(compression) > 0 && (compression[0] == TIFF_OJPEG || compression[0] == TIFF_JPEG) &&
+			len(tags[TIFF_STRIP_OFFSETS]) == 1 && len(tags[TIFF_STRIP_BYTE_COUNTS]) == 1 {
+			previews = append(previews, rawPreview{tags[TIFF_STRIP_OFFSETS][0], tags[TIFF_STRIP_BYTE_COUNTS][0]})
+		}
+	}
+
+	var valid []rawPreview
+	soi := make([]byte, 2)
+	for _, preview := range previews {
+		if preview.offset <= 0 || preview.length <= 2 || preview.offset+preview.length > size {
+			continue
+		}
+		if _, err := r.ReadAt(soi, preview.offset); err == nil && soi[0] == 0xff && soi[1] == 0xd8 {
+			valid = append(valid, preview)
+		}
+	}
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].length > valid[j].length })
+	return valid, orientation, nil
+}
+
+// The SHORT, LONG and IFD values of each tag in the IFD at offset, and the offset of the next IFD
+func readIfd(r io.ReaderAt, order binary.ByteOrder, offset int64) (map[uint16][]int64, int64, error) {
+	count := make([]byte, 2)
+	if _, err := r.ReadAt(count, offset); err != nil {
+		return nil, 0, err
+	}
+	n := int(order.Uint16(count))
+	if n > MAX_IFD_ENTRIES {
+		return nil, 0, fmt.Errorf("%d entries in IFD at %d", n, offset)
+	}
+	entries := make([]byte, n*12+4)
+	if _, err := r.ReadAt(entries, offset+2); err != nil {
+		return nil, 0, err
+	}
+
+	tags := make(map[uint16][]int64)
+	for i := 0; i < n; i++ {
+		entry := entries[i*12 : i*12+12]
+		tag, kind, values := order.Uint16(entry), order.Uint16(entry[2:]), int(order.Uint32(entry[4:]))
+		width := 4
+		switch kind {
+		case 3:
+			width = 2
+		case 4, 13:
+		default:
+			continue
+		}
+		if values <= 0 || values > MAX_TAG_VALUES {
+			continue
+		}
+		data := entry[8:12]
+		if values*width > 4 {
+			data = make([]byte, values*width)
+			if _, err := r.ReadAt(data, int64(order.Uint32(entry[8:]))); err != nil {
+				continue
+			}
+		}
+		for j := 0; j < values; j++ {
+			if width == 2 {
+				tags[tag] = append(tags[tag], int64(order.Uint16(data[j*2:])))
+			} else {
+				tags[tag] = append(tags[tag], int64(order.Uint32(data[j*4:])))
+			}
+		}
+	}
+	return tags, int64(order.Uint32(entries[n*12:])), nil
+}
+
+// Turns img the way an EXIF orientation says, as imaging does for jpegs
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+func (c Config) IsRawFile(filename string) bool {
+	imageType, ok := c.MediaType(filename).(*ImageType)
+	return ok && imageType.Raw
+}
+
+// A raw file with a jpeg, or other image, of the same name goes with it rather than
+// being shown twice, Raws has the raw file for the name of the image
+func (t *TemplateSource) pairRaws() {
+	images := make(map[string]string)
+	for _, file := range t.Files {
+		if t.Current.IsImageFile(file.Name()) && !t.Current.IsRawFile(file.Name()) {
+			images[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = file.Name()
+		}
+	}
+
+	var files []os.DirEntry
+	for _, file := range t.Files {
+		name, ok := images[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))]
+		if ok && t.Current.IsRawFile(file.Name()) {
+			if t.Raws == nil {
+				t.Raws = make(map[string]string)
+			}
+			t.Raws[name] = file.Name()
+			t.ImageCount -= 1
+			continue
+		}
+		files = append(files, file)
+	}
+	t.Files = files
+}
+
+// Link to the raw file that goes with name in the current directory, "" if there isn't one
+func (t TemplateSource) RawUrl(name string) string {
+	if raw := t.Raws[name]; raw != "" {
+		return t.SizedUrl(raw, "full")
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package album
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// A raw file laid out the way cameras write them: a small preview in IFD0, lossless raw
+// data that starts like a jpeg in IFD1 and the big preview in a sub IFD
+func makeRaw(t testing.TB, order binary.ByteOrder, orientation int) []byte {
+	encode := func(width, height int) []byte {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	small, big := encode(16, 12), encode(64, 48)
+	lossless := append([]byte{0xff, 0xd8, 0xff, 0xc3}, make([]byte, len(big)+100)...)
+
+	const ifd0, ifd1, sub, data = 8, 62, 104, 146
+	smallAt, bigAt, losslessAt := data, data+len(small), data+len(small)+len(big)
+
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	write := func(v interface{}) { binary.Write(&buf, order, v) }
+	entry := func(tag, kind uint16, value int) {
+		write(tag)
+		write(kind)
+		write(uint32(1))
+		if kind == 3 {
+			write(uint16(value))
+			write(uint16(0))
+		} else {
+			write(uint32(value))
+		}
+	}
+	write(uint16(42))
+	write(uint32(ifd0))
+
+	write(uint16(4))
+	entry(TIFF_ORIENTATION, 3, orientation)
+	entry(TIFF_SUB_IFDS, 13, sub)
+	entry(TIFF_JPEG_OFFSET, 4, smallAt)
+	entry(TIFF_JPEG_LENGTH, 4, len(small))
+	write(uint32(ifd1))
+
+	write(uint16(3))
+	entry(TIFF_COMPRESSION, 3, TIFF_OJPEG)
+	entry(TIFF_STRIP_OFFSETS, 4, losslessAt)
+	entry(TIFF_STRIP_BYTE_COUNTS, 4, len(lossless))
+	write(uint32(0))
+
+	write(uint16(3))
+	entry(TIFF_COMPRESSION, 3, TIFF_JPEG)
+	entry(TIFF_STRIP_OFFSETS, 4, bigAt)
+	entry(TIFF_STRIP_BYTE_COUNTS, 4, len(big))
+	write(uint32(0))
+
+	if buf.Len() != data {
+		t.Fatalf("Expecting the previews at %d, was %d", data, buf.Len())
+	}
+	buf.Write(small)
+	buf.Write(big)
+	buf.Write(lossless)
+	return buf.Bytes()
+}
+
+func TestDecodeRaw(t *testing.T) {
+	dir := t.TempDir()
+	tiff := filepath.Join(dir, "plain.dng")
+	if err := imaging.Save(image.NewRGBA(image.Rect(0, 0, 20, 10)), filepath.Join(dir, "plain.tif")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "plain.tif"), tiff); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name        string
+		order       binary.ByteOrder
+		orientation int
+		wantWidth   int
+		wantHeight  int
+	}{
+		{"le.cr2", binary.LittleEndian, 1, 64, 48},
+		{"be.nef", binary.BigEndian, 1, 64, 48},
+		{"portrait.arw", binary.LittleEndian, 6, 48, 64},
+		{"none.dng", binary.BigEndian, 0, 64, 48},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, test.name)
+		if err := os.WriteFile(filename, makeRaw(t, test.order, test.orientation), 0664); err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeRaw(filename, "")
+		if err != nil {
+			t.Errorf("decodeRaw(%s): %v", test.name, err)
+			continue
+		}
+		if img.Bounds().Dx() != test.wantWidth || img.Bounds().Dy() != test.wantHeight {
+			t.Errorf("decodeRaw(%s): expecting %dx%d, was %v", test.name, test.wantWidth, test.wantHeight, img.Bounds())
+		}
+	}
+
+	if img, err := decodeRaw(tiff, ""); err != nil || img.Bounds().Dx() != 20 {
+		t.Errorf("Expecting a TIFF without a preview to be opened as is, was %v", err)
+	}
+	junk := filepath.Join(dir, "junk.cr2")
+	os.WriteFile(junk, []byte("II*\x00\xff\xff\xff\x7f"), 0664)
+	if _, err := decodeRaw(junk, ""); err == nil {
+		t.Error("Expecting an error without a preview")
+	}
+}
+
+func TestRawFiles(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	raw := makeRaw(t, binary.LittleEndian, 1)
+	for _, name := range []string{"Bob_and_Jenny.CR2", "solo.NEF"} {
+		if err := os.WriteFile(filepath.Join(source, name), raw, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if strings.Contains(page, "tn__Bob_and_Jenny.CR2") || !strings.Contains(page, "tn__Bob_and_Jenny.jpg") || !strings.Contains(page, "tn__solo.NEF") {
+		t.Errorf("Expecting the CR2 to go with its jpeg and the NEF on its own, was %s", page)
+	}
+
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/640x480_Bob_and_Jenny.jpg", nil)).Body.String()
+	if !strings.Contains(page, `<a href="/test/albums/Bob_and_Jenny.CR2" download>RAW available</a>`) {
+		t.Errorf("Expecting a link to the raw file, was %s", page)
+	}
+	if page := serve(a, httptest.NewRequest("GET", "/test/albums/640x480_solo.NEF", nil)).Body.String(); strings.Contains(page, "RAW available") {
+		t.Errorf("Expecting no raw link for a raw file, was %s", page)
+	}
+
+	rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/tn__solo.NEF", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expecting a jpeg thumbnail of the NEF, was %d %v", rec.Code, rec.Header())
+	}
+	if img, err := imaging.Decode(rec.Body); err != nil || img.Bounds().Dx() != 50 {
+		t.Errorf("Expecting a thumbnail 50 wide, was %v", err)
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/test/albums/Bob_and_Jenny.CR2", nil)); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), raw) {
+		t.Errorf("Expecting the raw file to download, was %d", rec.Code)
+	}
+
+	var media ApiMedia
+	if err := json.Unmarshal(serve(a, httptest.NewRequest("GET", "/api/v1/test/media/Bob_and_Jenny.jpg", nil)).Body.Bytes(), &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.RawUrl != "/test/albums/Bob_and_Jenny.CR2" {
+		t.Errorf("Expecting the rawUrl in the api, was %q", media.RawUrl)
+	}
+}
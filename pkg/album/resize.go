@@ -0,0 +1,161 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	FINAL_WIDTH_PARAM   = "w"
+	DEFAULT_FINAL_WIDTH = 1920
+	ACCEPT_CH           = "Sec-CH-Viewport-Width, Sec-CH-DPR, Viewport-Width, DPR"
+)
+
+// Widths an image can be resized to when allowFinalResize is on, anything asked for is
+// rounded up to one of these so the thumbDir doesn't fill with every possible width
+var finalWidths = []int{480, 640, 800, 1024, 1280, 1440, 1920, 2560, 3840}
+
+// Rounds width up to the nearest of the finalWidths
+func SnapWidth(width int) int {
+	for _, finalWidth := range finalWidths {
+		if width <= finalWidth {
+			return finalWidth
+		}
+	}
+	return finalWidths[len(finalWidths)-1]
+}
+
+// Width of the browser's screen in device pixels from the client hints, 0 if there weren't any
+func hintedWidth(req *http.Request) int {
+	viewportWidth := hintValue(req, "Sec-CH-Viewport-Width", "Viewport-Width")
+	if viewportWidth <= 0 {
+		return 0
+	}
+	dpr := hintValue(req, "Sec-CH-DPR", "DPR")
+	if dpr <= 0 {
+		dpr = 1
+	}
+	return int(viewportWidth * dpr)
+}
+
+func hintValue(req *http.Request, names ...string) float64 {
+	for _, name := range names {
+		if value, err := strconv.ParseFloat(req.Header.Get(name), 64); err == nil {
+			return value
+		}
+	}
+	return 0
+}
+
+// Where an image resized to width is cached, next to its other variants in thumbDir
+func finalResizeFilename(pathInfo string, width int) string {
+	return path.Join(path.Dir(pathInfo), fmt.Sprintf("%dw_%s", width, path.Base(pathInfo)))
+}
+
+// Link to name in the current directory resized to the screen
+func (t TemplateSource) FinalUrl(name string) string {
+	width := t.FinalWidth
+	if width == 0 {
+		width = DEFAULT_FINAL_WIDTH
+	}
+	return t.versioned(fmt.Sprintf("%s/%s?%s=%d", t.ThumbsRootFor(t.BasePath), path.Join(t.currentDir(), name), FINAL_WIDTH_PARAM, width), name)
+}
+
+// Every final resize width of name as a srcset, so the browser can pick one for its screen
+func (t TemplateSource) FinalSrcset(name string) string {
+	return t.finalSrcset(name, 0)
+}
+
+func (t TemplateSource) finalSrcset(name string, above int) string {
+	link := t.ThumbsRootFor(t.BasePath) + "/" + path.Join(t.currentDir(), name)
+	var srcset []string
+	for _, width := range finalWidths {
+		if width > above {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", srcsetUrl(t.versioned(fmt.Sprintf("%s?%s=%d", link, FINAL_WIDTH_PARAM, width), name)), width))
+		}
+	}
+	return strings.Join(srcset, ", ")
+}
+
+// Serves /<album>/thumbs/<path>?w=<width>, the image at pathInfo no wider than width
+// after it's snapped to one of the finalWidths
+func (a *Album) handleFinalResize(w http.ResponseWriter, req *http.Request, appConfig *AppConfig, albumConfig AlbumConfig, config Config, pathInfo string, public bool) {
+	albumDir := filepath.Join(appConfig.AlbumsDir, albumConfig.AlbumDir)
+	if !config.IsImageFile(pathInfo) {
+		config = withDirTypes(config, albumDir, path.Dir(pathInfo))
+	}
+	allowed := config.AllowFinalResize
+	if dirConfig, err := LoadConfigFile(filepath.Join(albumDir, filepath.FromSlash(path.Clean("/"+path.Dir(pathInfo))), CONFIG_FILENAME)); err == nil {
+		// The pages of a directory whose config.yaml turns it on link to resized images
+		allowed = allowed || dirConfig.AllowFinalResize
+	}
+	if !allowed || !config.IsImageFile(pathInfo) {
+		http.NotFound(w, req)
+		return
+	}
+	width, err := strconv.Atoi(req.URL.Query().Get(FINAL_WIDTH_PARAM))
+	if err != nil || width <= 0 {
+		http.Error(w, "Bad width", http.StatusBadRequest)
+		return
+	}
+	width = SnapWidth(width)
+
+	thumbDir := filepath.Join(appConfig.AlbumsDir, albumConfig.ThumbDir)
+	fullFilename, err := ResolvePath(thumbDir, finalResizeFilename(pathInfo, width), albumConfig.FollowSymlinks)
+	if err != nil {
+		a.pathError(w, pathInfo, err)
+		return
+	}
+	source, err := ResolvePath(albumDir, pathInfo, albumConfig.FollowSymlinks)
+	if err != nil {
+		a.pathError(w, pathInfo, err)
+		return
+	}
+	sourceStat, err := os.Stat(source)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	version := thumbnailVersion(config, sourceStat)
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(path.Dir(pathInfo)), INFO_FILENAME)
+	if stat, err := os.Stat(fullFilename); err != nil || stat.ModTime().Before(sourceStat.ModTime()) || !a.thumbnailMadeWith(infoFilename, fullFilename, version) {
+		rendition, err := ResolvePath(thumbDir, heifRendition(pathInfo), albumConfig.FollowSymlinks)
+		if err != nil {
+			a.pathError(w, pathInfo, err)
+			return
+		}
+		mediaType := config.DetectMediaType(source)
+		if mediaType == nil || mediaType.Kind() != MEDIA_IMAGE {
+			http.NotFound(w, req)
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(fullFilename), 0775); err != nil {
+			a.logger.Printf("Error creating directory %s:%v\n", filepath.Dir(fullFilename), err)
+		}
+
+		// Never make an image bigger than it was
+		opts := ThumbnailOptions{Width: width, Quality: config.GetThumbnailQuality(), Rendition: rendition, NoUpscale: true}
+		if err := mediaType.Thumbnail(source, fullFilename, opts); err != nil {
+			a.logger.Printf("Error making %s from %s: %v\n", fullFilename, source, err)
+			http.NotFound(w, req)
+			return
+		}
+		a.saveThumbnailVersion(thumbDir, pathInfo, source, fullFilename, version)
+	}
+
+	w.Header().Set("Cache-Control", cacheControl(public, req.URL.Query().Get(VERSION_PARAM) == version))
+	a.serveThumbnail(w, req, config, fullFilename, version)
+}
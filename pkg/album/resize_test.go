@@ -0,0 +1,149 @@
+package album
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestSnapWidth(t *testing.T) {
+	var tests = []struct {
+		width int
+		want  int
+	}{
+		{1, 480},
+		{480, 480},
+		{481, 640},
+		{1400, 1440},
+		{3840, 3840},
+		{100000, 3840},
+	}
+	for _, test := range tests {
+		if got := SnapWidth(test.width); got != test.want {
+			t.Errorf("SnapWidth(%d): expecting %d, was %d", test.width, test.want, got)
+		}
+	}
+}
+
+func TestFinalResize(t *testing.T) {
+	a := setupTestAlbum(t)
+	if err := imaging.Save(image.NewRGBA(image.Rect(0, 0, 2000, 1500)), filepath.Join(a.appConfig.AlbumsDir, "source", "big.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["resize"] = AlbumConfig{AlbumTitle: "Resize", AlbumDir: "source", ThumbDir: "thumbs", Config: Config{AllowFinalResize: true}}
+	a.albumsConfig = albumsConfig
+	if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, "source/2020/(01)January", CONFIG_FILENAME), []byte("allowFinalResize: true\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		url        string
+		wantStatus int
+		wantFile   string
+		wantWidth  int
+	}{
+		{"/resize/thumbs/big.jpg?w=1000", http.StatusOK, "thumbs/1024w_big.jpg", 1024},
+		{"/resize/thumbs/big.jpg?w=9999", http.StatusOK, "thumbs/3840w_big.jpg", 2000},
+		{"/resize/thumbs/Bob_and_Jenny.jpg?w=600", http.StatusOK, "thumbs/640w_Bob_and_Jenny.jpg", 64},
+		{"/resize/thumbs/big.jpg?w=wide", http.StatusBadRequest, "", 0},
+		{"/resize/thumbs/big.jpg?w=-5", http.StatusBadRequest, "", 0},
+		{"/resize/thumbs/movie.avi?w=800", http.StatusNotFound, "", 0},
+		{"/resize/thumbs/missing.jpg?w=800", http.StatusNotFound, "", 0},
+		{"/test/thumbs/big.jpg?w=800", http.StatusNotFound, "", 0},
+		{"/test/thumbs/2020/(01)January/party.jpg?w=800", http.StatusOK, "thumbs/2020/(01)January/800w_party.jpg", 64},
+	}
+	for _, test := range tests {
+		rec := serve(a, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if test.wantFile == "" {
+			continue
+		}
+		img, err := imaging.Open(filepath.Join(a.appConfig.AlbumsDir, test.wantFile))
+		if err != nil {
+			t.Errorf("GET %s: expecting %s to be cached: %v", test.url, test.wantFile, err)
+			continue
+		}
+		if img.Bounds().Dx() != test.wantWidth {
+			t.Errorf("GET %s: expecting width %d, was %d", test.url, test.wantWidth, img.Bounds().Dx())
+		}
+	}
+
+	// The links on the pages of the directory whose config.yaml turned it on
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/2020/(01)January/1024x768_party.jpg", nil)).Body.String()
+	if !strings.Contains(page, "/test/thumbs/2020/%2801%29January/party.jpg?w=") {
+		t.Errorf("Expecting resized images on the page, was %s", page)
+	}
+}
+
+func TestFinalResizePage(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["resize"] = AlbumConfig{AlbumTitle: "Resize", AlbumDir: "source", ThumbDir: "thumbs", Config: Config{AllowFinalResize: true}}
+	a.albumsConfig = albumsConfig
+
+	var tests = []struct {
+		url      string
+		hints    map[string]string
+		wantBody string
+		notBody  string
+	}{
+		{"/resize/albums/Bob_and_Jenny.jpg?slide_show=full", nil, `src="/resize/thumbs/Bob_and_Jenny.jpg?w=1920&amp;v=`, ""},
+		{"/resize/albums/Bob_and_Jenny.jpg?slide_show=full", map[string]string{"Sec-CH-Viewport-Width": "700", "Sec-CH-DPR": "2"}, `src="/resize/thumbs/Bob_and_Jenny.jpg?w=1440&amp;v=`, ""},
+		{"/resize/albums/Bob_and_Jenny.jpg?slide_show=full", map[string]string{"Viewport-Width": "390"}, `srcset="/resize/thumbs/Bob_and_Jenny.jpg?w=480&amp;v=`, ""},
+		{"/resize/albums/1024x768_Bob_and_Jenny.jpg", nil, `/resize/thumbs/Bob_and_Jenny.jpg?w=3840&amp;v=`, ""},
+		{"/test/albums/1024x768_Bob_and_Jenny.jpg", nil, `srcset=`, "?w="},
+		{"/test/albums/Bob_and_Jenny.jpg?slide_show=full", map[string]string{"Sec-CH-Viewport-Width": "700"}, `src="/test/thumbs/./Bob_and_Jenny.jpg"`, "?w="},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		for name, value := range test.hints {
+			req.Header.Set(name, value)
+		}
+		rec := serve(a, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expecting status 200, was %d", test.url, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s %v: expecting body to contain %s, was %s", test.url, test.hints, test.wantBody, rec.Body.String())
+		}
+		if test.notBody != "" && strings.Contains(rec.Body.String(), test.notBody) {
+			t.Errorf("GET %s: expecting body not to contain %s", test.url, test.notBody)
+		}
+		if wantAcceptCh := strings.HasPrefix(test.url, "/resize/"); (rec.Header().Get("Accept-CH") != "") != wantAcceptCh {
+			t.Errorf("GET %s: expecting Accept-CH %v, was %q", test.url, wantAcceptCh, rec.Header().Get("Accept-CH"))
+		}
+	}
+	// A browser whose screen changed gets the page again rather than a 304
+	req := httptest.NewRequest("GET", "/resize/albums/Bob_and_Jenny.jpg?slide_show=full", nil)
+	req.Header.Set("Sec-CH-Viewport-Width", "390")
+	rec := serve(a, req)
+	if !strings.Contains(rec.Header().Get("Vary"), "Sec-CH-Viewport-Width") {
+		t.Errorf("Expecting the page to vary by the hints, was %q", rec.Header().Get("Vary"))
+	}
+	for _, test := range []struct {
+		width string
+		want  int
+	}{{"390", http.StatusNotModified}, {"2000", http.StatusOK}} {
+		req = httptest.NewRequest("GET", "/resize/albums/Bob_and_Jenny.jpg?slide_show=full", nil)
+		req.Header.Set("Sec-CH-Viewport-Width", test.width)
+		req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+		if got := serve(a, req).Code; got != test.want {
+			t.Errorf("Width %s: expecting %d, was %d", test.width, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrBadPath     = errors.New("bad path")
+	ErrSymlink     = errors.New("path goes through a symlink")
+	ErrPathEscapes = errors.New("path escapes its directory")
+)
+
+// Maps pathInfo, a slash separated path from a url, to a file under root.  ".." and
+// absolute components are refused outright, and whatever part of the path already
+// exists has to really be inside root once symlinks are evaluated.  Symlinks are only
+// followed when followSymlinks is set.  The file itself, or even root, doesn't have to
+// exist yet.
+func ResolvePath(root, pathInfo string, followSymlinks bool) (string, error) {
+	if strings.HasPrefix(pathInfo, "/") || strings.ContainsAny(pathInfo, "\\\x00") {
+		return "", ErrBadPath
+	}
+	elems := []string{root}
+	for _, elem := range strings.Split(pathInfo, "/") {
+		switch {
+		case elem == "" || elem == ".":
+			continue
+		case elem == ".." || filepath.VolumeName(elem) != "":
+			return "", ErrBadPath
+		}
+		elems = append(elems, elem)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// Nothing under it exists yet either, ie a thumbDir before any thumbnails are made
+		return filepath.Join(elems...), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	current := realRoot
+	for _, elem := range elems[1:] {
+		next := filepath.Join(current, elem)
+		stat, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			if !followSymlinks {
+				return "", ErrSymlink
+			}
+			// A dangling link is refused too, writing through it could land anywhere
+			if next, err = filepath.EvalSymlinks(next); err != nil {
+				return "", ErrPathEscapes
+			}
+			if !isWithin(realRoot, next) {
+				return "", ErrPathEscapes
+			}
+		}
+		current = next
+	}
+	return filepath.Join(elems...), nil
+}
+
+func isWithin(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// A %2F or %5C in the url would otherwise be decoded into a separator inside one path element
+func hasEncodedSeparator(u *url.URL) bool {
+	raw := strings.ToLower(u.EscapedPath())
+	return strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c")
+}
+
+func (a *Album) pathError(w http.ResponseWriter, pathInfo string, err error) {
+	a.logger.Printf("Refusing path %q: %v\n", pathInfo, err)
+	if errors.Is(err, ErrBadPath) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "404 page not found", http.StatusNotFound)
+}
@@ -0,0 +1,167 @@
+package album
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Links source/inside to a directory in the album and source/escape, source/dangling
+// and thumbs/escape to outside of it.  Returns the outside directory.
+func setupSymlinks(t testing.TB, a *Album) string {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.jpg"), []byte("TOPSECRET"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"source/inside":   filepath.Join(a.appConfig.AlbumsDir, "source/2020"),
+		"source/escape":   outside,
+		"source/dangling": filepath.Join(outside, "missing"),
+		"thumbs/escape":   outside,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(a.appConfig.AlbumsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return outside
+}
+
+func TestResolvePath(t *testing.T) {
+	a := setupTestAlbum(t)
+	setupSymlinks(t, a)
+	root := filepath.Join(a.appConfig.AlbumsDir, "source")
+
+	tests := []struct {
+		pathInfo       string
+		followSymlinks bool
+		want           string
+		err            error
+	}{
+		{"", false, root, nil},
+		{"2020/(01)January/party.jpg", false, filepath.Join(root, "2020/(01)January/party.jpg"), nil},
+		{"2020//./(01)January/", false, filepath.Join(root, "2020/(01)January"), nil},
+		{"2020/missing/new.jpg", false, filepath.Join(root, "2020/missing/new.jpg"), nil},
+		{"../albumsconfig.yaml", false, "", ErrBadPath},
+		{"2020/../../albumsconfig.yaml", false, "", ErrBadPath},
+		{"/etc/passwd", false, "", ErrBadPath},
+		{"2020\\..\\x", false, "", ErrBadPath},
+		{"x\x00.jpg", false, "", ErrBadPath},
+		{"inside/(01)January/party.jpg", false, "", ErrSymlink},
+		{"inside/(01)January/party.jpg", true, filepath.Join(root, "inside/(01)January/party.jpg"), nil},
+		{"escape/secret.jpg", false, "", ErrSymlink},
+		{"escape/secret.jpg", true, "", ErrPathEscapes},
+		{"dangling/x.jpg", true, "", ErrPathEscapes},
+	}
+	for _, test := range tests {
+		got, err := ResolvePath(root, test.pathInfo, test.followSymlinks)
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("ResolvePath(%q, %v) = %q, %v, expecting %q, %v", test.pathInfo, test.followSymlinks, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestMissingThumbDir(t *testing.T) {
+	a := setupTestAlbum(t)
+	thumbDir := filepath.Join(a.appConfig.AlbumsDir, "thumbs")
+	if err := os.RemoveAll(thumbDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ResolvePath(thumbDir, "2020/tn__x.jpg", false); err != nil || got != filepath.Join(thumbDir, "2020/tn__x.jpg") {
+		t.Errorf("Expecting a path under a missing root, was %q, %v", got, err)
+	}
+	for _, url := range []string{"/test/thumbs/tn__Bob_and_Jenny.jpg", "/test/thumbs/2020/(01)January/tn__party.jpg"} {
+		if rec := serve(a, httptest.NewRequest("GET", url, nil)); rec.Code != 200 {
+			t.Errorf("%s: expecting the thumbnail to be made, got %d", url, rec.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(thumbDir, "tn__Bob_and_Jenny.jpg")); err != nil {
+		t.Errorf("Expecting thumbDir to be made again, %v", err)
+	}
+}
+
+func TestSymlinkRequests(t *testing.T) {
+	a := setupTestAlbum(t)
+	setupSymlinks(t, a)
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/test/albums/escape/secret.jpg", 404},
+		{"/test/albums/escape/", 404},
+		{"/test/thumbs/escape/secret.jpg", 404},
+		{"/test/thumbs/escape/tn__x.jpg", 404},
+		{"/test/albums/inside/", 404},
+		{"/test/albums/2020%2F..%2F..%2Falbumsconfig.yaml", 400},
+		{"/test/albums/../albumsconfig.yaml", 400},
+		{"/test/albums/2020/", 200},
+	}
+	for _, test := range tests {
+		if rec := serve(a, httptest.NewRequest("GET", test.url, nil)); rec.Code != test.status {
+			t.Errorf("%s: expecting %d, got %d", test.url, test.status, rec.Code)
+		}
+	}
+
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["test"] = AlbumConfig{AlbumTitle: "Test Album", AlbumDir: "source", ThumbDir: "thumbs", FollowSymlinks: true}
+	a.albumsConfig = albumsConfig
+	if rec := serve(a, httptest.NewRequest("GET", "/test/albums/inside/(01)January/party.jpg", nil)); rec.Code != 200 {
+		t.Errorf("Expecting a symlink inside the album to be followed, got %d", rec.Code)
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/test/albums/escape/secret.jpg", nil)); rec.Code != 404 {
+		t.Errorf("Expecting a symlink out of the album to be refused, got %d", rec.Code)
+	}
+}
+
+func FuzzHandleGet(f *testing.F) {
+	a := setupTestAlbum(f)
+	outside := setupSymlinks(f, a)
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		f.Fatal(err)
+	}
+	a.albumsConfig = albumsConfig
+	a.albumsConfig.Albums["follow"] = AlbumConfig{AlbumTitle: "Follow", AlbumDir: "source", ThumbDir: "thumbs", FollowSymlinks: true}
+
+	for _, seed := range []string{
+		"/test/albums/2020/(01)January/party.jpg",
+		"/test/thumbs/2020/(01)January/tn__party.jpg",
+		"/test/albums/escape/secret.jpg",
+		"/follow/albums/escape/secret.jpg",
+		"/follow/thumbs/escape/tn__secret.jpg",
+		"/follow/albums/dangling/x.jpg",
+		"/follow/thumbs/dangling/tn__x.jpg",
+		"/test/albums/../../secret.jpg",
+		"/test/thumbs/..%2F..%2Fsecret.jpg",
+		"/test/albums//etc/passwd",
+		"/api/v1/follow/media/escape/secret.jpg",
+		"/api/v1/follow/tree/escape/",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rawPath string) {
+		u, err := url.Parse(rawPath)
+		if err != nil || !strings.HasPrefix(u.Path, "/") {
+			t.Skip()
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL = u
+		rec := serve(a, req)
+		if strings.Contains(rec.Body.String(), "TOPSECRET") {
+			t.Fatalf("%s leaked a file outside the album", rawPath)
+		}
+		entries, err := os.ReadDir(outside)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s wrote outside the album: %v", rawPath, entries)
+		}
+	})
+}
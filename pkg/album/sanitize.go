@@ -0,0 +1,66 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	CAPTION_TRUSTED = "trusted"
+	CAPTION_BASIC   = "basic"
+	CAPTION_TEXT    = "text"
+)
+
+var (
+	basicTag      = regexp.MustCompile(`(?i)&lt;(/?)(b|i|u|em|strong|small|big|sub|sup|br|p|hr|center|h[1-6]|ul|ol|li|blockquote)\s*/?&gt;`)
+	basicLinkOpen = regexp.MustCompile(`(?i)&lt;a\s+href\s*=\s*(?:&#34;|&#39;)((?:[^&]|&amp;)*)(?:&#34;|&#39;)\s*&gt;`)
+	basicLinkEnd  = regexp.MustCompile(`(?i)&lt;/a\s*&gt;`)
+)
+
+// caption.txt header html and captions are the only html a page takes as is.  How far
+// they are trusted is up to the album's captionPolicy: trusted (the default) passes them
+// through, basic keeps simple formatting tags and http links, text escapes everything.
+func SanitizeHtml(policy, s string) template.HTML {
+	switch policy {
+	case "", CAPTION_TRUSTED:
+		return template.HTML(s)
+	case CAPTION_BASIC:
+		return template.HTML(sanitizeBasic(s))
+	}
+	return template.HTML(html.EscapeString(s))
+}
+
+// Escapes everything and then turns the escaped forms of the allowed tags back into
+// tags.  Tags come back without attributes apart from the href of a link.
+func sanitizeBasic(s string) string {
+	s = html.EscapeString(s)
+	s = basicTag.ReplaceAllString(s, "<$1$2>")
+	s = basicLinkOpen.ReplaceAllStringFunc(s, func(tag string) string {
+		href := html.UnescapeString(basicLinkOpen.FindStringSubmatch(tag)[1])
+		u, err := url.Parse(href)
+		if err != nil {
+			return tag
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "", "http", "https", "mailto":
+			return `<a href="` + html.EscapeString(u.String()) + `">`
+		}
+		return tag
+	})
+	return basicLinkEnd.ReplaceAllString(s, "</a>")
+}
+
+func (t TemplateSource) trustedHtml(s string) template.HTML {
+	return SanitizeHtml(t.AlbumConfig.CaptionPolicy, s)
+}
@@ -0,0 +1,28 @@
+package album
+
+import "testing"
+
+func TestSanitizeHtml(t *testing.T) {
+	var tests = []struct {
+		policy string
+		html   string
+		want   string
+	}{
+		{"", "<b onclick=x()>Hi</b>", "<b onclick=x()>Hi</b>"},
+		{CAPTION_TRUSTED, "<script>x()</script>", "<script>x()</script>"},
+		{CAPTION_BASIC, "<B>Bold</B> <br/> <em>&amp;</em>", "<B>Bold</B> <br> <em>&amp;amp;</em>"},
+		{CAPTION_BASIC, "<b onclick=x()>Hi</b>", "&lt;b onclick=x()&gt;Hi</b>"},
+		{CAPTION_BASIC, `<a href="https://example.com/?a=1&b=2">link</a>`, `<a href="https://example.com/?a=1&amp;b=2">link</a>`},
+		{CAPTION_BASIC, `<a href='../2020/'>up</a>`, `<a href="../2020/">up</a>`},
+		{CAPTION_BASIC, `<a href="javascript:x()">bad</a>`, `&lt;a href=&#34;javascript:x()&#34;&gt;bad</a>`},
+		{CAPTION_BASIC, `<a href="x" onclick="y">bad</a>`, `&lt;a href=&#34;x&#34; onclick=&#34;y&#34;&gt;bad</a>`},
+		{CAPTION_BASIC, "<img src=x onerror=y()>", "&lt;img src=x onerror=y()&gt;"},
+		{CAPTION_TEXT, "<b>Hi</b>", "&lt;b&gt;Hi&lt;/b&gt;"},
+		{"unknown", "<b>Hi</b>", "&lt;b&gt;Hi&lt;/b&gt;"},
+	}
+	for _, test := range tests {
+		if got := string(SanitizeHtml(test.policy, test.html)); got != test.want {
+			t.Errorf("SanitizeHtml(%q, %q) = %q, expecting %q", test.policy, test.html, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REVOKED_SHARES_FILENAME = "revokedshares.txt"
+
+	// Form field the /shares page posts back its token in
+	CSRF_FIELD = "csrf"
+)
+
+var (
+	ErrShareInvalid = errors.New("invalid share link")
+	ErrShareExpired = errors.New("share link has expired")
+	ErrShareRevoked = errors.New("share link has been revoked")
+	ErrNoShareKey   = errors.New("share links need shares.key or auth.sessionKey to be set")
+)
+
+type ShareConfig struct {
+	Key         string `yaml:"key"`
+	RevokedFile string `yaml:"revokedFile"`
+}
+
+// A share link grants anyone holding the token access to Path and everything below it
+// in Album until Expires.  Originals of images can only be fetched when Download is set.
+type Share struct {
+	Id       string `json:"i"`
+	Album    string `json:"a"`
+	Path     string `json:"p"`
+	Expires  int64  `json:"e"`
+	Download bool   `json:"d,omitempty"`
+	Token    string `json:"-"`
+}
+
+func (s ShareConfig) String() string {
+	return fmt.Sprintf("ShareConfig:{RevokedFile:%s}", s.RevokedFile)
+}
+
+func (s Share) String() string {
+	return fmt.Sprintf("Share:{Id:%s,Album:%s,Path:%s,Expires:%v,Download:%v}", s.Id, s.Album, s.Path, time.Unix(s.Expires, 0), s.Download)
+}
+
+// Whether relPath, relative to the top of the album, is the shared directory or below it
+func (s Share) Contains(relPath string) bool {
+	relPath = strings.Trim(path.Clean("/"+relPath), "/")
+	return s.Path == "" || relPath == s.Path || strings.HasPrefix(relPath, s.Path+"/")
+}
+
+// Mints a signed token for dir in album, nothing is stored on the server
+func (a *Album) NewShare(albumsConfig *AlbumsConfig, album, dir string, expires time.Time, download bool) (*Share, error) {
+	key := shareKey(albumsConfig)
+	if key == nil {
+		return nil, ErrNoShareKey
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		Id:       hex.EncodeToString(id),
+		Album:    album,
+		Path:     strings.Trim(path.Clean("/"+dir), "/"),
+		Expires:  expires.Unix(),
+		Download: download,
+	}
+	payload, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	share.Token = encoded + "." + signShare(key, encoded)
+	return share, nil
+}
+
+func (a *Album) parseShare(appConfig *AppConfig, albumsConfig *AlbumsConfig, token string) (*Share, error) {
+	key := shareKey(albumsConfig)
+	i := strings.LastIndex(token, ".")
+	if key == nil || i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(signShare(key, token[:i]))) {
+		return nil, ErrShareInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, ErrShareInvalid
+	}
+	var share Share
+	if err := json.Unmarshal(payload, &share); err != nil {
+		return nil, ErrShareInvalid
+	}
+	share.Token = token
+
+	if time.Now().Unix() > share.Expires {
+		return nil, ErrShareExpired
+	}
+	revoked, err := loadRevokedShares(appConfig, albumsConfig.Shares)
+	if err != nil {
+		a.logger.Printf("Error loading revoked shares: %v\n", err)
+		return nil, ErrShareRevoked
+	}
+	if revoked[share.Id] {
+		return nil, ErrShareRevoked
+	}
+	return &share, nil
+}
+
+// Share tokens are signed with shares.key, falling back to auth.sessionKey, nil when neither
+// is set.  Unlike a login a link can't be handed out again, so they're never signed with a
+// key made up when the server starts that's gone when it restarts.
+func shareKey(albumsConfig *AlbumsConfig) []byte {
+	if albumsConfig.Shares.Key != "" {
+		return []byte(albumsConfig.Shares.Key)
+	}
+	if albumsConfig.Auth.SessionKey != "" {
+		return []byte(albumsConfig.Auth.SessionKey)
+	}
+	return nil
+}
+
+func signShare(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("share:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func revokedSharesFilename(appConfig *AppConfig, shareConfig ShareConfig) string {
+	filename := shareConfig.RevokedFile
+	if filename == "" {
+		filename = REVOKED_SHARES_FILENAME
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(appConfig.AlbumsDir, filename)
+	}
+	return filename
+}
+
+// The revocation list is one share id per line, anything after the id is a comment
+func loadRevokedShares(appConfig *AppConfig, shareConfig ShareConfig) (map[string]bool, error) {
+	revoked := make(map[string]bool)
+	in, err := os.Open(revokedSharesFilename(appConfig, shareConfig))
+	if os.IsNotExist(err) {
+		return revoked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			revoked[fields[0]] = true
+		}
+	}
+	return revoked, scanner.Err()
+}
+
+func RevokeShare(appConfig *AppConfig, shareConfig ShareConfig, id, note string) error {
+	out, err := os.OpenFile(revokedSharesFilename(appConfig, shareConfig), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s %s\n", id, note)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Admins mint and revoke share links at /shares
+func (a *Album) handleShares(w http.ResponseWriter, req *http.Request, tmplSource TemplateSource) {
+	if !tmplSource.AlbumsConfig.Auth.IsAdmin(tmplSource.User) {
+		a.denyAccess(w, req, tmplSource, true)
+		return
+	}
+
+	tmplSource.Current = tmplSource.AlbumsConfig.Default
+	tmplSource.PageTitle = "Share Links"
+	data := &tmplSource.Shares
+	data.Csrf = a.csrfToken(tmplSource)
+	for key := range tmplSource.AlbumsConfig.Albums {
+		data.Albums = append(data.Albums, key)
+	}
+	sort.Strings(data.Albums)
+
+	status := http.StatusOK
+	if req.Method == "POST" {
+		// With basicAuth a browser sends the credentials with a form posted from any site,
+		// so only forms from this page are taken
+		if !hmac.Equal([]byte(req.PostFormValue(CSRF_FIELD)), []byte(data.Csrf)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var err error
+		switch req.PostFormValue("action") {
+		case "create":
+			data.Share, err = a.createShare(tmplSource, req)
+			if err == nil {
+				data.Link = fmt.Sprintf("%s://%s%s/", scheme(req), req.Host, tmplSource.shareRoot(data.Share.Album, data.Share.Token))
+				if data.Share.Path != "" {
+					data.Link += data.Share.Path + "/"
+				}
+				a.logger.Printf("%s shared %s\n", tmplSource.User.Name, data.Share)
+			}
+		case "revoke":
+			id := strings.TrimSpace(req.PostFormValue("id"))
+			if share, parseErr := a.parseShare(tmplSource.AppConfig, tmplSource.AlbumsConfig, id); parseErr == nil {
+				// Let a whole link or token be pasted in as well as the id
+				id = share.Id
+			}
+			if id == "" || strings.ContainsAny(id, " \t\r\n") {
+				err = fmt.Errorf("expecting a share id")
+			} else if err = RevokeShare(tmplSource.AppConfig, tmplSource.AlbumsConfig.Shares, id, "revoked by "+tmplSource.User.Name); err == nil {
+				data.Message = fmt.Sprintf("Revoked %s", id)
+				a.logger.Printf("%s revoked share %s\n", tmplSource.User.Name, id)
+			}
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			data.Message = err.Error()
+			status = http.StatusBadRequest
+		}
+	}
+	a.renderStatus(w, req, tmplSource, "shares.html", status)
+}
+
+// The token the forms of the /shares page are posted with, tied to the user and signed like
+// their session
+func (a *Album) csrfToken(tmplSource TemplateSource) string {
+	return a.sign(tmplSource.AlbumsConfig.Auth, "csrf|"+tmplSource.User.Name)
+}
+
+func (a *Album) createShare(tmplSource TemplateSource, req *http.Request) (*Share, error) {
+	key := req.PostFormValue("album")
+	albumConfig, ok := tmplSource.AlbumsConfig.Albums[key]
+	if !ok {
+		return nil, fmt.Errorf("no such album: %s", key)
+	}
+
+	dir := strings.Trim(path.Clean("/"+req.PostFormValue("path")), "/")
+	stat, err := os.Stat(filepath.Join(tmplSource.AppConfig.AlbumsDir, albumConfig.AlbumDir, dir))
+	if err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("no such directory: %s", dir)
+	}
+
+	days, err := strconv.Atoi(req.PostFormValue("days"))
+	if err != nil || days < 1 {
+		return nil, fmt.Errorf("expecting a number of days")
+	}
+	return a.NewShare(tmplSource.AlbumsConfig, key, dir, time.Now().AddDate(0, 0, days), req.PostFormValue("download") != "")
+}
+
+// Where links inside a share start, the token is carried in the path so relative links keep it
+func (t TemplateSource) shareRoot(key, token string) string {
+	if t.HostConfig != nil && t.HostConfig.Album == key {
+		return t.Prefix + "/share/" + token
+	}
+	return t.Prefix + "/" + key + "/share/" + token
+}
+
+// Whether originals may be served, only a share without download permission says no
+func (t TemplateSource) CanDownload() bool {
+	return t.Share == nil || t.Share.Download
+}
+
+func scheme(req *http.Request) string {
+	if isSecure(req) {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,129 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShare(t *testing.T, a *Album, dir string, expires time.Time, download bool) *Share {
+	share, err := a.NewShare(a.albumsConfig, "family", dir, expires, download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestShareAccess(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+	share := newTestShare(t, a, "2020", time.Now().Add(time.Hour), false)
+	root := "/family/share/" + share.Token
+
+	rec := serve(a, httptest.NewRequest("GET", root+"/", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != root+"/2020/" {
+		t.Errorf("Expecting a redirect to the shared directory, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", root+"/2020/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), root+"/2020/%2801%29January") {
+		t.Errorf("Expecting the shared directory with links carrying the token, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", root+"/2020/(01)January/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), root+"/thumbs/2020/%2801%29January/tn__party.jpg") || strings.Contains(rec.Body.String(), "full sized") {
+		t.Errorf("Expecting thumbnails under the share and no full sized links, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{root + "/thumbs/2020/(01)January/tn__party.jpg", http.StatusOK},
+		{root + "/2020/(01)January/party.jpg", http.StatusForbidden},
+		{root + "/thumbs/2020/(01)January/party.jpg?w=1920", http.StatusForbidden},
+		{root + "/Bob_and_Jenny.jpg", http.StatusForbidden},
+		{root + "/thumbs/tn__Bob_and_Jenny.jpg", http.StatusForbidden},
+		{root + "/2020/../Bob_and_Jenny.jpg", http.StatusBadRequest},
+		{"/bobs/share/" + share.Token + "/2020/", http.StatusNotFound},
+		{"/family/share/" + share.Token[:len(share.Token)-2] + "xx/2020/", http.StatusForbidden},
+		{"/family/albums/2020/", http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		if rec := serve(a, httptest.NewRequest("GET", test.url, nil)); rec.Code != test.status {
+			t.Errorf("%s: expecting %d, got %d", test.url, test.status, rec.Code)
+		}
+	}
+
+	download := newTestShare(t, a, "2020", time.Now().Add(time.Hour), true)
+	if rec := serve(a, httptest.NewRequest("GET", "/family/share/"+download.Token+"/2020/(01)January/party.jpg", nil)); rec.Code != http.StatusOK {
+		t.Errorf("Expecting the original with download permission, got %d", rec.Code)
+	}
+}
+
+func TestShareExpiredAndRevoked(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+
+	expired := newTestShare(t, a, "2020", time.Now().Add(-time.Minute), false)
+	if rec := serve(a, httptest.NewRequest("GET", "/family/share/"+expired.Token+"/2020/", nil)); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "expired") {
+		t.Errorf("Expecting an expired share to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	share := newTestShare(t, a, "2020", time.Now().Add(time.Hour), false)
+	if err := RevokeShare(a.appConfig, a.albumsConfig.Shares, share.Id, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/family/share/"+share.Token+"/2020/", nil)); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "revoked") {
+		t.Errorf("Expecting a revoked share to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestShareAdmin(t *testing.T) {
+	a := setupAuthAlbum(t, false)
+	a.albumsConfig.Auth.Admins = []string{"bob"}
+
+	csrf := regexp.MustCompile(`(?i)name="csrf" value="([^"]+)"`)
+	post := func(form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		if token := csrf.FindStringSubmatch(serve(a, httptest.NewRequest("GET", "/shares", nil), cookies...).Body.String()); token != nil && form.Get("csrf") == "" {
+			form.Set("csrf", token[1])
+		}
+		req := httptest.NewRequest("POST", "/shares", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(a, req, cookies...)
+	}
+	create := url.Values{"action": {"create"}, "album": {"family"}, "path": {"2020"}, "days": {"7"}}
+
+	jenny := login(t, a, "jenny", "secret").Result().Cookies()
+	if rec := post(create, jenny); rec.Code != http.StatusForbidden {
+		t.Errorf("Expecting non admins to be refused, got %d", rec.Code)
+	}
+
+	bob := login(t, a, "bob", "secret").Result().Cookies()
+
+	// Forms posted from another site don't have the token, or have someone else's
+	for _, token := range []string{"", a.sign(a.albumsConfig.Auth, "csrf|jenny")} {
+		req := httptest.NewRequest("POST", "/shares", strings.NewReader(url.Values{"action": {"revoke"}, "id": {"0123456789abcdef"}, "csrf": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if rec := serve(a, req, bob...); rec.Code != http.StatusForbidden {
+			t.Errorf("Expecting a post with token %q to be refused, got %d", token, rec.Code)
+		}
+	}
+
+	rec := post(create, bob)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "http://example.com/family/share/") {
+		t.Fatalf("Expecting a share link, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := post(url.Values{"action": {"create"}, "album": {"family"}, "path": {"missing"}, "days": {"7"}}, bob); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expecting a missing directory to be refused, got %d", rec.Code)
+	}
+
+	// Links signed with a key made up at startup would stop working on a restart
+	a.albumsConfig.Shares.Key = ""
+	if rec := post(create, bob); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "shares.key") {
+		t.Errorf("Expecting links to be refused without a key, got %d %s", rec.Code, rec.Body.String())
+	}
+}
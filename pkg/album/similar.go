@@ -0,0 +1,268 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// The index of an album is kept at the top of its thumbDir under this name
+	SIMILAR_FILENAME = ".similar.json"
+
+	// How many similar photos are shown under a photo
+	SIMILAR_COUNT = 8
+
+	// Photos scoring more than this aren't alike enough to show, 0 is the same photo and
+	// 2 is as different as can be
+	MAX_SIMILAR_SCORE = 0.6
+
+	// Levels of each of red, green and blue in a color histogram
+	HISTOGRAM_LEVELS = 4
+
+	// How long after an album was indexed it's walked again for new or changed photos
+	SIMILAR_REINDEX = 5 * time.Minute
+
+	// A big album is saved as it goes so it's useful before it's finished
+	SIMILAR_SAVE_EVERY = 100
+)
+
+// What the index keeps of a photo, until its size or time changes.  Hash is its dHash in
+// hex, NO_HASH when it can't be decoded, and Histogram how much of it is each color,
+// out of 255.
+type similarPhoto struct {
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modTime"`
+	Hash      string `json:"hash"`
+	Histogram []byte `json:"histogram,omitempty"`
+}
+
+// The photos of an album by their path in it
+type similarIndex map[string]*similarPhoto
+
+// The index of an album as it was when it was last read, so it's only parsed again once
+// the background indexing has saved it
+type loadedIndex struct {
+	modTime time.Time
+	index   similarIndex
+}
+
+// An index file that's missing or can't be read is an empty one, it's only a cache
+func loadSimilarIndex(filename string) similarIndex {
+	index := make(similarIndex)
+	if contents, err := os.ReadFile(filename); err == nil {
+		json.Unmarshal(contents, &index)
+	}
+	return index
+}
+
+// Queues indexing the album of t in the background, unless it's being done or was done
+// in the last SIMILAR_REINDEX
+func (a *Album) submitSimilarIndex(t TemplateSource) {
+	thumbDir := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir)
+	a.similarLock.Lock()
+	defer a.similarLock.Unlock()
+	if indexed, ok := a.similarIndexed[thumbDir]; ok && (indexed.IsZero() || time.Since(indexed) < SIMILAR_REINDEX) {
+		return
+	}
+
+	a.similarIndexed[thumbDir] = time.Time{}
+	config := t.AlbumsConfig.Default
+	Merge(&config, &t.AlbumConfig.Config)
+	albumDir := t.baseDir()
+	a.pool.Submit(func() {
+		if err := a.updateSimilarIndex(config, albumDir, thumbDir); err != nil {
+			a.logger.Printf("Error indexing %s: %v\n", albumDir, err)
+		}
+		a.similarLock.Lock()
+		a.similarIndexed[thumbDir] = time.Now()
+		a.similarLock.Unlock()
+	})
+}
+
+// Adds the photos of the album at albumDir that are new or changed since it was last
+// indexed, from their thumbnails when they've been made, and drops the ones that are gone
+func (a *Album) updateSimilarIndex(config Config, albumDir, thumbDir string) error {
+	filename := filepath.Join(thumbDir, SIMILAR_FILENAME)
+	index := loadSimilarIndex(filename)
+	seen := make(map[string]bool)
+	changed := 0
+	err := walkPhotos(config, albumDir, func(dir string, config Config, names []string) error {
+		for _, name := range names {
+			pathInfo := path.Join(dir, name)
+			seen[pathInfo] = true
+			source := filepath.Join(albumDir, filepath.FromSlash(pathInfo))
+			stat, err := os.Stat(source)
+			if err != nil {
+				continue
+			}
+			if photo := index[pathInfo]; photo != nil && photo.Size == stat.Size() && photo.ModTime == stat.ModTime().UnixNano() {
+				continue
+			}
+
+			photo := &similarPhoto{Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), Hash: NO_HASH}
+			if img, err := thumbnailImage(config, source, thumbDir, pathInfo); err == nil {
+				photo.Hash = fmt.Sprintf("%016x", dHash(img))
+				photo.Histogram = colorHistogram(img)
+			} else {
+				a.logger.Printf("Error indexing %s: %v\n", pathInfo, err)
+			}
+			index[pathInfo] = photo
+			changed++
+			if changed%SIMILAR_SAVE_EVERY == 0 {
+				if err := saveJson(filename, index); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for pathInfo := range index {
+		if !seen[pathInfo] {
+			delete(index, pathInfo)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return nil
+	}
+	return saveJson(filename, index)
+}
+
+// The index of the album of t as it was last saved, nil when there isn't one yet
+func (a *Album) similarIndex(t TemplateSource) similarIndex {
+	filename := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir, SIMILAR_FILENAME)
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+	a.similarLock.Lock()
+	defer a.similarLock.Unlock()
+	if loaded, ok := a.similarIndexes[filename]; ok && loaded.modTime.Equal(stat.ModTime()) {
+		return loaded.index
+	}
+	index := loadSimilarIndex(filename)
+	a.similarIndexes[filename] = loadedIndex{modTime: stat.ModTime(), index: index}
+	return index
+}
+
+// Fills in Similar with the photos from anywhere in the album that look most like the one
+// being shown, leaving out those the user can't see
+func (a *Album) findSimilar(t *TemplateSource) {
+	index := a.similarIndex(*t)
+	current := path.Join(t.currentDir(), t.BaseFilename)
+	photo := index[current]
+	if photo == nil || photo.Hash == NO_HASH {
+		return
+	}
+	hash, err := strconv.ParseUint(photo.Hash, 16, 64)
+	if err != nil {
+		return
+	}
+
+	type scored struct {
+		pathInfo string
+		score    float64
+	}
+	var candidates []scored
+	for pathInfo, other := range index {
+		if pathInfo == current || other.Hash == NO_HASH {
+			continue
+		}
+		otherHash, err := strconv.ParseUint(other.Hash, 16, 64)
+		if err != nil {
+			continue
+		}
+		score := float64(hashDistance(hash, otherHash))/64 + histogramDistance(photo.Histogram, other.Histogram)
+		if score <= MAX_SIMILAR_SCORE {
+			candidates = append(candidates, scored{pathInfo, score})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].pathInfo < candidates[j].pathInfo
+	})
+
+	allowed := make(map[string]bool)
+	for _, candidate := range candidates {
+		if len(t.Similar) == SIMILAR_COUNT {
+			break
+		}
+		dir := path.Dir(candidate.pathInfo)
+		if dir == "." {
+			dir = ""
+		}
+		canAccess, ok := allowed[dir]
+		if !ok {
+			canAccess = t.CanAccess(dir)
+			allowed[dir] = canAccess
+		}
+		if !canAccess {
+			continue
+		}
+		// Shown at the size this one is
+		name := path.Base(candidate.pathInfo)
+		t.Similar = append(t.Similar, StripLink{
+			Url: t.AlbumsRootFor(t.BasePath) + "/" + path.Join(path.Dir(candidate.pathInfo), fixNextName(path.Base(t.PathInfo), name)),
+			Src: t.versionedPath(t.ThumbsRootFor(t.BasePath)+"/"+path.Join(path.Dir(candidate.pathInfo), "tn__"+name), candidate.pathInfo),
+		})
+	}
+}
+
+// How much of img is each of HISTOGRAM_LEVELS cubed colors, out of 255
+func colorHistogram(img image.Image) []byte {
+	small := imaging.Resize(img, 32, 0, imaging.Box)
+	counts := make([]int, HISTOGRAM_LEVELS*HISTOGRAM_LEVELS*HISTOGRAM_LEVELS)
+	total := 0
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r, g, b := int(small.Pix[i])*HISTOGRAM_LEVELS/256, int(small.Pix[i+1])*HISTOGRAM_LEVELS/256, int(small.Pix[i+2])*HISTOGRAM_LEVELS/256
+		counts[(r*HISTOGRAM_LEVELS+g)*HISTOGRAM_LEVELS+b]++
+		total++
+	}
+	histogram := make([]byte, len(counts))
+	if total == 0 {
+		return histogram
+	}
+	for i, count := range counts {
+		histogram[i] = byte((count*255 + total/2) / total)
+	}
+	return histogram
+}
+
+// How different two histograms are, from 0 for the same colors to 1 for none in common
+func histogramDistance(a, b []byte) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 1
+	}
+	sum := 0
+	for i := range a {
+		if a[i] > b[i] {
+			sum += int(a[i] - b[i])
+		} else {
+			sum += int(b[i] - a[i])
+		}
+	}
+	return float64(sum) / 510
+}
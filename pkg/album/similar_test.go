@@ -0,0 +1,100 @@
+package album
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestColorHistogram(t *testing.T) {
+	solid := func(c color.Color) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+		for y := 0; y < 30; y++ {
+			for x := 0; x < 40; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	red, alsoRed, blue := colorHistogram(solid(color.RGBA{250, 10, 10, 255})), colorHistogram(solid(color.RGBA{220, 40, 30, 255})), colorHistogram(solid(color.RGBA{10, 10, 250, 255}))
+	if len(red) != HISTOGRAM_LEVELS*HISTOGRAM_LEVELS*HISTOGRAM_LEVELS {
+		t.Fatalf("Expecting %d levels, was %d", HISTOGRAM_LEVELS*HISTOGRAM_LEVELS*HISTOGRAM_LEVELS, len(red))
+	}
+	if distance := histogramDistance(red, alsoRed); distance != 0 {
+		t.Errorf("Expecting reds to have the same colors, was %f", distance)
+	}
+	if distance := histogramDistance(red, blue); distance != 1 {
+		t.Errorf("Expecting red and blue to have no colors in common, was %f", distance)
+	}
+	if distance := histogramDistance(red, nil); distance != 1 {
+		t.Errorf("Expecting a missing histogram to be unlike anything, was %f", distance)
+	}
+}
+
+func TestSimilarPhotos(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsDir := a.appConfig.AlbumsDir
+	save := func(name string, img image.Image) {
+		os.MkdirAll(filepath.Dir(filepath.Join(albumsDir, name)), 0775)
+		if err := imaging.Save(img, filepath.Join(albumsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("source/lighter.jpg", gradient(false, 0))
+	save("source/2020/lighter copy.jpg", gradient(false, 20))
+	save("source/darker.jpg", gradient(true, 0))
+	save("source/private/lighter.jpg", gradient(false, 0))
+	if err := os.WriteFile(filepath.Join(albumsDir, "source/private/config.yaml"), []byte("access: private\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.SimilarPhotos = true
+	albumsConfig.Albums["test"] = albumConfig
+	a.albumsConfig = albumsConfig
+
+	// Nothing to show until the index is made in the background
+	rec := serve(a, httptest.NewRequest("GET", "/test/albums/800x600_lighter.jpg", nil))
+	if strings.Contains(rec.Body.String(), "Similar photos") {
+		t.Errorf("Expecting no similar photos before indexing, was %s", rec.Body.String())
+	}
+	a.pool.StopAndWait()
+	index := loadSimilarIndex(filepath.Join(albumsDir, "thumbs", SIMILAR_FILENAME))
+	if photo := index["2020/lighter copy.jpg"]; photo == nil || photo.Hash == NO_HASH || len(photo.Histogram) == 0 {
+		t.Fatalf("Expecting the album to be indexed, was %v", index)
+	}
+	if index[".hiddenDir/x"] != nil {
+		t.Error("Expecting hidden directories to be left out")
+	}
+
+	rec = serve(a, httptest.NewRequest("GET", "/test/albums/800x600_lighter.jpg", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `href="/test/albums/2020/800x600_lighter%20copy.jpg"`) || !strings.Contains(body, `src="/test/thumbs/2020/tn__lighter%20copy.jpg?v=`) {
+		t.Errorf("Expecting the brighter copy to be similar, was %s", body)
+	}
+	for _, notWant := range []string{"/test/albums/darker.jpg", "/test/albums/private/lighter.jpg", `href="/test/albums/800x600_lighter.jpg"`} {
+		if strings.Contains(body, notWant) {
+			t.Errorf("Expecting %s not to be similar", notWant)
+		}
+	}
+
+	// Photos that are gone are dropped from the index
+	os.Remove(filepath.Join(albumsDir, "source/2020/lighter copy.jpg"))
+	config := albumsConfig.Default
+	Merge(&config, &albumConfig.Config)
+	if err := a.updateSimilarIndex(config, filepath.Join(albumsDir, "source"), filepath.Join(albumsDir, "thumbs")); err != nil {
+		t.Fatal(err)
+	}
+	if index := loadSimilarIndex(filepath.Join(albumsDir, "thumbs", SIMILAR_FILENAME)); index["2020/lighter copy.jpg"] != nil {
+		t.Errorf("Expecting a removed photo to be dropped, was %v", index)
+	}
+}
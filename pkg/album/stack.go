@@ -0,0 +1,288 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// The stack a grid shows all of, by the name of its pick
+	STACK_PARAM = "stack"
+
+	DEFAULT_STACK_SECONDS  = 2
+	DEFAULT_STACK_DISTANCE = 10
+)
+
+// Stacks each run of images in Files that were taken in the same burst, or within
+// stackSeconds of each other and looking alike, into a tile of its pick.  Runs are of the
+// images by name, the order a camera takes them in, and the tile goes where its pick is,
+// which order.txt can move.  The stack whose pick is expand is shown whole in its place.
+// Photos that haven't been hashed yet are hashed in the background, and stacked once they
+// have been.
+func (a *Album) stackFiles(t *TemplateSource, expand string) {
+	dir := t.currentDir()
+	infoFilename := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir, dir, INFO_FILENAME)
+	a.infoLock.Lock()
+	infos := loadDirInfo(infoFilename)
+	a.infoLock.Unlock()
+
+	// The EXIF of new photos is read without infoLock, and merged into .info.json after
+	var changed []string
+	lookup := func(name string) *photoInfo {
+		info, fresh := infos.lookup(filepath.Join(t.baseDir(), dir, name), name)
+		if fresh {
+			changed = append(changed, name)
+		}
+		return info
+	}
+	var unhashed []string
+	hash := func(name string, info *photoInfo) (uint64, bool) {
+		if info.Hash == "" {
+			unhashed = append(unhashed, name)
+			return 0, false
+		}
+		hash, err := strconv.ParseUint(info.Hash, 16, 64)
+		return hash, err == nil
+	}
+	together := func(prev, next string) bool {
+		p, n := lookup(prev), lookup(next)
+		if p == nil || n == nil {
+			return false
+		}
+		if p.BurstId != "" || n.BurstId != "" {
+			return p.BurstId == n.BurstId
+		}
+		if p.Taken.IsZero() || n.Taken.IsZero() {
+			return false
+		}
+		apart := n.Taken.Sub(p.Taken).Seconds()
+		if apart < 0 {
+			apart = -apart
+		}
+		if apart > float64(t.Current.GetStackSeconds()) {
+			return false
+		}
+		// Both, so the background hashes all that's missing at once
+		pHash, pOk := hash(prev, p)
+		nHash, nOk := hash(next, n)
+		return pOk && nOk && hashDistance(pHash, nHash) <= t.Current.GetStackDistance()
+	}
+
+	byName := make([]os.DirEntry, len(t.Files))
+	copy(byName, t.Files)
+	sort.SliceStable(byName, func(i, j int) bool { return byName[i].Name() < byName[j].Name() })
+	// The pick of the stack each image is in, and the runs by their pick
+	picks := make(map[string]string)
+	runs := make(map[string][]os.DirEntry)
+	var run []os.DirEntry
+	flush := func() {
+		if len(run) > 1 {
+			pick := t.stackPick(run, infos).Name()
+			for _, file := range run {
+				picks[file.Name()] = pick
+			}
+			runs[pick] = run
+		}
+		run = nil
+	}
+	for _, file := range byName {
+		if !t.Current.IsImageFile(file.Name()) {
+			flush()
+			continue
+		}
+		if len(run) > 0 && !together(run[len(run)-1].Name(), file.Name()) {
+			flush()
+		}
+		run = append(run, file)
+	}
+	flush()
+
+	var files []os.DirEntry
+	for _, file := range t.Files {
+		pick, ok := picks[file.Name()]
+		switch {
+		case !ok:
+			files = append(files, file)
+		case pick != file.Name():
+			// Shown as its pick
+		case pick == expand:
+			t.Expanded = expand
+			files = append(files, runs[pick]...)
+		default:
+			if t.Stacks == nil {
+				t.Stacks = make(map[string][]string)
+			}
+			for _, member := range runs[pick] {
+				t.Stacks[pick] = append(t.Stacks[pick], member.Name())
+			}
+			files = append(files, file)
+		}
+	}
+	t.Files = files
+
+	if len(changed) > 0 {
+		if err := a.mergeDirInfo(infoFilename, infos, changed); err != nil {
+			a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+		}
+	}
+	thumbDir := filepath.Join(t.AppConfig.AlbumsDir, t.AlbumConfig.ThumbDir)
+	var pending []string
+	a.infoLock.Lock()
+	for _, name := range unhashed {
+		key := filepath.Join(thumbDir, dir, name)
+		if !a.hashing[key] {
+			a.hashing[key] = true
+			pending = append(pending, name)
+		}
+	}
+	a.infoLock.Unlock()
+
+	// Submitting can wait for a free worker, which could be waiting for infoLock
+	if len(pending) > 0 {
+		config, albumDir := t.Current, t.baseDir()
+		a.pool.Submit(func() {
+			a.hashPhotos(config, albumDir, thumbDir, dir, pending)
+		})
+	}
+}
+
+// Hashes the photos names in dir of the album at albumDir, from their thumbnails when
+// they've been made, into its .info.json.  A photo that changes meanwhile is left to be
+// hashed again.
+func (a *Album) hashPhotos(config Config, albumDir, thumbDir, dir string, names []string) {
+	type hashed struct {
+		size, modTime int64
+		hash          string
+	}
+	hashes := make(map[string]hashed)
+	for _, name := range names {
+		pathInfo := path.Join(dir, name)
+		source := filepath.Join(albumDir, filepath.FromSlash(pathInfo))
+		stat, err := os.Stat(source)
+		if err != nil {
+			continue
+		}
+		photo := hashed{size: stat.Size(), modTime: stat.ModTime().UnixNano(), hash: NO_HASH}
+		if hash, err := photoHash(config, source, thumbDir, pathInfo); err == nil {
+			photo.hash = fmt.Sprintf("%016x", hash)
+		} else {
+			a.logger.Printf("Error hashing %s: %v\n", pathInfo, err)
+		}
+		hashes[name] = photo
+	}
+
+	infoFilename := filepath.Join(thumbDir, filepath.FromSlash(dir), INFO_FILENAME)
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	infos := loadDirInfo(infoFilename)
+	for _, name := range names {
+		delete(a.hashing, filepath.Join(thumbDir, filepath.FromSlash(dir), name))
+		photo, ok := hashes[name]
+		if !ok {
+			continue
+		}
+		info, _ := infos.lookup(filepath.Join(albumDir, filepath.FromSlash(dir), name), name)
+		if info != nil && info.Size == photo.size && info.ModTime == photo.modTime {
+			info.Hash = photo.hash
+		}
+	}
+	if err := infos.save(infoFilename); err != nil {
+		a.logger.Printf("Error saving %s: %v\n", infoFilename, err)
+	}
+}
+
+// The photo a stack is shown as, the one the camera marked as the pick of the burst, or else
+// the first one with a caption, or else the first one
+func (t *TemplateSource) stackPick(run []os.DirEntry, infos dirInfo) os.DirEntry {
+	for _, file := range run {
+		if info := infos[file.Name()]; info != nil && info.BurstPick {
+			return file
+		}
+	}
+	for _, file := range run {
+		if _, ok := t.CaptionMap[file.Name()]; ok {
+			return file
+		}
+	}
+	return run[0]
+}
+
+// The dHash of the image at source, pathInfo in the album
+func photoHash(config Config, source, thumbDir, pathInfo string) (uint64, error) {
+	img, err := thumbnailImage(config, source, thumbDir, pathInfo)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+// The image at source, pathInfo in the album, read from its tn__ thumbnail in thumbDir
+// when that's newer than it, which is much quicker than decoding the original
+func thumbnailImage(config Config, source, thumbDir, pathInfo string) (image.Image, error) {
+	sourceStat, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	thumbnail := filepath.Join(thumbDir, path.Dir(pathInfo), "tn__"+path.Base(pathInfo))
+	if stat, err := os.Stat(thumbnail); err == nil && !stat.ModTime().Before(sourceStat.ModTime()) {
+		if img, err := imaging.Open(thumbnail); err == nil {
+			return img, nil
+		}
+	}
+
+	decoder, ok := config.DetectMediaType(source).(ImageDecoder)
+	if !ok {
+		return nil, fmt.Errorf("can't decode %s", pathInfo)
+	}
+	return decoder.Decode(source, filepath.Join(thumbDir, heifRendition(pathInfo)))
+}
+
+// A 64 bit difference hash, whether each pixel of the image shrunk to 9x8 and made gray
+// is darker than the one to its right.  Resized or recompressed copies of a photo have
+// hashes a few bits apart.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x*4] < row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// How many bits two hashes differ in
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// The number of photos in the stack shown as name, 0 when it isn't one
+func (t TemplateSource) StackCount(name string) int {
+	return len(t.Stacks[name])
+}
+
+// Link to the grid with the stack shown as name expanded
+func (t TemplateSource) StackUrl(name string) string {
+	return "?" + STACK_PARAM + "=" + url.QueryEscape(name)
+}
@@ -0,0 +1,167 @@
+package album
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Gets lighter to the right, or to the left when reversed, shifted brighter by offset
+func gradient(reversed bool, offset int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 90, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 90; x++ {
+			level := x * 2
+			if reversed {
+				level = 180 - level
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(level + offset)})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	lighter, brighter, darker := dHash(gradient(false, 0)), dHash(gradient(false, 40)), dHash(gradient(true, 0))
+	if hashDistance(lighter, brighter) > 2 {
+		t.Errorf("Expecting a brighter copy to hash alike, was %016x %016x", lighter, brighter)
+	}
+	if hashDistance(lighter, darker) < 60 {
+		t.Errorf("Expecting the reverse to hash apart, was %016x %016x", lighter, darker)
+	}
+	if hashDistance(0, 0xff) != 8 || hashDistance(lighter, lighter) != 0 {
+		t.Error("Expecting the distance to count the bits that differ")
+	}
+}
+
+func TestStackBursts(t *testing.T) {
+	a := setupTestAlbum(t)
+	source := filepath.Join(a.appConfig.AlbumsDir, "source")
+	exif := func(taken, burst string) []byte {
+		return makeExif(t, binary.LittleEndian, "2021:07:04 "+taken, "", burst)
+	}
+	files := map[string][]byte{
+		"burst_1.jpg": makeExifJpeg(t, gradient(false, 0), exif("10:00:00", "APPLE-1"), ""),
+		"burst_2.jpg": makeExifJpeg(t, gradient(true, 0), exif("10:00:00", "APPLE-1"), ""),
+		"burst_3.jpg": makeExifJpeg(t, gradient(false, 0), exif("10:00:01", "APPLE-1"), ""),
+		"near_1.jpg":  makeExifJpeg(t, gradient(false, 0), exif("11:00:00", ""), ""),
+		"near_2.jpg":  makeExifJpeg(t, gradient(false, 30), exif("11:00:01", ""), ""),
+		"near_3.jpg":  makeExifJpeg(t, gradient(true, 0), exif("11:00:02", ""), ""),
+		"near_4.jpg":  makeExifJpeg(t, gradient(true, 0), exif("11:00:30", ""), ""),
+		"pixel_1.jpg": makeExifJpeg(t, gradient(false, 0), nil, `<rdf:Description GCamera:BurstID="P1"/>`),
+		"pixel_2.jpg": makeExifJpeg(t, gradient(false, 0), nil, `<rdf:Description GCamera:BurstID="P1" GCamera:BurstPrimary="1"/>`),
+		"pixel_3.jpg": makeExifJpeg(t, gradient(false, 0), nil, `<rdf:Description GCamera:BurstID="P2"/>`),
+		"caption.txt": []byte("__END__\nburst_2.jpg: The keeper\n"),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(source, name), contents, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Photos taken together are only stacked by how they look once they've been hashed,
+	// which the first request leaves to the background
+	albumConfig := albumsConfig.Albums["test"]
+	albumConfig.Config.StackBursts = true
+	albumsConfig.Albums["test"] = albumConfig
+	a.albumsConfig = albumsConfig
+	page := serve(a, httptest.NewRequest("GET", "/test/albums/", nil)).Body.String()
+	if !strings.Contains(page, `<a href="?stack=burst_2.jpg" data-stack="3">`) || !strings.Contains(page, `<a href="1024x768_near_2.jpg">`) {
+		t.Errorf("Expecting only the burst to be stacked before hashing, was %s", page)
+	}
+	a.pool.StopAndWait()
+
+	var tests = []struct {
+		name    string
+		stack   bool
+		url     string
+		want    []string
+		notWant []string
+	}{
+		{"off", false, "/test/albums/", []string{`/tn__burst_1.jpg`, `/tn__burst_3.jpg`, `/tn__near_2.jpg`, `/tn__pixel_1.jpg`}, []string{`data-stack="`, "Collapse stack"}},
+		{"stacked", true, "/test/albums/", []string{
+			`<a href="?stack=burst_2.jpg" data-stack="3">`,
+			"The keeper",
+			`<a href="?stack=near_1.jpg" data-stack="2">`,
+			`<a href="1024x768_near_3.jpg">`,
+			`<a href="1024x768_near_4.jpg">`,
+			`<a href="?stack=pixel_2.jpg" data-stack="2">`,
+			`<a href="1024x768_pixel_3.jpg">`,
+			`<a href="1024x768_Bob_and_Jenny.jpg">`,
+			`<a class="video" href="movie.avi?playvideo=1">`,
+		}, []string{`/tn__burst_1.jpg`, `/tn__burst_3.jpg`, `/tn__near_2.jpg`, `/tn__pixel_1.jpg`, "Collapse stack"}},
+		{"expanded", true, "/test/albums/?stack=burst_2.jpg", []string{
+			`<a href="1024x768_burst_1.jpg">`,
+			`<a href="1024x768_burst_2.jpg">`,
+			`<a href="1024x768_burst_3.jpg">`,
+			`<a href="?stack=near_1.jpg" data-stack="2">`,
+			`The keeper · <a href="./">Collapse stack</a></p>`,
+		}, []string{`data-stack="3"`}},
+	}
+	for _, test := range tests {
+		albumConfig := albumsConfig.Albums["test"]
+		albumConfig.Config.StackBursts = test.stack
+		albumsConfig.Albums["test"] = albumConfig
+		a.albumsConfig = albumsConfig
+
+		page := serve(a, httptest.NewRequest("GET", test.url, nil)).Body.String()
+		for _, want := range test.want {
+			if !strings.Contains(page, want) {
+				t.Errorf("%s: expecting %s, was %s", test.name, want, page)
+			}
+		}
+		for _, notWant := range test.notWant {
+			if strings.Contains(page, notWant) {
+				t.Errorf("%s: expecting no %s, was %s", test.name, notWant, page)
+			}
+		}
+	}
+
+	// The single pages still go through every photo
+	page = serve(a, httptest.NewRequest("GET", "/test/albums/640x480_burst_2.jpg", nil)).Body.String()
+	if !strings.Contains(page, "tn__burst_1.jpg") || !strings.Contains(page, "tn__burst_3.jpg") {
+		t.Errorf("Expecting the whole burst in the strip, was %s", page)
+	}
+
+	infos := loadDirInfo(filepath.Join(a.appConfig.AlbumsDir, "thumbs", INFO_FILENAME))
+	if infos["burst_1.jpg"] == nil || infos["burst_1.jpg"].BurstId != "APPLE-1" || infos["near_2.jpg"] == nil || infos["near_2.jpg"].Hash == "" {
+		t.Errorf("Expecting the photos to be cached in thumbDir, was %v", infos)
+	}
+	if infos["burst_1.jpg"] != nil && infos["burst_1.jpg"].Hash != "" {
+		t.Error("Expecting a burst to be stacked without hashing it")
+	}
+	if rec := serve(a, httptest.NewRequest("GET", "/test/thumbs/"+INFO_FILENAME, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("Expecting the cache not to be served, was %d", rec.Code)
+	}
+
+	// order.txt moves a stack by its pick, bursts are still found by name
+	if err := os.WriteFile(filepath.Join(source, ORDER_FILENAME), []byte("pixel_3.jpg\nburst_2.jpg\nnear_4.jpg\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	inOrder := func(url string, order ...string) {
+		page := serve(a, httptest.NewRequest("GET", url, nil)).Body.String()
+		last := -1
+		for _, want := range order {
+			i := strings.Index(page, want)
+			if i <= last {
+				t.Errorf("%s: expecting %s after %v, was %s", url, want, order, page)
+				return
+			}
+			last = i
+		}
+	}
+	inOrder("/test/albums/", `1024x768_pixel_3.jpg"`, `?stack=burst_2.jpg"`, `1024x768_near_4.jpg"`, `1024x768_Bob_and_Jenny.jpg"`, `?stack=near_1.jpg"`, `?stack=pixel_2.jpg"`)
+	inOrder("/test/albums/?stack=burst_2.jpg", `1024x768_pixel_3.jpg"`, `1024x768_burst_1.jpg"`, `1024x768_burst_2.jpg"`, `1024x768_burst_3.jpg"`, `1024x768_near_4.jpg"`)
+	// The single pages go through them in the same order
+	inOrder("/test/albums/640x480_pixel_3.jpg", `tn__pixel_3.jpg`, `tn__burst_2.jpg`, `tn__near_4.jpg`, `tn__Bob_and_Jenny.jpg`, `tn__burst_1.jpg`)
+}
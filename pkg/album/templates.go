@@ -0,0 +1,122 @@
+package album
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+)
+
+const (
+	THEME_MODERN  = "modern"
+	THEME_LEGACY  = "legacy"
+	DEFAULT_THEME = THEME_MODERN
+)
+
+//go:embed themes
+var themeFiles embed.FS
+
+// Helpers for templates on top of the TemplateSource methods
+var templateFuncs = template.FuncMap{
+	"beautify":        beautify,
+	"changeExtension": ChangeExtension,
+	"changeSize":      changeSize,
+	"pathJoin":        path.Join,
+}
+
+// The built in themes, one directory under themes each
+var themes = loadThemes()
+
+func loadThemes() map[string]*template.Template {
+	themes := make(map[string]*template.Template)
+	dirs, err := fs.ReadDir(themeFiles, "themes")
+	if err != nil {
+		panic(err)
+	}
+	for _, dir := range dirs {
+		themes[dir.Name()] = template.Must(template.New("").Funcs(templateFuncs).ParseFS(themeFiles, path.Join("themes", dir.Name(), "*.html")))
+	}
+	return themes
+}
+
+// The theme templates with the *.html files of the installation's and then the album's
+// templateDir parsed over them, so an override only needs the pages or {{ define }} blocks it changes
+func (a *Album) loadTemplates(t TemplateSource) (*template.Template, error) {
+	tmpl, err := themes[t.theme()].Clone()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range t.templateDirs() {
+		files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		if tmpl, err = tmpl.ParseFiles(files...); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// The theme of the directory, or of the albums for the index page.  An unknown theme gets the default.
+func (t TemplateSource) theme() string {
+	theme := t.Current.Theme
+	if theme == "" {
+		theme = t.AlbumsConfig.Default.Theme
+	}
+	if _, ok := themes[theme]; !ok {
+		return DEFAULT_THEME
+	}
+	return theme
+}
+
+func (t TemplateSource) templateDirs() []string {
+	dirs := make([]string, 0, 2)
+	for _, dir := range []string{t.AppConfig.TemplateDir, t.AlbumConfig.TemplateDir} {
+		if dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(t.AppConfig.AlbumsDir, dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Executes page into a buffer first so a broken override gets a 500 instead of half a page
+func (a *Album) render(w http.ResponseWriter, req *http.Request, t TemplateSource, page string) {
+	a.renderStatus(w, req, t, page, http.StatusOK)
+}
+
+func (a *Album) renderStatus(w http.ResponseWriter, req *http.Request, t TemplateSource, page string, status int) {
+	tmpl, err := a.loadTemplates(t)
+	if err != nil {
+		a.logger.Printf("Error loading templates: %v\n", err)
+		http.Error(w, "Error loading templates", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, page, t); err != nil {
+		a.logger.Printf("Error executing %s: %v\n", page, err)
+		http.Error(w, "Error executing templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	writeCompressed(w, req, status, buf.Bytes())
+}
@@ -0,0 +1,102 @@
+package album
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateDir(t *testing.T) {
+	a := setupTestAlbum(t)
+	a.appConfig.TemplateDir = "site"
+	files := map[string]string{
+		"site/layout.html":   `{{ define "header" }}<HTML><BODY class="site">{{ .CaptionHtml }}{{ end }}`,
+		"site/index.html":    `<ul>{{ range .SortedAlbumTitles }}<li>{{ .Title }}</li>{{ end }}</ul>`,
+		"family/grid.html":   `{{ template "header" . }}{{ range .Files }}<img src="{{ $.SizedUrl .Name "sm" }}" title="{{ beautify .Name }}">{{ end }}{{ template "footer" . }}`,
+		"broken/single.html": `{{ .NoSuchField }}`,
+	}
+	for name, contents := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(a.appConfig.AlbumsDir, name)), 0775)
+		if err := os.WriteFile(filepath.Join(a.appConfig.AlbumsDir, name), []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["family"] = AlbumConfig{AlbumTitle: "Family", AlbumDir: "source", ThumbDir: "thumbs", TemplateDir: "family"}
+	albumsConfig.Albums["broken"] = AlbumConfig{AlbumTitle: "Broken", AlbumDir: "source", ThumbDir: "thumbs", TemplateDir: filepath.Join(a.appConfig.AlbumsDir, "broken")}
+	a.albumsConfig = albumsConfig
+
+	var tests = []struct {
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/", http.StatusOK, "<li>Family</li>"},
+		{"/test/albums/", http.StatusOK, `<BODY class="site"><H1>Header</H1>`},
+		{"/test/albums/", http.StatusOK, `<a href="1024x768_Bob_and_Jenny.jpg">`},
+		{"/family/albums/", http.StatusOK, `<BODY class="site">`},
+		{"/family/albums/", http.StatusOK, `<img src="/family/thumbs/640x480_Bob_and_Jenny.jpg?v=`},
+		{"/family/albums/", http.StatusOK, `Back to Family`},
+		{"/broken/albums/", http.StatusOK, `<BODY class="site">`},
+		{"/broken/albums/Bob_and_Jenny.jpg?slide_show=sm", http.StatusInternalServerError, "Error executing templates"},
+	}
+	for _, test := range tests {
+		rec := serve(a, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s: expecting status %d, was %d", test.url, test.wantStatus, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s: expecting body to contain %s, was %s", test.url, test.wantBody, rec.Body.String())
+		}
+	}
+}
+
+func TestThemes(t *testing.T) {
+	a := setupTestAlbum(t)
+	albumsConfig, err := LoadAlbumsConfigFile(a.appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsConfig.Albums["dark"] = AlbumConfig{AlbumTitle: "Dark", AlbumDir: "source", ThumbDir: "thumbs", Config: Config{ColorScheme: "dark"}}
+	albumsConfig.Albums["legacy"] = AlbumConfig{AlbumTitle: "Legacy", AlbumDir: "source", ThumbDir: "thumbs", Config: Config{Theme: THEME_LEGACY}}
+	albumsConfig.Albums["unknown"] = AlbumConfig{AlbumTitle: "Unknown", AlbumDir: "source", ThumbDir: "thumbs", Config: Config{Theme: "nosuchtheme"}}
+	a.albumsConfig = albumsConfig
+
+	var tests = []struct {
+		url      string
+		wantBody string
+		notBody  string
+	}{
+		{"/test/albums/", `<ul class="grid">`, "<TABLE"},
+		{"/test/albums/", `loading="lazy"`, ""},
+		{"/test/albums/", `srcset="/test/thumbs/tn__Bob_and_Jenny.jpg?v=`, ""},
+		{"/test/albums/", ` 50w, /test/thumbs/640x480_Bob_and_Jenny.jpg?v=`, ""},
+		{"/test/albums/", `data-scheme="auto"`, ""},
+		{"/dark/albums/", `data-scheme="dark"`, ""},
+		{"/test/albums/1024x768_Bob_and_Jenny.jpg", `srcset=`, ""},
+		{"/test/albums/Bob_and_Jenny.jpg?slide_show=sm", `640x480_Bob_and_Jenny.jpg" alt="Bob_and_Jenny.jpg"`, "srcset="},
+		{"/legacy/albums/", "<TABLE", `class="grid"`},
+		{"/legacy/albums/", `SRC="/legacy/thumbs/tn__Bob_and_Jenny.jpg?v=`, ""},
+		{"/legacy/albums/", `SRC="/legacy/thumbs/tn__movie.png?v=`, ""},
+		{"/unknown/albums/", `<ul class="grid">`, ""},
+	}
+	for _, test := range tests {
+		rec := serve(a, httptest.NewRequest("GET", test.url, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expecting status 200, was %d", test.url, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.wantBody) {
+			t.Errorf("GET %s: expecting body to contain %s, was %s", test.url, test.wantBody, rec.Body.String())
+		}
+		if test.notBody != "" && strings.Contains(rec.Body.String(), test.notBody) {
+			t.Errorf("GET %s: expecting body not to contain %s", test.url, test.notBody)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Package albumclient is a client for the album JSON api served under /api/v1/.
+package albumclient
+
+/*
+   Copyright 1998-2021 James D Woodgate.  All rights reserved.
+   It may be used and modified freely, but I do request that this copyright
+   notice remain attached to the file.  You may modify this module as you
+   wish, but if you redistribute a modified version, please attach a note
+   listing the modifications you have made.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	API_PREFIX = "/api/v1/"
+
+	CONVERSION_NONE    = "none"
+	CONVERSION_MISSING = "missing"
+	CONVERSION_PENDING = "pending"
+	CONVERSION_DONE    = "done"
+	CONVERSION_FAILED  = "failed"
+
+	// Size names accepted by DownloadVariant besides the keys of Media.Variants
+	ORIGINAL  = "original"
+	THUMBNAIL = "thumbnail"
+)
+
+// Returned by a WalkFunc to skip the sub directories of the current directory
+var SkipDir = errors.New("skip this directory")
+
+type Client struct {
+	BaseUrl    string
+	HttpClient *http.Client
+}
+
+type Album struct {
+	Key     string `json:"key"`
+	Title   string `json:"title"`
+	Url     string `json:"url"`
+	TreeUrl string `json:"treeUrl"`
+}
+
+type Config struct {
+	BodyArgs            string `json:"bodyArgs"`
+	VideoThumbnailSize  string `json:"videoThumbnailSize"`
+	ThumbnailUse        string `json:"thumbnailUse"`
+	ThumbnailWidth      int    `json:"thumbnailWidth"`
+	ThumbnailAspect     string `json:"thumbnailAspect"`
+	DefaultBrowserWidth int    `json:"defaultBrowserWidth"`
+	SlideShowDelay      int    `json:"slideShowDelay"`
+	NumberOfColumns     int    `json:"numberOfColumns"`
+	OutsideTableBorder  int    `json:"outsideTableBorder"`
+	InsideTableBorder   int    `json:"insideTableBorder"`
+	EditMode            bool   `json:"editMode"`
+	AllowFinalResize    bool   `json:"allowFinalResize"`
+	ReverseDirs         bool   `json:"reverseDirs"`
+	ReversePics         bool   `json:"reversePics"`
+}
+
+type Dir struct {
+	Name    string `json:"name"`
+	Title   string `json:"title"`
+	Path    string `json:"path"`
+	Url     string `json:"url"`
+	TreeUrl string `json:"treeUrl"`
+}
+
+type Conversion struct {
+	State   string `json:"state"`
+	WebmUrl string `json:"webmUrl"`
+}
+
+type Media struct {
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Type         string            `json:"type"`
+	Title        string            `json:"title"`
+	Caption      string            `json:"caption"`
+	Url          string            `json:"url"`
+	ThumbnailUrl string            `json:"thumbnailUrl"`
+	Variants     map[string]string `json:"variants"`
+	Conversion   *Conversion       `json:"conversion"`
+}
+
+type Tree struct {
+	Album       string  `json:"album"`
+	AlbumTitle  string  `json:"albumTitle"`
+	Path        string  `json:"path"`
+	Title       string  `json:"title"`
+	Url         string  `json:"url"`
+	Config      Config  `json:"config"`
+	CaptionHtml string  `json:"captionHtml"`
+	Dirs        []Dir   `json:"dirs"`
+	Files       []Media `json:"files"`
+}
+
+// Captions of a single directory, Html is the header section of caption.txt
+// and Captions maps filenames to their caption
+type Captions struct {
+	Html     string
+	Captions map[string]string
+}
+
+// Any non 2xx response from the server
+type Error struct {
+	StatusCode int
+	Message    string `json:"error"`
+}
+
+// Called for every directory visited by Walk
+type WalkFunc func(tree *Tree) error
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("album api: %d %s", e.StatusCode, e.Message)
+}
+
+// baseUrl is the scheme, host and optional path the album handler is mounted at,
+// ie http://localhost:8000 or https://intranet.example/photos
+func New(baseUrl string) *Client {
+	return &Client{
+		BaseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		HttpClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) ListAlbums(ctx context.Context) ([]Album, error) {
+	var albums struct {
+		Albums []Album `json:"albums"`
+	}
+	if err := c.getJson(ctx, c.mountPath()+API_PREFIX+"albums", &albums); err != nil {
+		return nil, err
+	}
+	return albums.Albums, nil
+}
+
+// Lists a single directory of an album, an empty dirPath is the top of the album
+func (c *Client) Tree(ctx context.Context, album, dirPath string) (*Tree, error) {
+	var tree Tree
+	if err := c.getJson(ctx, c.apiPath(album, "tree", dirPath)+"/", &tree); err != nil {
+		return nil, err
+	}
+	return &tree, nil
+}
+
+func (c *Client) Media(ctx context.Context, album, filePath string) (*Media, error) {
+	var media Media
+	if err := c.getJson(ctx, c.apiPath(album, "media", filePath), &media); err != nil {
+		return nil, err
+	}
+	return &media, nil
+}
+
+func (c *Client) Captions(ctx context.Context, album, dirPath string) (*Captions, error) {
+	tree, err := c.Tree(ctx, album, dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	captions := &Captions{Html: tree.CaptionHtml, Captions: make(map[string]string)}
+	for _, file := range tree.Files {
+		if file.Caption != "" {
+			captions.Captions[file.Name] = file.Caption
+		}
+	}
+	return captions, nil
+}
+
+// Visits dirPath and all of its sub directories depth first, in the order the server lists them.
+// If fn returns SkipDir the sub directories of that directory are not visited, any other error
+// stops the walk and is returned.
+func (c *Client) Walk(ctx context.Context, album, dirPath string, fn WalkFunc) error {
+	tree, err := c.Tree(ctx, album, dirPath)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tree)
+	if err == SkipDir {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range tree.Dirs {
+		if err := c.Walk(ctx, album, dir.Path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the original file to w
+func (c *Client) Download(ctx context.Context, media *Media, w io.Writer) (int64, error) {
+	return c.DownloadVariant(ctx, media, ORIGINAL, w)
+}
+
+// Copies a version of the file to w, size is ORIGINAL, THUMBNAIL or one of the keys of
+// media.Variants (sm, med, lg).  Asking for a variant generates it on the server if needed.
+func (c *Client) DownloadVariant(ctx context.Context, media *Media, size string, w io.Writer) (int64, error) {
+	var variantUrl string
+	switch size {
+	case ORIGINAL:
+		variantUrl = media.Url
+	case THUMBNAIL:
+		variantUrl = media.ThumbnailUrl
+	default:
+		variantUrl = media.Variants[size]
+	}
+	if variantUrl == "" {
+		return 0, fmt.Errorf("album api: %s has no %s variant", media.Path, size)
+	}
+
+	resp, err := c.get(ctx, variantUrl)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// Polls the media file every interval until its conversion is no longer pending.  Returns
+// an error if the conversion failed or ctx is done first.
+func (c *Client) WaitForConversion(ctx context.Context, album, filePath string, interval time.Duration) (*Media, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		media, err := c.Media(ctx, album, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if media.Conversion == nil {
+			return media, nil
+		}
+
+		switch media.Conversion.State {
+		case CONVERSION_NONE, CONVERSION_DONE:
+			return media, nil
+		case CONVERSION_FAILED:
+			return media, fmt.Errorf("album api: conversion of %s failed", filePath)
+		}
+
+		select {
+		case <-ctx.Done():
+			return media, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) getJson(ctx context.Context, urlPath string, v interface{}) error {
+	resp, err := c.get(ctx, urlPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// urlPath is an unescaped absolute path on the server as returned in the api responses
+func (c *Client) get(ctx context.Context, urlPath string) (*http.Response, error) {
+	escaped := strings.Split(urlPath, "/")
+	for idx, elem := range escaped {
+		escaped[idx] = url.PathEscape(elem)
+	}
+
+	base, err := url.Parse(c.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", base.Scheme+"://"+base.Host+strings.Join(escaped, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func (c *Client) apiPath(album, kind, p string) string {
+	return c.mountPath() + API_PREFIX + path.Join(album, kind, p)
+}
+
+// The path part of BaseUrl, urls returned by the server already include it
+func (c *Client) mountPath() string {
+	base, err := url.Parse(c.BaseUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(base.Path, "/")
+}
@@ -0,0 +1,172 @@
+package albumclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/jddwoody/album/pkg/album"
+)
+
+// Starts the real album handler on a "test" album, mounted at /photos
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	albumsDir := t.TempDir()
+	for _, dir := range []string{"source/2020/Summer Trip", "source/2021", "thumbs"} {
+		if err := os.MkdirAll(filepath.Join(albumsDir, dir), 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for _, name := range []string{"source/a.jpg", "source/2020/Summer Trip/beach #1.jpg"} {
+		if err := imaging.Save(img, filepath.Join(albumsDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"albumsconfig.yaml":   "default:\n    thumbnailWidth: 50\nalbums:\n  test:\n    albumTitle: Test Album\n    albumDir: source\n    thumbDir: thumbs\n",
+		"source/caption.txt":  "<H1>Header</H1>\n__END__\na.jpg: The letter a\n",
+		"source/2021/old.avi": "not really a movie",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(albumsDir, name), []byte(contents), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/photos/", album.New(
+		album.WithAppConfig(&album.AppConfig{AlbumsDir: albumsDir}),
+		album.WithPrefix("/photos"),
+		album.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, albumsDir
+}
+
+func TestListAlbums(t *testing.T) {
+	server, _ := newTestServer(t)
+	albums, err := New(server.URL + "/photos").ListAlbums(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || albums[0].Key != "test" || albums[0].Title != "Test Album" {
+		t.Errorf("Unexpected albums: %v", albums)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := New(server.URL + "/photos/")
+
+	var visited []string
+	err := client.Walk(context.Background(), "test", "", func(tree *Tree) error {
+		visited = append(visited, tree.Path)
+		if tree.Path == "2021" {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "2020", "2020/Summer Trip", "2021"}
+	if fmt.Sprint(visited) != fmt.Sprint(want) {
+		t.Errorf("Expecting to visit %v, visited %v", want, visited)
+	}
+
+	stop := errors.New("stop")
+	err = client.Walk(context.Background(), "test", "", func(tree *Tree) error { return stop })
+	if err != stop {
+		t.Errorf("Expecting walk to return the error from fn, got %v", err)
+	}
+}
+
+func TestCaptions(t *testing.T) {
+	server, _ := newTestServer(t)
+	captions, err := New(server.URL+"/photos").Captions(context.Background(), "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captions.Html != "<H1>Header</H1>\n" || captions.Captions["a.jpg"] != "The letter a" {
+		t.Errorf("Unexpected captions: %v", captions)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server, albumsDir := newTestServer(t)
+	client := New(server.URL + "/photos")
+	ctx := context.Background()
+
+	media, err := client.Media(ctx, "test", "2020/Summer Trip/beach #1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var original bytes.Buffer
+	if _, err := client.Download(ctx, media, &original); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(filepath.Join(albumsDir, "source/2020/Summer Trip/beach #1.jpg"))
+	if !bytes.Equal(original.Bytes(), want) {
+		t.Error("Downloaded original does not match the file")
+	}
+
+	for size, wantWidth := range map[string]int{THUMBNAIL: 50, "sm": 640} {
+		var variant bytes.Buffer
+		if _, err := client.DownloadVariant(ctx, media, size, &variant); err != nil {
+			t.Fatalf("%s: %v", size, err)
+		}
+		img, err := imaging.Decode(&variant)
+		if err != nil {
+			t.Fatalf("%s: %v", size, err)
+		}
+		if img.Bounds().Dx() != wantWidth {
+			t.Errorf("Expecting %s to be %d wide, was %d", size, wantWidth, img.Bounds().Dx())
+		}
+	}
+
+	if _, err := client.DownloadVariant(ctx, media, "huge", &original); err == nil {
+		t.Error("Expecting an error for an unknown size")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+	_, err := New(server.URL+"/photos").Tree(context.Background(), "nosuchalbum", "")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "no such album: nosuchalbum" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestWaitForConversion(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := New(server.URL + "/photos")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	media, err := client.WaitForConversion(ctx, "test", "a.jpg", time.Millisecond)
+	if err != nil || media.Conversion != nil {
+		t.Errorf("Images should not need conversion: %v %v", media, err)
+	}
+
+	// Not a real video, so the conversion always fails
+	media, err = client.WaitForConversion(ctx, "test", "2021/old.avi", 10*time.Millisecond)
+	if err == nil || media == nil || media.Conversion.State != CONVERSION_FAILED {
+		t.Errorf("Expecting conversion to fail: %v %v", media, err)
+	}
+}